@@ -2,6 +2,7 @@ package batcher
 
 import (
 	"context"
+	"errors"
 	"math"
 	"sync"
 	"time"
@@ -18,115 +19,336 @@ type BatchBuilder interface {
 	Build([][]byte) [][]byte
 }
 
+// BatchFilter defines optional builder interface
+// Filter is called once per flush on the buffered payloads before splitting them into chunks,
+// it keeps the state of builder out of Build that could be repeated on the same chunk
+type BatchFilter interface {
+	Filter([][]byte) [][]byte
+}
+
 // BatchHandler defines handler
 type BatchHandler func(context.Context, []byte) error
 
+// ErrClosed is returned on adding to or flushing the exited batcher
+var ErrClosed = errors.New("batcher is closed")
+
+// Limits defines the batch limits, zero means no limit
+// MaxItems and MaxBytes limit the input payloads built together,
+// MaxBytes also limits the built payload: the oversized one is rebuilt by halves of input,
+// the single input payload is handled as is
+// MaxBuffer limits the buffered bytes: Add blocks while the buffer is full
+type Limits struct {
+	MaxItems  int
+	MaxBytes  int
+	MaxBuffer int
+}
+
 // Batcher implements buffered batcher
+// the batches are built and handled in order by the single worker
 type Batcher struct {
 	mu sync.Mutex
 
-	buf        [][]byte
-	bufSize    int
-	maxBytes   int
-	ticker     *time.Ticker
-	tickerExit chan bool
+	buf     [][]byte
+	bufSize int
+	flushes uint64
+	limits  Limits
+	pending int
+	closed  bool
+	space   chan struct{}
+
+	ticker   *time.Ticker
+	kickCh   chan struct{}
+	flushCh  chan chan struct{}
+	exitCh   chan bool
+	exitOnce sync.Once
+	done     chan struct{}
 
 	builder BatchBuilder
 	handler BatchHandler
 }
 
+// Stats describes the batch buffer
+// Flushes counts the batches of buffered payloads
+// Pending counts the payloads of batches in progress
+type Stats struct {
+	BufLen  int
+	BufSize int
+	Flushes uint64
+	Pending int
+}
+
 // NewBatcher returns new instance
 func NewBatcher(
 	bb BatchBuilder,
 	bh BatchHandler,
 	d time.Duration,
-	maxBytes int) *Batcher {
+	limits Limits) *Batcher {
 	if d == 0 {
 		d = math.MaxInt64
 	}
 	bt := Batcher{
-		buf:        make([][]byte, 0),
-		bufSize:    0,
-		maxBytes:   maxBytes,
-		ticker:     time.NewTicker(d),
-		tickerExit: make(chan bool, 1),
+		buf:     make([][]byte, 0),
+		bufSize: 0,
+		limits:  limits,
+		space:   make(chan struct{}),
+
+		ticker:  time.NewTicker(d),
+		kickCh:  make(chan struct{}, 1),
+		flushCh: make(chan chan struct{}),
+		exitCh:  make(chan bool, 1),
+		done:    make(chan struct{}),
 
 		builder: bb,
 		handler: bh,
 	}
 
-	/* handle ticker */
-	go func() {
-		for {
-			select {
-			case <-bt.ticker.C:
-				bt.Batch()
-			case <-bt.tickerExit:
-				bt.Batch()
-				return
+	go bt.run()
+	return &bt
+}
+
+// run processes the flushes in order
+func (bt *Batcher) run() {
+	defer close(bt.done)
+	for {
+		select {
+		case <-bt.ticker.C:
+			bt.flush()
+		case <-bt.kickCh:
+			bt.flush()
+		case req := <-bt.flushCh:
+			bt.flush()
+			close(req)
+		case flush := <-bt.exitCh:
+			bt.ticker.Stop()
+			if flush {
+				bt.flush()
 			}
+			return
 		}
-	}()
-
-	return &bt
+	}
 }
 
 // Add adds single payload to batch buffer
-func (bt *Batcher) Add(p []byte) {
-	bt.mu.Lock()
+// blocks while the buffer is full until flushed or the context is done
+// the payload is accepted into the empty buffer regardless of size
+func (bt *Batcher) Add(ctx context.Context, p []byte) error {
+	for {
+		bt.mu.Lock()
+		if bt.closed {
+			bt.mu.Unlock()
+			return ErrClosed
+		}
+		if bt.bufSize == 0 || bt.limits.MaxBuffer <= 0 ||
+			bt.bufSize+len(p) <= bt.limits.MaxBuffer {
+			bt.buf = append(bt.buf, p)
+			bt.bufSize += len(p)
+			full := (bt.limits.MaxBytes > 0 && bt.bufSize >= bt.limits.MaxBytes) ||
+				(bt.limits.MaxItems > 0 && len(bt.buf) >= bt.limits.MaxItems)
+			bt.mu.Unlock()
+			if full {
+				bt.kick()
+			}
+			return nil
+		}
+		space, bufSize, maxBuffer := bt.space, bt.bufSize, bt.limits.MaxBuffer
+		bt.mu.Unlock()
 
-	bt.buf = append(bt.buf, p)
-	bt.bufSize += len(p)
+		log.Debug().Msgf("batch buffer size %dKB reached the limit %dKB",
+			bufSize/1024, maxBuffer/1024)
+		bt.kick()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
 
-	bt.mu.Unlock()
+// Batch requests processing of buffered payloads in background
+func (bt *Batcher) Batch() {
+	bt.kick()
+}
 
-	bt.bufSize += len(p)
-	if bt.bufSize > bt.maxBytes {
-		log.Debug().Msgf("batch buffer size %dKB exceeded the soft limit %dKB",
-			bt.bufSize/1024, bt.maxBytes/1024)
-		bt.Batch()
+// Flush processes buffered payloads
+// blocks until the handlers return or the context is done
+func (bt *Batcher) Flush(ctx context.Context) error {
+	req := make(chan struct{})
+	select {
+	case bt.flushCh <- req:
+	case <-bt.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-req:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-// Batch processes buffered payloads
-func (bt *Batcher) Batch() {
+func (bt *Batcher) kick() {
+	select {
+	case bt.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+// take returns buffered payloads and resets the buffer
+func (bt *Batcher) take() ([][]byte, int, Limits, BatchBuilder) {
 	bt.mu.Lock()
+	defer bt.mu.Unlock()
 
 	buf, bufSize := bt.buf, bt.bufSize
 	bt.buf, bt.bufSize = make([][]byte, 0), 0
-
-	bt.mu.Unlock()
 	if len(buf) > 0 {
-		go func() {
-			/* cannot use services package due to import cycle */
-			ctx, span := otel.GetTracerProvider().
-				Tracer("batcher").Start(context.Background(), "Batch:Build")
-			defer func() {
-				span.SetAttributes(attribute.Int("bufferSize", bufSize))
-				span.End()
-			}()
-
-			payloads := bt.builder.Build(buf)
-			if len(payloads) > 0 {
-				for _, p := range payloads {
-					if len(p) > 0 {
-						bt.handler(ctx, p)
-					}
-				}
+		bt.flushes++
+		bt.pending += len(buf)
+		bt.signalSpace()
+	}
+	return buf, bufSize, bt.limits, bt.builder
+}
+
+// signalSpace wakes up the blocked Add calls
+// should be called under lock
+func (bt *Batcher) signalSpace() {
+	close(bt.space)
+	bt.space = make(chan struct{})
+}
+
+// flush builds and handles the buffered payloads by chunks within limits
+func (bt *Batcher) flush() {
+	buf, bufSize, limits, builder := bt.take()
+	if len(buf) == 0 {
+		return
+	}
+
+	/* cannot use services package due to import cycle */
+	ctx, span := otel.GetTracerProvider().
+		Tracer("batcher").Start(context.Background(), "Batch:Build")
+	defer func() {
+		span.SetAttributes(attribute.Int("bufferSize", bufSize))
+		span.End()
+	}()
+
+	if f, ok := builder.(BatchFilter); ok {
+		n := len(buf)
+		buf = f.Filter(buf)
+		bt.mu.Lock()
+		bt.pending -= n - len(buf)
+		bt.mu.Unlock()
+		if len(buf) == 0 {
+			return
+		}
+	}
+
+	for _, chunk := range split(buf, limits) {
+		bt.handle(ctx, builder, chunk, limits.MaxBytes)
+
+		bt.mu.Lock()
+		bt.pending -= len(chunk)
+		bt.mu.Unlock()
+	}
+}
+
+// handle builds and handles the chunk
+// rebuilds by halves if some built payload exceeds maxBytes
+func (bt *Batcher) handle(ctx context.Context, builder BatchBuilder, chunk [][]byte, maxBytes int) {
+	payloads := builder.Build(chunk)
+	if maxBytes > 0 && len(chunk) > 1 {
+		for _, p := range payloads {
+			if len(p) > maxBytes {
+				log.Debug().Msgf("batch payload size %dKB exceeded the limit %dKB, rebuilding %d payloads by halves",
+					len(p)/1024, maxBytes/1024, len(chunk))
+				bt.handle(ctx, builder, chunk[:len(chunk)/2], maxBytes)
+				bt.handle(ctx, builder, chunk[len(chunk)/2:], maxBytes)
+				return
 			}
-		}()
+		}
+	}
+	for _, p := range payloads {
+		if len(p) == 0 {
+			continue
+		}
+		if maxBytes > 0 && len(p) > maxBytes {
+			log.Warn().Msgf("batch payload size %dKB exceeds the limit %dKB",
+				len(p)/1024, maxBytes/1024)
+		}
+		if err := bt.handler(ctx, p); err != nil {
+			log.Err(err).Msg("could not handle batch payload")
+		}
+	}
+}
+
+// split splits the payloads into chunks within limits keeping the order
+func split(buf [][]byte, limits Limits) [][][]byte {
+	chunks := make([][][]byte, 0, 1)
+	start, size := 0, 0
+	for i, p := range buf {
+		if i > start &&
+			((limits.MaxItems > 0 && i-start >= limits.MaxItems) ||
+				(limits.MaxBytes > 0 && size+len(p) > limits.MaxBytes)) {
+			chunks = append(chunks, buf[start:i])
+			start, size = i, 0
+		}
+		size += len(p)
 	}
+	return append(chunks, buf[start:])
+}
+
+// Stats returns the state of batch buffer
+func (bt *Batcher) Stats() Stats {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return Stats{BufLen: len(bt.buf), BufSize: bt.bufSize, Flushes: bt.flushes, Pending: bt.pending}
 }
 
-// Exit stops the internal ticker
+// Exit stops accepting payloads and stops the worker
+// the buffered payloads are processed in background
 func (bt *Batcher) Exit() {
-	bt.tickerExit <- true
+	bt.close()
+	bt.exitOnce.Do(func() { bt.exitCh <- true })
+}
+
+// Drain stops accepting payloads and processes the buffered ones
+// waits for the batches in progress until the context is done, then stops the worker
+// the Stats show what was left unprocessed on error
+func (bt *Batcher) Drain(ctx context.Context) error {
+	bt.close()
+	if err := bt.Flush(ctx); err != nil && !errors.Is(err, ErrClosed) {
+		return err
+	}
+	bt.exitOnce.Do(func() { bt.exitCh <- false })
+	return nil
+}
+
+func (bt *Batcher) close() {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	if !bt.closed {
+		bt.closed = true
+		bt.signalSpace()
+	}
+}
+
+// SetBuilder replaces the builder applied from the next flush
+// used to apply the builder settings, the state of previous builder is dropped
+func (bt *Batcher) SetBuilder(bb BatchBuilder) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.builder = bb
 }
 
 // Reset applyes configuration
-func (bt *Batcher) Reset(d time.Duration, maxBytes int) {
-	bt.Batch()
-	bt.maxBytes = maxBytes
+// the buffered payloads are processed in background
+func (bt *Batcher) Reset(d time.Duration, limits Limits) {
+	bt.mu.Lock()
+	bt.limits = limits
+	bt.signalSpace()
+	bt.mu.Unlock()
+
+	bt.kick()
 	if d == 0 {
 		d = math.MaxInt64
 	}
@@ -0,0 +1,164 @@
+package batcher
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type joinBuilder struct{}
+
+func (joinBuilder) Build(input [][]byte) [][]byte {
+	return [][]byte{bytes.Join(input, []byte(","))}
+}
+
+func TestBatcher_Drain(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		handled []string
+	)
+	release := make(chan struct{})
+	bt := NewBatcher(joinBuilder{}, func(ctx context.Context, p []byte) error {
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, string(p))
+		return nil
+	}, time.Hour, Limits{MaxBytes: 1024})
+
+	assert.NoError(t, bt.Add(context.Background(), []byte("a")))
+	assert.NoError(t, bt.Add(context.Background(), []byte("b")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	assert.ErrorIs(t, bt.Drain(ctx), context.DeadlineExceeded)
+	assert.Equal(t, Stats{Flushes: 1, Pending: 2}, bt.Stats())
+
+	close(release)
+	assert.NoError(t, bt.Drain(context.Background()))
+	assert.Equal(t, Stats{Flushes: 1}, bt.Stats())
+	assert.Equal(t, []string{"a,b"}, handled)
+	assert.ErrorIs(t, bt.Add(context.Background(), []byte("c")), ErrClosed)
+}
+
+func TestBatcher_Flush(t *testing.T) {
+	var handled []string
+	bt := NewBatcher(joinBuilder{}, func(ctx context.Context, p []byte) error {
+		handled = append(handled, string(p))
+		return nil
+	}, time.Hour, Limits{MaxItems: 2, MaxBytes: 1024})
+	defer bt.Exit()
+
+	ctx := context.Background()
+	for _, p := range []string{"a", "b", "c"} {
+		assert.NoError(t, bt.Add(ctx, []byte(p)))
+	}
+	assert.NoError(t, bt.Flush(ctx))
+	assert.NoError(t, bt.Add(ctx, []byte("d")))
+	assert.Equal(t, 1, bt.Stats().BufLen)
+	assert.Equal(t, 1, bt.Stats().BufSize)
+	assert.NoError(t, bt.Flush(ctx))
+	assert.Equal(t, []string{"a,b", "c", "d"}, handled)
+}
+
+func TestBatcher_MaxBytes(t *testing.T) {
+	var handled []string
+	bt := NewBatcher(joinBuilder{}, func(ctx context.Context, p []byte) error {
+		handled = append(handled, string(p))
+		return nil
+	}, time.Hour, Limits{MaxBytes: 4})
+	defer bt.Exit()
+
+	/* the inputs "a", "b", "c" fit the limit but the joined output does not */
+	ctx := context.Background()
+	for _, p := range []string{"a", "b", "c", "dddddddd", "e"} {
+		assert.NoError(t, bt.Add(ctx, []byte(p)))
+	}
+	assert.NoError(t, bt.Flush(ctx))
+	assert.Equal(t, []string{"a", "b,c", "dddddddd", "e"}, handled)
+}
+
+type filterBuilder struct {
+	joinBuilder
+	filters int
+}
+
+func (bld *filterBuilder) Filter(input [][]byte) [][]byte {
+	bld.filters++
+	res := make([][]byte, 0, len(input))
+	for _, p := range input {
+		if string(p) != "x" {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func TestBatcher_Filter(t *testing.T) {
+	var handled []string
+	bld := &filterBuilder{}
+	bt := NewBatcher(bld, func(ctx context.Context, p []byte) error {
+		handled = append(handled, string(p))
+		return nil
+	}, time.Hour, Limits{MaxBytes: 4})
+	defer bt.Exit()
+
+	/* the filter is not repeated on rebuilding by halves */
+	ctx := context.Background()
+	for _, p := range []string{"a", "x", "b", "c", "x"} {
+		assert.NoError(t, bt.Add(ctx, []byte(p)))
+	}
+	assert.NoError(t, bt.Flush(ctx))
+	assert.Equal(t, []string{"a", "b,c"}, handled)
+	assert.Equal(t, 1, bld.filters)
+	assert.Equal(t, 0, bt.Stats().Pending)
+}
+
+func TestBatcher_MaxBuffer(t *testing.T) {
+	release := make(chan struct{})
+	bt := NewBatcher(joinBuilder{}, func(ctx context.Context, p []byte) error {
+		<-release
+		return nil
+	}, time.Hour, Limits{MaxBuffer: 2})
+	defer bt.Exit()
+
+	bg := context.Background()
+	assert.NoError(t, bt.Add(bg, []byte("ab")))
+	bt.Batch()
+	/* the worker takes the buffer and blocks in handler */
+	assert.Eventually(t, func() bool { return bt.Stats().Pending == 1 }, time.Second, time.Millisecond*10)
+	assert.NoError(t, bt.Add(bg, []byte("cd")))
+
+	ctx, cancel := context.WithTimeout(bg, time.Millisecond*100)
+	defer cancel()
+	assert.ErrorIs(t, bt.Add(ctx, []byte("e")), context.DeadlineExceeded)
+	assert.Equal(t, Stats{BufLen: 1, BufSize: 2, Flushes: 1, Pending: 1}, bt.Stats())
+
+	close(release)
+	assert.NoError(t, bt.Add(bg, []byte("e")))
+	assert.NoError(t, bt.Flush(bg))
+	assert.Equal(t, Stats{Flushes: 3}, bt.Stats())
+}
+
+func TestBatcher_SetBuilder(t *testing.T) {
+	var handled []string
+	bt := NewBatcher(joinBuilder{}, func(ctx context.Context, p []byte) error {
+		handled = append(handled, string(p))
+		return nil
+	}, time.Hour, Limits{})
+	defer bt.Exit()
+
+	ctx := context.Background()
+	bld := &filterBuilder{}
+	bt.SetBuilder(bld)
+	for _, p := range []string{"a", "x", "b"} {
+		assert.NoError(t, bt.Add(ctx, []byte(p)))
+	}
+	assert.NoError(t, bt.Flush(ctx))
+	assert.Equal(t, []string{"a,b"}, handled)
+	assert.Equal(t, 1, bld.filters)
+}
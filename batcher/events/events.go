@@ -2,13 +2,57 @@ package events
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/gwos/tcg/sdk/transit"
 	"github.com/rs/zerolog/log"
 )
 
+// Define reasons of dropping events
+const (
+	DropSuppressed  = "suppressed"
+	DropRateLimited = "rateLimited"
+)
+
+// hostRateInterval defines the interval of HostRate limit
+const hostRateInterval = time.Minute
+
+// eventKey identifies the repeated events
+type eventKey struct {
+	host, service, monitorStatus, textMessage string
+}
+
+// seenEvent keeps the last emitted event of key
+// idx refers to the event in the current flush, -1 if emitted by previous one
+type seenEvent struct {
+	emitted    time.Time
+	suppressed int
+	idx        int
+}
+
+// hostCounter counts the emitted events of host within interval
+type hostCounter struct {
+	start time.Time
+	count int
+}
+
 // EventsBatchBuilder implements builder
-type EventsBatchBuilder struct{}
+// the events repeated within SuppressWindow are emitted once per window,
+// the repeat count is added to TextMessage of emitted event
+// the events over HostRate per minute per host are dropped
+// OnDrop is called for each dropped event with the reason
+// the zero values turn off suppressing and limiting
+// the events are dropped by Filter called once per flush, so Build has no state
+type EventsBatchBuilder struct {
+	SuppressWindow time.Duration
+	HostRate       int
+	OnDrop         func(host, reason string)
+
+	clock func() time.Time
+	seen  map[eventKey]*seenEvent
+	hosts map[string]*hostCounter
+}
 
 // Build builds the batch payloads if not empty
 func (bld *EventsBatchBuilder) Build(input [][]byte) [][]byte {
@@ -37,3 +81,149 @@ func (bld *EventsBatchBuilder) Build(input [][]byte) [][]byte {
 	}
 	return nil
 }
+
+// Filter drops the repeated events and the events over host rate
+// returns the payloads with the events left, the empty ones are omitted
+// the payloads that could not be unmarshaled are passed unchanged
+func (bld *EventsBatchBuilder) Filter(input [][]byte) [][]byte {
+	if bld.SuppressWindow <= 0 && bld.HostRate <= 0 {
+		return input
+	}
+	events := make([]transit.GroundworkEvent, 0)
+	owners := make([]int, 0)
+	requests := make([]*transit.GroundworkEventsRequest, len(input))
+	for i, p := range input {
+		r := transit.GroundworkEventsRequest{}
+		if err := json.Unmarshal(p, &r); err != nil {
+			log.Err(err).
+				RawJSON("payload", p).
+				Msg("could not unmarshal events payload for filter")
+			continue
+		}
+		for _, e := range r.Events {
+			events = append(events, e)
+			owners = append(owners, i)
+		}
+		requests[i] = &r
+	}
+
+	kept := make([][]transit.GroundworkEvent, len(input))
+	for _, i := range bld.suppress(events) {
+		kept[owners[i]] = append(kept[owners[i]], events[i])
+	}
+	res := make([][]byte, 0, len(input))
+	for i, r := range requests {
+		if r == nil {
+			res = append(res, input[i])
+			continue
+		}
+		if len(kept[i]) == 0 {
+			continue
+		}
+		r.Events = kept[i]
+		p, err := json.Marshal(r)
+		if err != nil {
+			log.Err(err).
+				Interface("events", r).
+				Msg("could not marshal events")
+			continue
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+// suppress drops the repeated events and the events over host rate
+// returns the indexes of events left, the repeat count is added to their TextMessage
+func (bld *EventsBatchBuilder) suppress(events []transit.GroundworkEvent) []int {
+	now := bld.now()
+	bld.prune(now)
+
+	res := make([]int, 0, len(events))
+	repeats := make([]int, len(events))
+	for i, e := range events {
+		k := eventKey{e.Host, e.Service, e.MonitorStatus, e.TextMessage}
+		s, seen := bld.seen[k]
+		if seen && bld.SuppressWindow > 0 && now.Sub(s.emitted) < bld.SuppressWindow {
+			if s.idx >= 0 {
+				repeats[s.idx]++
+			} else {
+				s.suppressed++
+			}
+			bld.drop(e.Host, DropSuppressed)
+			continue
+		}
+		if !bld.allowHost(e.Host, now) {
+			bld.drop(e.Host, DropRateLimited)
+			continue
+		}
+		if bld.SuppressWindow > 0 {
+			if seen {
+				repeats[i] = s.suppressed
+			}
+			bld.seen[k] = &seenEvent{emitted: now, idx: i}
+		}
+		res = append(res, i)
+	}
+
+	for _, i := range res {
+		if repeats[i] > 0 {
+			events[i].TextMessage = fmt.Sprintf("%s [repeated %d times]", events[i].TextMessage, repeats[i])
+		}
+	}
+	for _, s := range bld.seen {
+		s.idx = -1
+	}
+	return res
+}
+
+// allowHost counts the host event and returns false if the host rate is exceeded
+func (bld *EventsBatchBuilder) allowHost(host string, now time.Time) bool {
+	if bld.HostRate <= 0 {
+		return true
+	}
+	c, ok := bld.hosts[host]
+	if !ok || now.Sub(c.start) >= hostRateInterval {
+		c = &hostCounter{start: now}
+		bld.hosts[host] = c
+	}
+	if c.count >= bld.HostRate {
+		return false
+	}
+	c.count++
+	return true
+}
+
+// prune removes the expired state
+// the seen events are kept for two windows to report the suppressed count with the next emitted one
+func (bld *EventsBatchBuilder) prune(now time.Time) {
+	if bld.seen == nil {
+		bld.seen = make(map[eventKey]*seenEvent)
+	}
+	if bld.hosts == nil {
+		bld.hosts = make(map[string]*hostCounter)
+	}
+	for k, s := range bld.seen {
+		if now.Sub(s.emitted) >= bld.SuppressWindow*2 {
+			delete(bld.seen, k)
+		}
+	}
+	for k, c := range bld.hosts {
+		if now.Sub(c.start) >= hostRateInterval {
+			delete(bld.hosts, k)
+		}
+	}
+}
+
+func (bld *EventsBatchBuilder) drop(host, reason string) {
+	if bld.OnDrop != nil {
+		bld.OnDrop(host, reason)
+	}
+}
+
+func (bld *EventsBatchBuilder) now() time.Time {
+	if bld.clock != nil {
+		return bld.clock()
+	}
+	return time.Now()
+}
@@ -0,0 +1,125 @@
+package events
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gwos/tcg/sdk/transit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventsBatchBuilder(t *testing.T) {
+	now := time.Now()
+	dropped := make(map[string]int)
+	bld := &EventsBatchBuilder{
+		SuppressWindow: time.Minute * 5,
+		HostRate:       3,
+		OnDrop:         func(host, reason string) { dropped[host+":"+reason]++ },
+		clock:          func() time.Time { return now },
+	}
+	event := func(host, status, msg string) transit.GroundworkEvent {
+		return transit.GroundworkEvent{Host: host, Service: "svc", MonitorStatus: status, TextMessage: msg}
+	}
+	build := func(events ...transit.GroundworkEvent) []string {
+		p, err := json.Marshal(transit.GroundworkEventsRequest{Events: events})
+		assert.NoError(t, err)
+		pp := bld.Build(bld.Filter([][]byte{p}))
+		if len(pp) == 0 {
+			return nil
+		}
+		r := transit.GroundworkEventsRequest{}
+		assert.NoError(t, json.Unmarshal(pp[0], &r))
+		res := make([]string, 0, len(r.Events))
+		for _, e := range r.Events {
+			res = append(res, e.Host+":"+e.MonitorStatus+":"+e.TextMessage)
+		}
+		return res
+	}
+
+	assert.Equal(t, []string{
+		"h1:CRITICAL:down [repeated 2 times]",
+		"h1:OK:up",
+		"h2:CRITICAL:down",
+	}, build(
+		event("h1", "CRITICAL", "down"),
+		event("h1", "OK", "up"),
+		event("h1", "CRITICAL", "down"),
+		event("h2", "CRITICAL", "down"),
+		event("h1", "CRITICAL", "down"),
+	))
+
+	/* within window and rate limit */
+	now = now.Add(time.Second * 30)
+	assert.Equal(t, []string{"h1:WARNING:slow"}, build(
+		event("h1", "CRITICAL", "down"),
+		event("h1", "WARNING", "slow"),
+		event("h1", "WARNING", "other"),
+	))
+
+	/* after window and rate interval */
+	now = now.Add(time.Minute * 5)
+	assert.Equal(t, []string{"h1:CRITICAL:down [repeated 1 times]"}, build(
+		event("h1", "CRITICAL", "down"),
+	))
+	assert.Equal(t, map[string]int{"h1:suppressed": 3, "h1:rateLimited": 1}, dropped)
+}
+
+func TestEventsBatchBuilder_Rebuild(t *testing.T) {
+	dropped := 0
+	bld := &EventsBatchBuilder{
+		SuppressWindow: time.Minute * 5,
+		HostRate:       3,
+		OnDrop:         func(host, reason string) { dropped++ },
+	}
+	payload := func(events ...transit.GroundworkEvent) []byte {
+		p, err := json.Marshal(transit.GroundworkEventsRequest{Events: events})
+		assert.NoError(t, err)
+		return p
+	}
+	input := bld.Filter([][]byte{
+		payload(transit.GroundworkEvent{Host: "h1", MonitorStatus: "CRITICAL"}),
+		payload(transit.GroundworkEvent{Host: "h1", MonitorStatus: "CRITICAL"}),
+		payload(transit.GroundworkEvent{Host: "h1", MonitorStatus: "OK"}),
+	})
+	assert.Len(t, input, 2)
+	assert.Equal(t, 1, dropped)
+
+	/* the batcher rebuilds by halves on the oversized payload */
+	assert.Equal(t, bld.Build(input), bld.Build(input))
+	for _, half := range [][][]byte{input[:1], input[1:]} {
+		pp := bld.Build(half)
+		assert.Len(t, pp, 1)
+	}
+	assert.Equal(t, 1, dropped)
+}
+
+func TestEventsBatchBuilder_Disabled(t *testing.T) {
+	p, err := json.Marshal(transit.GroundworkEventsRequest{Events: []transit.GroundworkEvent{
+		{Host: "h1", MonitorStatus: "CRITICAL"},
+		{Host: "h1", MonitorStatus: "CRITICAL"},
+	}})
+	assert.NoError(t, err)
+	bld := new(EventsBatchBuilder)
+	pp := bld.Build(bld.Filter([][]byte{p, p}))
+	assert.Len(t, pp, 1)
+	r := transit.GroundworkEventsRequest{}
+	assert.NoError(t, json.Unmarshal(pp[0], &r))
+	assert.Len(t, r.Events, 4)
+}
+
+func TestEventsBatchBuilder_FilterUndecodable(t *testing.T) {
+	p, err := json.Marshal(transit.GroundworkEventsRequest{Events: []transit.GroundworkEvent{
+		{Host: "h1", MonitorStatus: "CRITICAL"},
+		{Host: "h1", MonitorStatus: "CRITICAL"},
+	}})
+	assert.NoError(t, err)
+	bad := []byte(`{"events":"bad"}`)
+	bld := &EventsBatchBuilder{SuppressWindow: time.Minute * 5}
+	pp := bld.Filter([][]byte{bad, p})
+	assert.Len(t, pp, 2)
+	assert.Equal(t, bad, pp[0])
+	r := transit.GroundworkEventsRequest{}
+	assert.NoError(t, json.Unmarshal(pp[1], &r))
+	assert.Len(t, r.Events, 1)
+}
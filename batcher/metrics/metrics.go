@@ -16,13 +16,13 @@ type mapItem struct {
 }
 
 // Add adds single transit.ResourcesWithServicesRequest to batch
-func add(byGroups map[string]mapItem, p []byte) {
+func add(byGroups map[string]mapItem, keys []string, p []byte) []string {
 	r := transit.ResourcesWithServicesRequest{}
 	if err := json.Unmarshal(p, &r); err != nil {
 		log.Err(err).
 			RawJSON("payload", p).
 			Msg("could not unmarshal metrics payload for batch")
-		return
+		return keys
 	}
 
 	for i := range r.Resources {
@@ -35,35 +35,46 @@ func add(byGroups map[string]mapItem, p []byte) {
 	k := makeGKey(r.Groups)
 	if item, ok := byGroups[k]; ok {
 		item.contexts = append(item.contexts, *r.Context)
+		item.groups = unionGroups(item.groups, r.Groups)
 		item.res = append(item.res, r.Resources...)
 		byGroups[k] = item
-	} else {
-		byGroups[k] = mapItem{
-			contexts: []transit.TracerContext{*r.Context},
-			groups:   r.Groups,
-			res:      r.Resources,
-		}
+		return keys
+	}
+	byGroups[k] = mapItem{
+		contexts: []transit.TracerContext{*r.Context},
+		groups:   r.Groups,
+		res:      r.Resources,
 	}
+	return append(keys, k)
 }
 
 // MetricsBatchBuilder implements builder
-type MetricsBatchBuilder struct{}
+// Coalesce turns on merging the resources by owner and name, the services by name,
+// and keeping the latest sample per metric by interval end time
+type MetricsBatchBuilder struct {
+	Coalesce bool
+}
 
 // Build builds the batch payloads if not empty
 func (bld *MetricsBatchBuilder) Build(input [][]byte) [][]byte {
 	byGroups := make(map[string]mapItem)
+	keys := make([]string, 0)
 	for _, p := range input {
-		add(byGroups, p)
+		keys = add(byGroups, keys, p)
 	}
 
-	pp := make([][]byte, len(byGroups))
-	for _, item := range byGroups {
+	pp := make([][]byte, 0, len(byGroups))
+	for _, k := range keys {
+		item := byGroups[k]
 		r := transit.ResourcesWithServicesRequest{}
 		if len(item.contexts) > 0 {
 			r.Context = &item.contexts[0]
 		}
 		r.Groups = item.groups
 		r.Resources = item.res
+		if bld.Coalesce {
+			r.Resources = coalesce(item.res)
+		}
 		if len(r.Resources) > 0 {
 			p, err := json.Marshal(r)
 			if err == nil {
@@ -110,10 +121,144 @@ func applyTime(
 }
 
 func makeGKey(gg []transit.ResourceGroup) string {
-	keys := make([]string, len(gg))
+	keys := make([]string, 0, len(gg))
 	for _, g := range gg {
 		keys = append(keys, string(g.Type)+":"+g.GroupName)
 	}
 	sort.Strings(keys)
 	return strings.Join(keys, "#")
 }
+
+// unionGroups adds the resource refs of groups with the same type and name
+func unionGroups(groups, other []transit.ResourceGroup) []transit.ResourceGroup {
+	for _, g := range other {
+		for i := range groups {
+			if groups[i].Type != g.Type || groups[i].GroupName != g.GroupName {
+				continue
+			}
+			refs := make(map[transit.ResourceRef]bool, len(groups[i].Resources))
+			for _, ref := range groups[i].Resources {
+				refs[ref] = true
+			}
+			for _, ref := range g.Resources {
+				if !refs[ref] {
+					refs[ref] = true
+					groups[i].Resources = append(groups[i].Resources, ref)
+				}
+			}
+			break
+		}
+	}
+	return groups
+}
+
+// coalesce merges the resources by owner and name keeping the order of first appearance
+func coalesce(resources []transit.MonitoredResource) []transit.MonitoredResource {
+	type rKey struct{ owner, name string }
+	idx := make(map[rKey]int, len(resources))
+	res := make([]transit.MonitoredResource, 0, len(resources))
+	for _, r := range resources {
+		k := rKey{r.Owner, r.Name}
+		i, ok := idx[k]
+		if !ok {
+			idx[k] = len(res)
+			r.Services = coalesceServices(nil, r.Services)
+			res = append(res, r)
+			continue
+		}
+		services := res[i].Services
+		if !isBefore(r.LastCheckTime, res[i].LastCheckTime) {
+			r.Properties = mergeProperties(res[i].Properties, r.Properties)
+			res[i].BaseResource, res[i].MonitoredInfo = r.BaseResource, r.MonitoredInfo
+		}
+		res[i].Services = coalesceServices(services, r.Services)
+	}
+	return res
+}
+
+// coalesceServices merges the services by name keeping the order of first appearance
+func coalesceServices(services, other []transit.MonitoredService) []transit.MonitoredService {
+	idx := make(map[string]int, len(services))
+	for i, svc := range services {
+		idx[svc.Name] = i
+	}
+	for _, svc := range other {
+		i, ok := idx[svc.Name]
+		if !ok {
+			idx[svc.Name] = len(services)
+			svc.Metrics = coalesceMetrics(nil, svc.Metrics)
+			services = append(services, svc)
+			continue
+		}
+		metrics := services[i].Metrics
+		if !isBefore(svc.LastCheckTime, services[i].LastCheckTime) {
+			svc.Properties = mergeProperties(services[i].Properties, svc.Properties)
+			services[i].BaseInfo, services[i].MonitoredInfo = svc.BaseInfo, svc.MonitoredInfo
+		}
+		services[i].Metrics = coalesceMetrics(metrics, svc.Metrics)
+	}
+	return services
+}
+
+// coalesceMetrics keeps the latest sample per metric by interval end time
+// the metric is identified by name, sample type and tags
+func coalesceMetrics(metrics, other []transit.TimeSeries) []transit.TimeSeries {
+	idx := make(map[string]int, len(metrics))
+	for i, m := range metrics {
+		idx[makeMKey(m)] = i
+	}
+	for _, m := range other {
+		k := makeMKey(m)
+		i, ok := idx[k]
+		if !ok {
+			idx[k] = len(metrics)
+			metrics = append(metrics, m)
+			continue
+		}
+		if !isBefore(endTime(m), endTime(metrics[i])) {
+			metrics[i] = m
+		}
+	}
+	return metrics
+}
+
+func makeMKey(m transit.TimeSeries) string {
+	tags := make([]string, 0, len(m.Tags))
+	for k, v := range m.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return m.MetricName + "#" + string(m.SampleType) + "#" + strings.Join(tags, ",")
+}
+
+func endTime(m transit.TimeSeries) *transit.Timestamp {
+	if m.Interval == nil {
+		return nil
+	}
+	return m.Interval.EndTime
+}
+
+// isBefore returns true if ts is before other, the nil is before any
+func isBefore(ts, other *transit.Timestamp) bool {
+	switch {
+	case other == nil:
+		return false
+	case ts == nil:
+		return true
+	}
+	return ts.Before(other.Time)
+}
+
+func mergeProperties(props, other map[string]transit.TypedValue) map[string]transit.TypedValue {
+	if len(props) == 0 {
+		return other
+	}
+	merged := make(map[string]transit.TypedValue, len(props)+len(other))
+	for k, v := range props {
+		merged[k] = v
+	}
+	for k, v := range other {
+		merged[k] = v
+	}
+	return merged
+}
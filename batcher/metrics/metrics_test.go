@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gwos/tcg/sdk/transit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeGKey(t *testing.T) {
+	assert.Equal(t, "", makeGKey(nil))
+	assert.Equal(t, "HostGroup:a#HostGroup:b", makeGKey([]transit.ResourceGroup{
+		{GroupName: "b", Type: transit.HostGroup},
+		{GroupName: "a", Type: transit.HostGroup},
+	}))
+}
+
+func TestMetricsBatchBuilder(t *testing.T) {
+	ts := func(sec int64) *transit.Timestamp { return &transit.Timestamp{Time: time.Unix(sec, 0).UTC()} }
+	metric := func(name string, sec int64, value int) transit.TimeSeries {
+		return transit.TimeSeries{
+			MetricName: name,
+			SampleType: transit.Value,
+			Interval:   &transit.TimeInterval{EndTime: ts(sec)},
+			Value:      transit.NewTypedValue(value),
+		}
+	}
+	service := func(name string, sec int64, status transit.MonitorStatus, metrics ...transit.TimeSeries) transit.MonitoredService {
+		svc := transit.MonitoredService{Metrics: metrics}
+		svc.Name, svc.Status, svc.LastCheckTime, svc.NextCheckTime = name, status, ts(sec), ts(sec+60)
+		return svc
+	}
+	resource := func(name string, sec int64, services ...transit.MonitoredService) transit.MonitoredResource {
+		res := transit.MonitoredResource{Services: services}
+		res.Name, res.Status, res.LastCheckTime, res.NextCheckTime = name, transit.HostUp, ts(sec), ts(sec+60)
+		return res
+	}
+	payload := func(ref string, resources ...transit.MonitoredResource) []byte {
+		r := transit.ResourcesWithServicesRequest{
+			Context:   &transit.TracerContext{TimeStamp: ts(1)},
+			Resources: resources,
+			Groups: []transit.ResourceGroup{{
+				GroupName: "g", Type: transit.HostGroup,
+				Resources: []transit.ResourceRef{{Name: ref, Type: transit.ResourceTypeHost}},
+			}},
+		}
+		p, err := json.Marshal(r)
+		assert.NoError(t, err)
+		return p
+	}
+	input := [][]byte{
+		payload("h1",
+			resource("h1", 10,
+				service("s1", 10, transit.ServiceOk, metric("m1", 10, 1), metric("m2", 10, 1)),
+				service("s2", 10, transit.ServiceOk, metric("m1", 10, 1)),
+			)),
+		payload("h2",
+			resource("h2", 15, service("s1", 15, transit.ServiceOk, metric("m1", 15, 1))),
+			resource("h1", 20, service("s1", 20, transit.ServiceWarning, metric("m1", 20, 2))),
+		),
+		payload("h1",
+			resource("h1", 5, service("s2", 5, transit.ServiceUnknown, metric("m1", 5, 3), metric("m3", 5, 3))),
+		),
+	}
+
+	unmarshal := func(pp [][]byte) transit.ResourcesWithServicesRequest {
+		assert.Len(t, pp, 1)
+		r := transit.ResourcesWithServicesRequest{}
+		assert.NoError(t, json.Unmarshal(pp[0], &r))
+		assert.Len(t, r.Groups, 1)
+		assert.Equal(t, []transit.ResourceRef{
+			{Name: "h1", Type: transit.ResourceTypeHost},
+			{Name: "h2", Type: transit.ResourceTypeHost},
+		}, r.Groups[0].Resources)
+		return r
+	}
+
+	r := unmarshal(new(MetricsBatchBuilder).Build(input))
+	assert.Len(t, r.Resources, 4)
+
+	r = unmarshal((&MetricsBatchBuilder{Coalesce: true}).Build(input))
+	assert.Len(t, r.Resources, 2)
+	h1, h2 := r.Resources[0], r.Resources[1]
+	assert.Equal(t, "h1", h1.Name)
+	assert.Equal(t, "h2", h2.Name)
+	assert.Equal(t, ts(20).Time, h1.LastCheckTime.Time)
+	assert.Len(t, h1.Services, 2)
+
+	s1, s2 := h1.Services[0], h1.Services[1]
+	assert.Equal(t, transit.ServiceWarning, s1.Status)
+	assert.Len(t, s1.Metrics, 2)
+	assert.Equal(t, int64(2), *s1.Metrics[0].Value.IntegerValue)
+	assert.Equal(t, "m2", s1.Metrics[1].MetricName)
+
+	assert.Equal(t, transit.ServiceOk, s2.Status)
+	assert.Len(t, s2.Metrics, 2)
+	assert.Equal(t, int64(1), *s2.Metrics[0].Value.IntegerValue)
+	assert.Equal(t, "m3", s2.Metrics[1].MetricName)
+}
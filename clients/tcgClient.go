@@ -1,9 +1,32 @@
 package clients
 
 import (
+	"bytes"
 	"context"
-	"github.com/rs/zerolog/log"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
 	"sync"
+
+	"github.com/gwos/tcg/sdk/clients"
+	tcgerr "github.com/gwos/tcg/sdk/errors"
+	"github.com/gwos/tcg/sdk/logper"
+	"github.com/gwos/tcg/sdk/transit"
+	"github.com/gwos/tcg/secrets"
+)
+
+// Define entrypoints of upstream TCG controller
+const (
+	TCGEntrypointConnect                 = "/api/v1/version"
+	TCGEntrypointClearInDowntime         = "/api/v1/clear-in-downtime"
+	TCGEntrypointSetInDowntime           = "/api/v1/set-in-downtime"
+	TCGEntrypointSendEvents              = "/api/v1/events"
+	TCGEntrypointSendEventsAck           = "/api/v1/events-ack"
+	TCGEntrypointSendEventsUnack         = "/api/v1/events-unack"
+	TCGEntrypointSendResourceWithMetrics = "/api/v1/metrics"
+	TCGEntrypointSynchronizeInventory    = "/api/v1/inventory"
 )
 
 // TCGConnection defines TCG Connection configuration
@@ -23,8 +46,32 @@ type TCGConnection struct {
 	PrefixResourceNames bool   `yaml:"prefixResourceNames"`
 	ResourceNamePrefix  string `yaml:"resourceNamePrefix"`
 	SendAllInventory    bool   `yaml:"sendAllInventory"`
-	IsDynamicInventory  bool   `yaml:"-"`
-	HTTPEncode          bool   `yaml:"-"`
+	// SkipUnchangedInventory omits the inventory equal to the last one delivered,
+	// it is ignored with SendAllInventory or IsDynamicInventory set
+	SkipUnchangedInventory bool `yaml:"skipUnchangedInventory"`
+	IsDynamicInventory     bool `yaml:"-"`
+	HTTPEncode             bool `yaml:"-"`
+	// RoutingRules filters the payloads delivered to connection
+	// the empty list means deliver all
+	RoutingRules []RoutingRule `yaml:"routingRules"`
+}
+
+// RoutingRule defines the rule for filtering payloads delivered to TCG Connection
+// empty fields match any value, HostName, HostGroup, AppType and ServiceName accept glob patterns
+// the payload item is delivered if it matches any of including rules (if defined)
+// and doesn't match any of excluding rules
+// the events, acks, unacks, clear-in-downtime and metrics without groups are checked by HostGroup
+// with groups of host from the last inventory, the unknown host doesn't match HostGroup rules
+type RoutingRule struct {
+	// Exclude turns the rule into excluding one
+	Exclude bool `yaml:"exclude"`
+	// PayloadTypes restricts the rule applying by payload types like:
+	// events, eventsAck, eventsUnack, inventory, metrics, clearInDowntime, setInDowntime
+	PayloadTypes []string `yaml:"payloadTypes"`
+	HostName     string   `yaml:"hostName"`
+	HostGroup    string   `yaml:"hostGroup"`
+	AppType      string   `yaml:"appType"`
+	ServiceName  string   `yaml:"serviceName"`
 }
 
 // TCGHostGroups defines collection
@@ -44,7 +91,7 @@ type TCGServices struct {
 	} `json:"services"`
 }
 
-// TCGClient implements TCG Connection
+// TCGClient implements upstream TCG API operations
 type TCGClient struct {
 	AppName string
 	AppType string
@@ -52,24 +99,305 @@ type TCGClient struct {
 
 	mu   sync.Mutex
 	once sync.Once
-}
 
-func (client *TCGClient) SendData(ctx context.Context, payload []byte) ([]byte, error) {
-	//log.Info().Msgf("Sending Metrics Data: %s", payload)
-	return nil, nil
-}
+	// authHeaders are prepared on Connect
+	// the local connection uses Password as the upstream X-PIN
+	// otherwise the BASIC credentials are verified by upstream
+	authHeaders map[string]string
+	// inventoryHashsum keeps the last delivered inventory
+	inventoryHashsum []byte
 
-func (client *TCGClient) SendEvent(ctx context.Context, payload []byte) ([]byte, error) {
-	log.Info().Msgf("Sending Event: %s", payload)
-	return nil, nil
+	uriConnect                 string
+	uriClearInDowntime         string
+	uriSetInDowntime           string
+	uriSendEvents              string
+	uriSendEventsAck           string
+	uriSendEventsUnack         string
+	uriSendResourceWithMetrics string
+	uriSynchronizeInventory    string
 }
 
 // Connect calls API
 func (client *TCGClient) Connect() error {
+	client.buildURIs()
+	/* restrict by mutex for one-thread at one-time */
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	/* resolve the secret reference on each connect to pick up the rotated one */
+	password, err := secrets.Resolve(client.TCGConnection.Password)
+	if err != nil {
+		client.authHeaders = nil
+		logper.Warn(map[string]interface{}{"error": err, "url": client.uriConnect}, "could not resolve tcg password")
+		return fmt.Errorf("%w: %v", tcgerr.ErrUnauthorized, err)
+	}
+	authHeaders := map[string]string{
+		"Accept":        "application/json",
+		"GWOS-APP-NAME": client.AppName,
+	}
+	if client.LocalConnection {
+		authHeaders["X-PIN"] = password
+	} else {
+		r, _ := http.NewRequest(http.MethodGet, client.uriConnect, nil)
+		r.SetBasicAuth(client.TCGConnection.UserName, password)
+		authHeaders["Authorization"] = r.Header.Get("Authorization")
+	}
+	req, err := (&clients.Req{
+		URL:     client.uriConnect,
+		Method:  http.MethodGet,
+		Headers: authHeaders,
+	}).Send()
+
+	if err = client.checkResponse(req, err, "could not connect tcg"); err != nil {
+		client.authHeaders = nil
+		return err
+	}
+	logper.Debug(req, "connect tcg")
+	client.authHeaders = authHeaders
 	return nil
 }
 
 // Disconnect calls API
 func (client *TCGClient) Disconnect() error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.authHeaders = nil
+	return nil
+}
+
+// AuthenticatePassword calls API with BASIC credentials
+// doesn't change the credentials of connection
+func (client *TCGClient) AuthenticatePassword(username, password string) error {
+	client.buildURIs()
+	r, _ := http.NewRequest(http.MethodGet, client.uriConnect, nil)
+	r.SetBasicAuth(username, password)
+	req, err := (&clients.Req{
+		URL:    client.uriConnect,
+		Method: http.MethodGet,
+		Headers: map[string]string{
+			"Accept":        "application/json",
+			"Authorization": r.Header.Get("Authorization"),
+			"GWOS-APP-NAME": client.AppName,
+		},
+	}).Send()
+	/* don't log the verified credentials */
+	req.Headers["Authorization"] = "Basic ***"
+	return client.checkResponse(req, err, "could not authenticate password")
+}
+
+// ClearInDowntime calls API
+func (client *TCGClient) ClearInDowntime(ctx context.Context, payload []byte) ([]byte, error) {
+	client.buildURIs()
+	return client.sendData(ctx, client.uriClearInDowntime, payload)
+}
+
+// SetInDowntime calls API
+func (client *TCGClient) SetInDowntime(ctx context.Context, payload []byte) ([]byte, error) {
+	client.buildURIs()
+	return client.sendData(ctx, client.uriSetInDowntime, payload)
+}
+
+// SendEvents calls API
+func (client *TCGClient) SendEvents(ctx context.Context, payload []byte) ([]byte, error) {
+	client.buildURIs()
+	return client.sendData(ctx, client.uriSendEvents, payload)
+}
+
+// SendEventsAck calls API
+func (client *TCGClient) SendEventsAck(ctx context.Context, payload []byte) ([]byte, error) {
+	client.buildURIs()
+	return client.sendData(ctx, client.uriSendEventsAck, payload)
+}
+
+// SendEventsUnack calls API
+func (client *TCGClient) SendEventsUnack(ctx context.Context, payload []byte) ([]byte, error) {
+	client.buildURIs()
+	return client.sendData(ctx, client.uriSendEventsUnack, payload)
+}
+
+// SendResourcesWithMetrics calls API
+func (client *TCGClient) SendResourcesWithMetrics(ctx context.Context, payload []byte) ([]byte, error) {
+	client.buildURIs()
+	return client.sendData(ctx, client.uriSendResourceWithMetrics, payload)
+}
+
+// SynchronizeInventory calls API
+// skips the inventory equal to the last delivered one if configured
+func (client *TCGClient) SynchronizeInventory(ctx context.Context, payload []byte) ([]byte, error) {
+	client.buildURIs()
+	var chk []byte
+	if client.SkipUnchangedInventory && !client.SendAllInventory && !client.IsDynamicInventory {
+		var err error
+		if chk, err = inventoryHashsum(payload); err != nil {
+			logper.Warn(obj{"error": err}, "could not calculate inventory hashsum")
+		} else if bytes.Equal(chk, client.getInventoryHashsum()) {
+			logper.Debug(nil, "skip unchanged inventory")
+			return nil, nil
+		}
+	}
+	response, err := client.sendData(ctx, client.uriSynchronizeInventory, payload)
+	if err == nil {
+		client.mu.Lock()
+		client.inventoryHashsum = chk
+		client.mu.Unlock()
+	}
+	return response, err
+}
+
+func (client *TCGClient) getInventoryHashsum() []byte {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.inventoryHashsum
+}
+
+func (client *TCGClient) sendData(ctx context.Context, reqURL string, payload []byte) ([]byte, error) {
+	if client.getAuthHeaders() == nil {
+		if err := client.Connect(); err != nil {
+			return nil, err
+		}
+	}
+	headers := client.makeHeaders()
+	req, err := (&clients.Req{
+		URL:     reqURL,
+		Method:  http.MethodPost,
+		Headers: headers,
+		Payload: payload,
+	}).SendWithContext(ctx)
+
+	if err == nil && req.Status == 401 {
+		logper.Debug(nil, "could not send tcg request: reconnecting")
+		if err := client.Connect(); err != nil {
+			logper.Error(obj{"error": err}, "could not send tcg request: could not reconnect")
+			return nil, err
+		}
+		req.Headers = client.makeHeaders()
+		req, err = req.SendWithContext(ctx)
+	}
+
+	if err = client.checkResponse(req, err, "could not send tcg request"); err != nil {
+		return nil, err
+	}
+	logper.Debug(req, "send tcg request")
+	return req.Response, nil
+}
+
+// checkResponse maps the transport error and response status on errors taxonomy
+func (client *TCGClient) checkResponse(req *clients.Req, err error, msg string) error {
+	switch {
+	case err != nil:
+		logper.Error(req, msg)
+		if tcgerr.IsErrorConnection(err) {
+			return fmt.Errorf("%w: %v", tcgerr.ErrTransient, err.Error())
+		}
+		return err
+
+	case req.Status == 401 || req.Status == 403:
+		eee := fmt.Errorf("%w: %v", tcgerr.ErrUnauthorized, string(req.Response))
+		req.Err = eee
+		logper.Warn(req, msg)
+		return eee
+
+	case req.Status == 502 || req.Status == 504:
+		eee := fmt.Errorf("%w: %v", tcgerr.ErrGateway, string(req.Response))
+		req.Err = eee
+		logper.Warn(req, msg)
+		return eee
+
+	case req.Status == 503:
+		eee := fmt.Errorf("%w: %v", tcgerr.ErrSynchronizer, string(req.Response))
+		req.Err = eee
+		logper.Warn(req, msg)
+		return eee
+
+	case req.Status == 500:
+		/* upstream controller returns 500 on failed queueing, like nats unavailable */
+		eee := fmt.Errorf("%w: %v", tcgerr.ErrTransient, string(req.Response))
+		req.Err = eee
+		logper.Warn(req, msg)
+		return eee
+
+	case req.Status != 200:
+		eee := fmt.Errorf("%w: %v", tcgerr.ErrUndecided, string(req.Response))
+		req.Err = eee
+		logper.Warn(req.Details(), msg)
+		return eee
+	}
 	return nil
 }
+
+func (client *TCGClient) getAuthHeaders() map[string]string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.authHeaders
+}
+
+func (client *TCGClient) makeHeaders() map[string]string {
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+	for k, v := range client.getAuthHeaders() {
+		headers[k] = v
+	}
+	if client.HTTPEncode {
+		headers["Content-Encoding"] = "gzip"
+	}
+	if client.PrefixResourceNames && client.ResourceNamePrefix != "" {
+		headers["HostNamePrefix"] = client.ResourceNamePrefix
+	}
+	return headers
+}
+
+func (client *TCGClient) buildURIs() {
+	client.once.Do(func() {
+		client.uriConnect = buildURI(client.TCGConnection.HostName, TCGEntrypointConnect)
+		client.uriClearInDowntime = buildURI(client.TCGConnection.HostName, TCGEntrypointClearInDowntime)
+		client.uriSetInDowntime = buildURI(client.TCGConnection.HostName, TCGEntrypointSetInDowntime)
+		client.uriSendEvents = buildURI(client.TCGConnection.HostName, TCGEntrypointSendEvents)
+		client.uriSendEventsAck = buildURI(client.TCGConnection.HostName, TCGEntrypointSendEventsAck)
+		client.uriSendEventsUnack = buildURI(client.TCGConnection.HostName, TCGEntrypointSendEventsUnack)
+		client.uriSendResourceWithMetrics = buildURI(client.TCGConnection.HostName, TCGEntrypointSendResourceWithMetrics)
+		client.uriSynchronizeInventory = buildURI(client.TCGConnection.HostName, TCGEntrypointSynchronizeInventory)
+	})
+}
+
+// buildURI makes the entrypoint url
+// the TCG controller listens plain http by default
+func buildURI(hostname, entrypoint string) string {
+	s := strings.TrimSuffix(strings.TrimRight(hostname, "/"), "/api/v1")
+	if !strings.HasPrefix(s, "http") {
+		s = "http://" + s
+	}
+	return fmt.Sprintf("%s/%s", s, strings.TrimLeft(entrypoint, "/"))
+}
+
+// inventoryHashsum calculates hashsum of inventory payload
+// the tracer context changes on every run and is omitted
+func inventoryHashsum(payload []byte) ([]byte, error) {
+	var r transit.InventoryRequest
+	if err := json.Unmarshal(payload, &r); err != nil {
+		return nil, err
+	}
+	return Hashsum(r.OwnershipType, r.Resources, r.Groups)
+}
+
+// Hashsum calculates FNV non-cryptographic hash suitable for checking the equality
+func Hashsum(args ...interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	for _, arg := range args {
+		s, err := json.Marshal(arg)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := b.Write(s); err != nil {
+			return nil, err
+		}
+	}
+	h := fnv.New128()
+	if _, err := h.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// obj defines a short alias
+type obj map[string]interface{}
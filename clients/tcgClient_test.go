@@ -0,0 +1,143 @@
+package clients
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	tcgerr "github.com/gwos/tcg/sdk/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCGClient_SendEvents(t *testing.T) {
+	var logins, sends int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		authorized := ok && user == "user" && pass == "pass"
+		switch r.URL.Path {
+		case TCGEntrypointConnect:
+			logins++
+			if !authorized {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case TCGEntrypointSendEvents:
+			sends++
+			/* reject the first request to force re-login */
+			if !authorized || sends == 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case TCGEntrypointSendResourceWithMetrics:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	client := &TCGClient{
+		AppName: "test",
+		TCGConnection: &TCGConnection{
+			HostName: srv.URL,
+			UserName: "user",
+			Password: "pass",
+		},
+	}
+
+	_, err := client.SendEvents(context.Background(), []byte(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, logins)
+	assert.Equal(t, 2, sends)
+
+	_, err = client.SendResourcesWithMetrics(context.Background(), []byte(`{}`))
+	assert.ErrorIs(t, err, tcgerr.ErrGateway)
+	assert.ErrorIs(t, err, tcgerr.ErrTransient)
+
+	client.Password = "wrong"
+	assert.NoError(t, client.Disconnect())
+	_, err = client.SendEvents(context.Background(), []byte(`{}`))
+	assert.ErrorIs(t, err, tcgerr.ErrUnauthorized)
+}
+
+func TestTCGClient_AuthenticatePassword(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	client := &TCGClient{
+		AppName:       "test",
+		TCGConnection: &TCGConnection{HostName: srv.URL},
+	}
+	assert.NoError(t, client.AuthenticatePassword("user", "pass"))
+	assert.ErrorIs(t, client.AuthenticatePassword("user", "wrong"), tcgerr.ErrUnauthorized)
+	assert.Nil(t, client.getAuthHeaders())
+}
+
+func TestTCGClient_ConnectSecret(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	client := &TCGClient{
+		AppName: "test",
+		TCGConnection: &TCGConnection{
+			HostName: srv.URL,
+			UserName: "user",
+			Password: "env:TCG_TEST_PASSWORD",
+		},
+	}
+	assert.ErrorIs(t, client.Connect(), tcgerr.ErrUnauthorized)
+	t.Setenv("TCG_TEST_PASSWORD", "pass")
+	assert.NoError(t, client.Connect())
+}
+
+func TestTCGClient_buildURI(t *testing.T) {
+	assert.Equal(t, "http://localhost:8099/api/v1/events",
+		buildURI("localhost:8099", TCGEntrypointSendEvents))
+	assert.Equal(t, "https://tcg-host/api/v1/events",
+		buildURI("https://tcg-host/api/v1/", TCGEntrypointSendEvents))
+}
+
+func TestTCGClient_SynchronizeInventory(t *testing.T) {
+	var sends int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == TCGEntrypointSynchronizeInventory {
+			sends++
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	client := &TCGClient{
+		TCGConnection: &TCGConnection{
+			HostName:               srv.URL,
+			SkipUnchangedInventory: true,
+		},
+	}
+	inv1 := []byte(`{"context":{"traceToken":"aaa"},"resources":[{"name":"host1"}]}`)
+	inv2 := []byte(`{"context":{"traceToken":"bbb"},"resources":[{"name":"host1"}]}`)
+	inv3 := []byte(`{"context":{"traceToken":"ccc"},"resources":[{"name":"host2"}]}`)
+
+	for _, p := range [][]byte{inv1, inv2, inv3} {
+		_, err := client.SynchronizeInventory(context.Background(), p)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, sends)
+
+	client.SendAllInventory = true
+	_, err := client.SynchronizeInventory(context.Background(), inv3)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, sends)
+}
@@ -1,11 +1,9 @@
 package config
 
 import (
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"path"
@@ -18,6 +16,7 @@ import (
 	"github.com/gwos/tcg/sdk/clients"
 	"github.com/gwos/tcg/sdk/logper"
 	"github.com/gwos/tcg/sdk/transit"
+	"github.com/gwos/tcg/secrets"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -26,7 +25,6 @@ import (
 	"go.opentelemetry.io/otel/sdk/resource"
 	tracesdk "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
-	"golang.org/x/crypto/nacl/secretbox"
 	"gopkg.in/yaml.v3"
 )
 
@@ -94,6 +92,32 @@ type Connector struct {
 	BatchEvents   time.Duration `yaml:"batchEvents"`
 	BatchMetrics  time.Duration `yaml:"batchMetrics"`
 	BatchMaxBytes int           `yaml:"batchMaxBytes"`
+	// BatchMaxItems limits the payloads combined into one batch, if 0 turn off limiting
+	BatchMaxItems int `yaml:"batchMaxItems"`
+	// BatchMaxBuffer limits the buffered bytes of each batcher
+	// the sending blocks while the buffer is full, if 0 turn off limiting
+	// it's off by default as the blocking could stall the callers on slow upstream
+	BatchMaxBuffer int `yaml:"batchMaxBuffer"`
+	// BatchCoalesceMetrics turns on merging the batched metrics of the same resources and services
+	// the latest sample per metric is kept
+	BatchCoalesceMetrics bool `yaml:"batchCoalesceMetrics"`
+	// BatchSuppressEvents turns on suppressing the batched events repeated within window
+	// the events with the same host, service, monitor status and text message are emitted once per window
+	// requires BatchEvents, as well as BatchEventsHostRate
+	BatchSuppressEvents time.Duration `yaml:"batchSuppressEvents"`
+	// BatchEventsHostRate limits the batched events per minute per host, if 0 turn off limiting
+	BatchEventsHostRate int `yaml:"batchEventsHostRate"`
+
+	// AuditFile accepts file path to log the state-changing calls of controller
+	// if empty turn off auditing, defaults to empty
+	AuditFile        string `yaml:"auditFile"`
+	AuditFileMaxSize int64  `yaml:"auditFileMaxSize"`
+	AuditFileRotate  int    `yaml:"auditFileRotate"`
+
+	// ConfigWatchInterval accepts time duration for polling the config file
+	// the changed file is reloaded as on SIGHUP, if 0 turn off watching, defaults to 0
+	// the file written by agent on config api call is not reloaded
+	ConfigWatchInterval time.Duration `yaml:"configWatchInterval"`
 
 	// ControllerAddr accepts value for combined "host:port"
 	// used as `http.Server{Addr}`
@@ -101,8 +125,18 @@ type Connector struct {
 	ControllerCertFile string `yaml:"controllerCertFile"`
 	ControllerKeyFile  string `yaml:"controllerKeyFile"`
 	// ControllerPin accepts value from environment
-	// provides local access for debug
+	// provides local access for debug with the "control" role
 	ControllerPin string `yaml:"-"`
+	// ControllerBasicRole defines the role granted for BASIC credentials and GWOS app tokens
+	// verified by upstream GW or TCG connection, defaults to "monitor"
+	ControllerBasicRole string `yaml:"controllerBasicRole"`
+	// ControllerTokens defines static API tokens with roles
+	// accepted in "Authorization: Bearer" or "GWOS-API-TOKEN" header
+	ControllerTokens ControllerTokens `yaml:"controllerTokens"`
+	// ControllerClientCAFile enables verifying client certificates on TLS
+	// the verified certificates get roles by ControllerClientCerts
+	ControllerClientCAFile string                 `yaml:"controllerClientCAFile"`
+	ControllerClientCerts  []ControllerClientCert `yaml:"controllerClientCerts"`
 	// Custom HTTP configuration
 	ControllerReadTimeout  time.Duration `yaml:"-"`
 	ControllerWriteTimeout time.Duration `yaml:"-"`
@@ -134,9 +168,9 @@ type Connector struct {
 	NatsAckWait time.Duration `yaml:"-"`
 	// designates the maximum number of outstanding acknowledgements
 	// (messages that have been delivered but not acknowledged)
-	// that NATS Streaming will allow for a given subscription.
-	// When this limit is reached, NATS Streaming will suspend delivery of messages
-	// to this subscription until the number of unacknowledged messages falls below the specified limit
+	// that NATS JetStream will allow for a given durable.
+	// When this limit is reached, NATS JetStream will suspend delivery of messages
+	// to this durable until the number of unacknowledged messages falls below the specified limit
 	NatsMaxInflight int `yaml:"-"`
 	// NatsMaxPubAcksInflight accepts number of unacknowledged messages
 	// that a publisher may have in-flight at any given time.
@@ -145,18 +179,20 @@ type Connector struct {
 	NatsMaxPubAcksInflight int   `yaml:"-"`
 	NatsMaxPayload         int32 `yaml:"-"`
 	// NatsMaxPendingBytes. Deprecated. Use NatsMaxInflight instead.
-	// sets the limits for pending msgs and bytes for the internal low-level NATS Subscription.
-	// Zero is not allowed. Any negative value means that the given metric is not limited.
+	// Not used since NATS JetStream.
 	NatsMaxPendingBytes int `yaml:"-"`
 	// NatsMaxPendingMsgs. Deprecated. Use NatsMaxInflight instead.
-	// sets the limits for pending msgs and bytes for the internal low-level NATS Subscription.
-	// Zero is not allowed. Any negative value means that the given metric is not limited.
+	// Not used since NATS JetStream.
 	NatsMaxPendingMsgs int `yaml:"-"`
 	// NatsMonitorPort enables monitoring on http port usefull for debug
-	// curl 'localhost:8222/streaming/channelsz?limit=0&offset=0&subs=1'
-	// More info: https://docs.nats.io/nats-streaming-concepts/monitoring
-	NatsMonitorPort int    `yaml:"-"`
-	NatsStoreDir    string `yaml:"natsFilestoreDir"`
+	// curl 'localhost:8222/jsz?streams=1&consumers=1'
+	// More info: https://docs.nats.io/running-a-nats-service/nats_admin/monitoring
+	NatsMonitorPort int `yaml:"-"`
+	// NatsBackend accepts "NATS"|"LOCAL"
+	// the LOCAL runs the in-process queue without listening ports
+	// and keeps it in NatsStoreDir for "FILE" store type
+	NatsBackend  string `yaml:"natsBackend"`
+	NatsStoreDir string `yaml:"natsFilestoreDir"`
 	// NatsStoreType accepts "FILE"|"MEMORY"
 	NatsStoreType string `yaml:"natsStoreType"`
 	// How long messages are kept
@@ -165,12 +201,27 @@ type Connector struct {
 	NatsStoreMaxBytes int64 `yaml:"natsStoreMaxBytes"`
 	// How many messages are allowed per-channel
 	NatsStoreMaxMsgs int `yaml:"natsStoreMaxMsgs"`
-	// NatsStoreBufferSize for FileStore type
+	// NatsStoreBufferSize for NATS Streaming FileStore on migration
 	// size (in bytes) of the buffer used during file store operations
 	NatsStoreBufferSize int `yaml:"-"`
-	// NatsStoreReadBufferSize for FileStore type
+	// NatsStoreReadBufferSize for NATS Streaming FileStore on migration
 	// size of the buffer to preload messages
 	NatsStoreReadBufferSize int `yaml:"-"`
+	// NatsRetry defines the retry policy of dispatcher
+	// with exponential backoff and overrides per error class
+	// MaxAttempts accepts negative value for unlimited retries
+	NatsRetry RetryConfig `yaml:"natsRetry"`
+
+	// ReadyFailureThreshold limits how long the upstream delivery may fail
+	// before the "/readyz" probe reports not ready
+	ReadyFailureThreshold time.Duration `yaml:"readyFailureThreshold"`
+
+	// ShutdownTimeout limits the draining on exit
+	// the batchers are flushed and the in-flight messages are handled until timed out,
+	// the queued backlog is left for the next start
+	// if 0 the batchers are flushed without waiting the dispatcher
+	// the default stays below the common 30s termination grace period
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
 }
 
 // ConnectorDTO defines TCG Connector configuration
@@ -196,11 +247,11 @@ type GWConnection clients.GWConnection
 type TCGConnection tcgclients.TCGConnection
 
 // MarshalYAML implements yaml.Marshaler interface
-// overrides the password field
+// overrides the password field, the secret references are kept as is
 func (con GWConnection) MarshalYAML() (interface{}, error) {
 	type plain GWConnection
 	c := plain(con)
-	if s := os.Getenv(SecKeyEnv); s != "" {
+	if s := os.Getenv(SecKeyEnv); s != "" && !secrets.IsRef(c.Password) {
 		encrypted, err := Encrypt([]byte(c.Password), []byte(s))
 		if err != nil {
 			return nil, err
@@ -344,6 +395,42 @@ func (con *DSConnection) Decode(value string) error {
 	return nil
 }
 
+// Define controller roles
+// the "monitor" role allows read-only requests like stats and status
+// the "control" role allows all requests
+const (
+	ControllerRoleMonitor = "monitor"
+	ControllerRoleControl = "control"
+)
+
+// ControllerToken defines static API token of controller
+type ControllerToken struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	Role  string `yaml:"role"`
+}
+
+// ControllerTokens defines a set of tokens
+type ControllerTokens []ControllerToken
+
+// Decode implements envconfig.Decoder interface
+// replaces existing tokens with incoming value
+func (tokens *ControllerTokens) Decode(value string) error {
+	var overrides ControllerTokens
+	if err := yaml.Unmarshal([]byte(value), &overrides); err != nil {
+		return err
+	}
+	*tokens = overrides
+	return nil
+}
+
+// ControllerClientCert maps verified client certificate to role of controller
+// CommonName accepts glob pattern matching the certificate subject, "*" matches any
+type ControllerClientCert struct {
+	CommonName string `yaml:"commonName"`
+	Role       string `yaml:"role"`
+}
+
 // Jaegertracing defines the configuration of telemetry provider
 type Jaegertracing struct {
 	// Agent defines address for communicating with AgentJaegerThriftCompactUDP,
@@ -369,10 +456,18 @@ type Config struct {
 func defaults() Config {
 	return Config{
 		Connector: &Connector{
+			AuditFile:               "",
+			AuditFileMaxSize:        1024 * 1024 * 10, // 10MB
+			AuditFileRotate:         5,
 			BatchEvents:             0,
 			BatchMetrics:            0,
 			BatchMaxBytes:           1024 * 1024, // 1MB
+			BatchMaxItems:           0,
+			BatchMaxBuffer:          0,
+			BatchCoalesceMetrics:    false,
+			ConfigWatchInterval:     0,
 			ControllerAddr:          ":8099",
+			ControllerBasicRole:     ControllerRoleMonitor,
 			ControllerReadTimeout:   time.Second * 10,
 			ControllerWriteTimeout:  time.Second * 20,
 			ControllerStartTimeout:  time.Second * 4,
@@ -390,6 +485,7 @@ func defaults() Config {
 			NatsMaxPendingBytes:     -1,
 			NatsMaxPendingMsgs:      1024,
 			NatsMonitorPort:         0,
+			NatsBackend:             "NATS",
 			NatsStoreDir:            "natsstore",
 			NatsStoreType:           "FILE",
 			NatsStoreMaxAge:         time.Hour * 24 * 10,     // 10days
@@ -397,6 +493,17 @@ func defaults() Config {
 			NatsStoreMaxMsgs:        1000000,                 // 1 000 000
 			NatsStoreBufferSize:     1024 * 1024 * 2,         // 2MB
 			NatsStoreReadBufferSize: 1024 * 1024 * 2,         // 2MB
+			NatsRetry: RetryConfig{
+				RetryPolicy: RetryPolicy{
+					InitialDelay: DefaultRetryDelay,
+					Multiplier:   2,
+					MaxDelay:     time.Minute * 20,
+					Jitter:       0.1,
+					MaxAttempts:  4,
+				},
+			},
+			ReadyFailureThreshold: time.Minute * 10,
+			ShutdownTimeout:       time.Second * 20,
 		},
 		DSConnection:  &DSConnection{},
 		Jaegertracing: &Jaegertracing{},
@@ -457,6 +564,11 @@ func (cfg *Config) loadConnector(data []byte) (*ConnectorDTO, error) {
 		log.Err(err).Msg("could not parse connector")
 		return nil, err
 	}
+	/* the connector comes from config api, deny reading local secrets */
+	v := Validation{}
+	if dto.validateRemoteSecrets(&v); len(v.Errors) > 0 {
+		return nil, fmt.Errorf("invalid connector: %v", v.Errors[0])
+	}
 	cfg.Connector.AgentID = dto.AgentID
 	cfg.Connector.AppName = dto.AppName
 	cfg.Connector.AppType = dto.AppType
@@ -521,8 +633,8 @@ func (cfg *Config) loadDynamicInventoryFlag(data []byte) error {
 	return nil
 }
 
-// LoadConnectorDTO loads ConnectorDTO into Config
-func (cfg *Config) LoadConnectorDTO(data []byte) (*ConnectorDTO, error) {
+// mergeConnectorDTO returns config file merged with ConnectorDTO
+func (cfg *Config) mergeConnectorDTO(data []byte) (*Config, *ConnectorDTO, error) {
 	c := defaults()
 	newCfg := &c
 	/* load config file */
@@ -540,14 +652,40 @@ func (cfg *Config) LoadConnectorDTO(data []byte) (*ConnectorDTO, error) {
 	/* load as ConnectorDTO */
 	dto, err := newCfg.loadConnector(data)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	/* load as struct with advanced prefixes field */
 	if err := newCfg.loadAdvancedPrefixes(data); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	/* load as struct with dynamic inventory flag */
 	if err := newCfg.loadDynamicInventoryFlag(data); err != nil {
+		return nil, nil, err
+	}
+	return newCfg, dto, nil
+}
+
+// PreviewConnectorDTO returns the effective config with ConnectorDTO applied
+// without writing config file and updating the current config
+func (cfg *Config) PreviewConnectorDTO(data []byte) (*Config, *ConnectorDTO, error) {
+	newCfg, dto, err := cfg.mergeConnectorDTO(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := envconfig.Process(EnvConfigPrefix, newCfg); err != nil {
+		return nil, nil, err
+	}
+	if cfg.IsConfiguringPMC() {
+		newCfg.Connector.InstallationMode = InstallationModePMC
+	}
+	newCfg.prepareConnections()
+	return newCfg, dto, nil
+}
+
+// LoadConnectorDTO loads ConnectorDTO into Config
+func (cfg *Config) LoadConnectorDTO(data []byte) (*ConnectorDTO, error) {
+	newCfg, dto, err := cfg.mergeConnectorDTO(data)
+	if err != nil {
 		return nil, err
 	}
 	/* override config file */
@@ -559,6 +697,8 @@ func (cfg *Config) LoadConnectorDTO(data []byte) (*ConnectorDTO, error) {
 			log.Err(err).
 				Str("configPath", newCfg.ConfigPath()).
 				Msg("could not write config")
+		} else {
+			writtenSum.Store(sha256.Sum256(output))
 		}
 	}
 	/* load environment */
@@ -571,18 +711,14 @@ func (cfg *Config) LoadConnectorDTO(data []byte) (*ConnectorDTO, error) {
 	if cfg.IsConfiguringPMC() {
 		newCfg.Connector.InstallationMode = InstallationModePMC
 	}
-	/* prepare gwConnections */
-	gwEncode := strings.ToLower(newCfg.Connector.GWEncode)
-	for i := range newCfg.GWConnections {
-		newCfg.GWConnections[i].IsDynamicInventory = newCfg.Connector.IsDynamicInventory
-		newCfg.GWConnections[i].HTTPEncode = gwEncode == "force" ||
-			(gwEncode != "off" && newCfg.GWConnections[i].IsChild)
-	}
+	/* prepare gwConnections and tcgConnections */
+	newCfg.prepareConnections()
 	/* update config */
 	*cfg.Connector = *newCfg.Connector
 	*cfg.DSConnection = *newCfg.DSConnection
 	*cfg.Jaegertracing = *newCfg.Jaegertracing
 	cfg.GWConnections = newCfg.GWConnections
+	cfg.TCGConnections = newCfg.TCGConnections
 
 	/* update logger */
 	cfg.initLogger()
@@ -753,23 +889,11 @@ func log2zerolog(lvl zerolog.Level, fields interface{}, format string, a ...inte
 // Decrypt decrypts small messages
 // golang.org/x/crypto/nacl/secretbox
 func Decrypt(message, secret []byte) ([]byte, error) {
-	var nonce [24]byte
-	var secretKey [32]byte = sha256.Sum256(secret)
-	copy(nonce[:], message[:24])
-	decrypted, ok := secretbox.Open(nil, message[24:], &nonce, &secretKey)
-	if !ok {
-		return nil, fmt.Errorf("decryption error")
-	}
-	return decrypted, nil
+	return secrets.Decrypt(message, secret)
 }
 
 // Encrypt encrypts small messages
 // golang.org/x/crypto/nacl/secretbox
 func Encrypt(message, secret []byte) ([]byte, error) {
-	var nonce [24]byte
-	var secretKey [32]byte = sha256.Sum256(secret)
-	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
-		return nil, err
-	}
-	return secretbox.Seal(nonce[:], message, &nonce, &secretKey), nil
+	return secrets.Encrypt(message, secret)
 }
@@ -159,6 +159,8 @@ dsConnection:
 	assert.NoError(t, err)
 	assert.Contains(t, string(data), "99998888-7777-6666-a3b0-b14622f7dd39")
 	assert.Contains(t, string(data), "controllerAddr: :8011")
+	assert.True(t, IsWritten(data))
+	assert.False(t, IsWritten(configYAML))
 }
 
 func TestMarshaling(t *testing.T) {
@@ -0,0 +1,266 @@
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v3"
+)
+
+// writtenSum keeps the checksum of the config file written by agent
+var writtenSum atomic.Value
+
+// IsWritten checks the config file data is the last one written by agent
+// used to skip reloading the file changed by config api call
+func IsWritten(data []byte) bool {
+	sum, ok := writtenSum.Load().([sha256.Size]byte)
+	return ok && sum == sha256.Sum256(data)
+}
+
+// restartFields lists the Connector fields applied on restart only
+// reloading keeps their live values and reports the changes
+var restartFields = map[string]bool{
+	"AuditFile":               true,
+	"AuditFileMaxSize":        true,
+	"AuditFileRotate":         true,
+	"ConfigWatchInterval":     true,
+	"ControllerAddr":          true,
+	"ControllerCertFile":      true,
+	"ControllerKeyFile":       true,
+	"ControllerClientCAFile":  true,
+	"ControllerReadTimeout":   true,
+	"ControllerWriteTimeout":  true,
+	"ControllerStartTimeout":  true,
+	"ControllerStopTimeout":   true,
+	"NatsAckWait":             true,
+	"NatsMaxInflight":         true,
+	"NatsMaxPubAcksInflight":  true,
+	"NatsMaxPayload":          true,
+	"NatsMaxPendingBytes":     true,
+	"NatsMaxPendingMsgs":      true,
+	"NatsMonitorPort":         true,
+	"NatsBackend":             true,
+	"NatsStoreDir":            true,
+	"NatsStoreType":           true,
+	"NatsStoreMaxAge":         true,
+	"NatsStoreMaxBytes":       true,
+	"NatsStoreMaxMsgs":        true,
+	"NatsStoreBufferSize":     true,
+	"NatsStoreReadBufferSize": true,
+}
+
+// runtimeFields lists the Connector fields computed at runtime
+// they are not loaded from file and are not compared
+var runtimeFields = map[string]bool{
+	"IsDynamicInventory": true,
+}
+
+// Change describes the changed setting
+// Path is the Go field path like "Connector.LogLevel"
+// the Old and New values are omitted for connections and masked for secrets
+// Restart marks the change not applied until restart
+type Change struct {
+	Path    string      `json:"path"`
+	Old     interface{} `json:"old,omitempty"`
+	New     interface{} `json:"new,omitempty"`
+	Restart bool        `json:"restart,omitempty"`
+}
+
+func (ch Change) String() string {
+	if ch.Old == nil && ch.New == nil {
+		return ch.Path
+	}
+	return fmt.Sprintf("%s: %v -> %v", ch.Path, ch.Old, ch.New)
+}
+
+// Diff describes the changes of config
+type Diff []Change
+
+// Changed returns true if some setting with the path prefix is changed and applied
+func (d Diff) Changed(prefixes ...string) bool {
+	for _, ch := range d {
+		for _, prefix := range prefixes {
+			if !ch.Restart && strings.HasPrefix(ch.Path, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RestartRequired returns the changes not applied until restart
+func (d Diff) RestartRequired() Diff {
+	var res Diff
+	for _, ch := range d {
+		if ch.Restart {
+			res = append(res, ch)
+		}
+	}
+	return res
+}
+
+// Reload re-reads the config file with environment and applies the changes
+// the settings listed in restartFields keep their live values
+// returns error without changes if the config file could not be parsed
+func (cfg *Config) Reload() (Diff, error) {
+	newCfg, err := cfg.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	diff := cfg.diff(newCfg)
+
+	/* keep the settings applied on restart */
+	live, next := reflect.ValueOf(cfg.Connector).Elem(), reflect.ValueOf(newCfg.Connector).Elem()
+	for name := range runtimeFields {
+		next.FieldByName(name).Set(live.FieldByName(name))
+	}
+	for _, ch := range diff {
+		if ch.Restart {
+			name := strings.TrimPrefix(ch.Path, "Connector.")
+			next.FieldByName(name).Set(live.FieldByName(name))
+		}
+	}
+	newCfg.prepareConnections()
+
+	/* update config */
+	*cfg.Connector = *newCfg.Connector
+	*cfg.DSConnection = *newCfg.DSConnection
+	*cfg.Jaegertracing = *newCfg.Jaegertracing
+	cfg.GWConnections = newCfg.GWConnections
+	cfg.TCGConnections = newCfg.TCGConnections
+
+	if diff.Changed("Connector.Log") {
+		cfg.initLogger()
+	}
+	return diff, nil
+}
+
+// readConfig returns defaults overridden with config file and environment
+func (cfg *Config) readConfig() (*Config, error) {
+	newCfg, err := ReadConfigFile(cfg.ConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	if cfg.IsConfiguringPMC() {
+		newCfg.Connector.InstallationMode = InstallationModePMC
+	}
+	return newCfg, nil
+}
+
+// ReadConfigFile returns defaults overridden with config file and environment
+// the current config is not affected, useful for offline validation
+func ReadConfigFile(configPath string) (*Config, error) {
+	c := defaults()
+	newCfg := &c
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, newCfg); err != nil {
+		return nil, err
+	}
+	if err := envconfig.Process(EnvConfigPrefix, newCfg); err != nil {
+		return nil, err
+	}
+	newCfg.prepareConnections()
+	return newCfg, nil
+}
+
+// prepareConnections sets the runtime fields of connections
+func (cfg *Config) prepareConnections() {
+	gwEncode := strings.ToLower(cfg.Connector.GWEncode)
+	for i := range cfg.GWConnections {
+		cfg.GWConnections[i].IsDynamicInventory = cfg.Connector.IsDynamicInventory
+		cfg.GWConnections[i].HTTPEncode = gwEncode == "force" ||
+			(gwEncode != "off" && cfg.GWConnections[i].IsChild)
+	}
+	for i := range cfg.TCGConnections {
+		cfg.TCGConnections[i].IsDynamicInventory = cfg.Connector.IsDynamicInventory
+	}
+}
+
+// diff compares the config with the new one
+func (cfg *Config) diff(newCfg *Config) Diff {
+	var diff Diff
+	diffStruct(&diff, "Connector", reflect.ValueOf(*cfg.Connector), reflect.ValueOf(*newCfg.Connector))
+
+	if !reflect.DeepEqual(gwConnectionsCmp(cfg.GWConnections), gwConnectionsCmp(newCfg.GWConnections)) {
+		diff = append(diff, Change{Path: "GWConnections"})
+	}
+	if !reflect.DeepEqual(tcgConnectionsCmp(cfg.TCGConnections), tcgConnectionsCmp(newCfg.TCGConnections)) {
+		diff = append(diff, Change{Path: "TCGConnections"})
+	}
+	if !reflect.DeepEqual(*cfg.DSConnection, *newCfg.DSConnection) {
+		diff = append(diff, Change{Path: "DSConnection"})
+	}
+	if !reflect.DeepEqual(*cfg.Jaegertracing, *newCfg.Jaegertracing) {
+		diff = append(diff, Change{Path: "Jaegertracing"})
+	}
+	return diff
+}
+
+func diffStruct(diff *Diff, path string, old, new reflect.Value) {
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			diffStruct(diff, path, old.Field(i), new.Field(i))
+			continue
+		}
+		if runtimeFields[field.Name] {
+			continue
+		}
+		oldValue, newValue := old.Field(i).Interface(), new.Field(i).Interface()
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		if isSecretField(field.Name) {
+			oldValue, newValue = maskSecret(oldValue), maskSecret(newValue)
+		}
+		*diff = append(*diff, Change{
+			Path:    path + "." + field.Name,
+			Old:     oldValue,
+			New:     newValue,
+			Restart: restartFields[field.Name],
+		})
+	}
+}
+
+func isSecretField(name string) bool {
+	return strings.Contains(name, "Password") ||
+		strings.Contains(name, "Pin") ||
+		strings.Contains(name, "Token")
+}
+
+func maskSecret(v interface{}) interface{} {
+	if reflect.ValueOf(v).IsZero() {
+		return ""
+	}
+	return "***"
+}
+
+// gwConnectionsCmp returns connections without runtime fields
+func gwConnectionsCmp(cons GWConnections) []GWConnection {
+	res := make([]GWConnection, 0, len(cons))
+	for _, c := range cons {
+		con := *c
+		con.IsDynamicInventory, con.HTTPEncode = false, false
+		res = append(res, con)
+	}
+	return res
+}
+
+// tcgConnectionsCmp returns connections without runtime fields
+func tcgConnectionsCmp(cons TCGConnections) []TCGConnection {
+	res := make([]TCGConnection, 0, len(cons))
+	for _, c := range cons {
+		con := *c
+		con.IsDynamicInventory, con.HTTPEncode = false, false
+		res = append(res, con)
+	}
+	return res
+}
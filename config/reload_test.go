@@ -0,0 +1,77 @@
+package config
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	once = sync.Once{}
+	configYAML := []byte(`
+connector:
+  appName: "test-app"
+  batchEvents: "1s"
+  logLevel: 1
+  natsStoreType: "MEMORY"
+tcgConnections:
+  - hostName: "tcg-host-1"
+    password: "pass"
+`)
+	tmpFile, err := os.CreateTemp("", "config")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(configYAML)
+	assert.NoError(t, err)
+
+	_ = os.Setenv(ConfigEnv, tmpFile.Name())
+	defer os.Unsetenv(ConfigEnv)
+
+	cfg := GetConfig()
+	connector := cfg.Connector
+	diff, err := cfg.Reload()
+	assert.NoError(t, err)
+	assert.Empty(t, diff)
+
+	configYAML = []byte(`
+connector:
+  appName: "test-app"
+  batchEvents: "5s"
+  controllerTokens:
+    - name: "ci"
+      token: "secret"
+      role: "monitor"
+  logLevel: 3
+  natsStoreType: "FILE"
+tcgConnections:
+  - hostName: "tcg-host-2"
+    password: "pass"
+`)
+	assert.NoError(t, os.WriteFile(tmpFile.Name(), configYAML, 0644))
+	diff, err = cfg.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, Diff{
+		{Path: "Connector.BatchEvents", Old: time.Second, New: time.Second * 5},
+		{Path: "Connector.ControllerTokens", Old: "", New: "***"},
+		{Path: "Connector.LogLevel", Old: Warn, New: Debug},
+		{Path: "Connector.NatsStoreType", Old: "MEMORY", New: "FILE", Restart: true},
+		{Path: "TCGConnections"},
+	}, diff)
+	assert.True(t, diff.Changed("Connector.Batch", "Jaegertracing"))
+	assert.False(t, diff.Changed("Connector.NatsStoreType"))
+	assert.Len(t, diff.RestartRequired(), 1)
+
+	assert.Same(t, connector, cfg.Connector)
+	assert.Equal(t, time.Second*5, cfg.Connector.BatchEvents)
+	assert.Equal(t, Debug, cfg.Connector.LogLevel)
+	assert.Equal(t, "MEMORY", cfg.Connector.NatsStoreType)
+	assert.Equal(t, "tcg-host-2", cfg.TCGConnections[0].HostName)
+
+	assert.NoError(t, os.WriteFile(tmpFile.Name(), []byte("connector: ["), 0644))
+	_, err = cfg.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, time.Second*5, cfg.Connector.BatchEvents)
+}
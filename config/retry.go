@@ -0,0 +1,89 @@
+package config
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	tcgerr "github.com/gwos/tcg/sdk/errors"
+)
+
+// DefaultRetryDelay defines the InitialDelay used if not positive
+// so the unlimited retries never run in a tight loop against upstream
+const DefaultRetryDelay = time.Second * 30
+
+// RetryPolicy defines the retrying of failed deliveries
+type RetryPolicy struct {
+	// InitialDelay is the delay before the first retry
+	InitialDelay time.Duration `yaml:"initialDelay"`
+	// Multiplier increases the delay for each next retry
+	Multiplier float64 `yaml:"multiplier"`
+	// MaxDelay limits the delay
+	MaxDelay time.Duration `yaml:"maxDelay"`
+	// Jitter randomizes the delay by the fraction in range [0, 1]
+	Jitter float64 `yaml:"jitter"`
+	// MaxAttempts limits the number of retries, negative value means unlimited
+	MaxAttempts int `yaml:"maxAttempts"`
+}
+
+// RetryConfig defines the retry policy with overrides per error class
+// the zero fields of override are inherited from the base policy
+type RetryConfig struct {
+	RetryPolicy  `yaml:",inline"`
+	Gateway      RetryPolicy `yaml:"gateway"`
+	Synchronizer RetryPolicy `yaml:"synchronizer"`
+}
+
+// PolicyFor returns the policy for error class
+func (c RetryConfig) PolicyFor(err error) RetryPolicy {
+	switch {
+	case errors.Is(err, tcgerr.ErrGateway):
+		return c.RetryPolicy.merge(c.Gateway)
+	case errors.Is(err, tcgerr.ErrSynchronizer):
+		return c.RetryPolicy.merge(c.Synchronizer)
+	}
+	return c.RetryPolicy
+}
+
+// Delay returns the delay before the retry, counted from 1
+// the not positive InitialDelay falls back to DefaultRetryDelay
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	initialDelay := p.InitialDelay
+	if initialDelay <= 0 {
+		initialDelay = DefaultRetryDelay
+	}
+	multiplier := math.Max(p.Multiplier, 1)
+	delay := float64(initialDelay) * math.Pow(multiplier, float64(retry-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if jitter := math.Min(math.Max(p.Jitter, 0), 1); jitter > 0 {
+		delay += delay * jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// CanRetry checks the limit of retries, counted from 1
+func (p RetryPolicy) CanRetry(retry int) bool {
+	return p.MaxAttempts < 0 || retry <= p.MaxAttempts
+}
+
+func (p RetryPolicy) merge(override RetryPolicy) RetryPolicy {
+	if override.InitialDelay != 0 {
+		p.InitialDelay = override.InitialDelay
+	}
+	if override.Multiplier != 0 {
+		p.Multiplier = override.Multiplier
+	}
+	if override.MaxDelay != 0 {
+		p.MaxDelay = override.MaxDelay
+	}
+	if override.Jitter != 0 {
+		p.Jitter = override.Jitter
+	}
+	if override.MaxAttempts != 0 {
+		p.MaxAttempts = override.MaxAttempts
+	}
+	return p
+}
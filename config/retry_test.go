@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	tcgerr "github.com/gwos/tcg/sdk/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	cfg := RetryConfig{
+		RetryPolicy: RetryPolicy{
+			InitialDelay: time.Second * 30,
+			Multiplier:   2,
+			MaxDelay:     time.Minute * 2,
+			MaxAttempts:  3,
+		},
+		Synchronizer: RetryPolicy{
+			InitialDelay: time.Minute,
+			MaxAttempts:  -1,
+		},
+	}
+
+	p := cfg.PolicyFor(fmt.Errorf("%w: bad gateway", tcgerr.ErrGateway))
+	assert.Equal(t, time.Second*30, p.Delay(1))
+	assert.Equal(t, time.Minute, p.Delay(2))
+	assert.Equal(t, time.Minute*2, p.Delay(3))
+	assert.Equal(t, time.Minute*2, p.Delay(10))
+	assert.True(t, p.CanRetry(3))
+	assert.False(t, p.CanRetry(4))
+
+	p = cfg.PolicyFor(fmt.Errorf("%w: unavailable", tcgerr.ErrSynchronizer))
+	assert.Equal(t, time.Minute, p.Delay(1))
+	assert.Equal(t, time.Minute*2, p.Delay(2))
+	assert.True(t, p.CanRetry(1000))
+
+	p = RetryPolicy{InitialDelay: 0, MaxAttempts: -1}
+	assert.Equal(t, DefaultRetryDelay, p.Delay(1))
+
+	p = RetryPolicy{InitialDelay: time.Minute, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		d := p.Delay(1)
+		assert.GreaterOrEqual(t, d, time.Second*30)
+		assert.LessOrEqual(t, d, time.Second*90)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gwos/tcg/config"
+	"github.com/gwos/tcg/secrets"
+	"github.com/spf13/pflag"
+)
+
+const usage = `Usage: tcgconfig <command> [options]
+
+Commands:
+  validate    validate the config file offline and print the effective config
+  keygen      generate the key file for encrypted secrets
+  encrypt     encrypt the secret value read from stdin
+  rotate      re-encrypt the secrets of config file with the new key
+
+Run "tcgconfig <command> --help" for options.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "validate":
+		os.Exit(validate(os.Args[2:], os.Stdout))
+	case "keygen":
+		os.Exit(keygen(os.Args[2:], os.Stdout))
+	case "encrypt":
+		os.Exit(encrypt(os.Args[2:], os.Stdin, os.Stdout))
+	case "rotate":
+		os.Exit(rotate(os.Args[2:], os.Stdout))
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
+
+// validate reads the config file merged with TCG_ environment
+// prints the found issues and the effective config with secrets masked
+// returns exit code 1 if there are errors
+func validate(args []string, w io.Writer) int {
+	flags := pflag.NewFlagSet("validate", pflag.ExitOnError)
+	flags.SortFlags = false
+	configPath := flags.String("config", config.Config{}.ConfigPath(),
+		"Config file path, defaults to "+config.ConfigEnv+" or "+config.ConfigName+" in work directory")
+	quiet := flags.Bool("quiet", false, "Omit printing the effective config")
+	_ = flags.Parse(args)
+
+	cfg, err := config.ReadConfigFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(w, "could not read config %s: %v\n", *configPath, err)
+		return 1
+	}
+	validation := cfg.Validate()
+	for _, fi := range validation.Errors {
+		fmt.Fprintf(w, "ERROR   %s\n", fi)
+	}
+	for _, fi := range validation.Warnings {
+		fmt.Fprintf(w, "WARNING %s\n", fi)
+	}
+	if !*quiet {
+		output, err := cfg.EffectiveYAML()
+		if err != nil {
+			fmt.Fprintf(w, "could not prepare effective config: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(w, "# effective config: %s\n%s", *configPath, output)
+	}
+	if !validation.Valid() {
+		return 1
+	}
+	return 0
+}
+
+// keygen writes the random key readable by owner only
+func keygen(args []string, w io.Writer) int {
+	flags := pflag.NewFlagSet("keygen", pflag.ExitOnError)
+	flags.SortFlags = false
+	keyFile := flags.String("key-file", os.Getenv(secrets.KeyFileEnv),
+		"Key file path, defaults to "+secrets.KeyFileEnv)
+	force := flags.Bool("force", false, "Overwrite the existing key file")
+	_ = flags.Parse(args)
+
+	if *keyFile == "" {
+		fmt.Fprintln(w, "key file is not defined")
+		return 1
+	}
+	if _, err := os.Stat(*keyFile); err == nil && !*force {
+		fmt.Fprintf(w, "key file exists: %s, use --force to overwrite\n", *keyFile)
+		return 1
+	}
+	if err := writeKey(*keyFile); err != nil {
+		fmt.Fprintf(w, "could not write key file: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(w, "generated key file: %s\n", *keyFile)
+	return 0
+}
+
+// encrypt prints the "enc:" reference for value read from the first line of input
+func encrypt(args []string, r io.Reader, w io.Writer) int {
+	flags := pflag.NewFlagSet("encrypt", pflag.ExitOnError)
+	flags.SortFlags = false
+	keyFile := flags.String("key-file", os.Getenv(secrets.KeyFileEnv),
+		"Key file path, defaults to "+secrets.KeyFileEnv)
+	_ = flags.Parse(args)
+
+	key, err := secrets.ReadKey(*keyFile)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	value, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(w, "could not read value: %v\n", err)
+		return 1
+	}
+	value = strings.TrimRight(value, "\r\n")
+	if value == "" {
+		fmt.Fprintln(w, "empty value")
+		return 1
+	}
+	ref, err := secrets.Seal(value, key)
+	if err != nil {
+		fmt.Fprintf(w, "could not encrypt value: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(w, ref)
+	return 0
+}
+
+// rotate re-encrypts the "enc:" references in config file
+// the new key file is generated if not exists
+func rotate(args []string, w io.Writer) int {
+	flags := pflag.NewFlagSet("rotate", pflag.ExitOnError)
+	flags.SortFlags = false
+	configPath := flags.String("config", config.Config{}.ConfigPath(),
+		"Config file path, defaults to "+config.ConfigEnv+" or "+config.ConfigName+" in work directory")
+	keyFile := flags.String("key-file", os.Getenv(secrets.KeyFileEnv),
+		"Current key file path, defaults to "+secrets.KeyFileEnv)
+	newKeyFile := flags.String("new-key-file", "", "New key file path, generated if not exists")
+	dryRun := flags.Bool("dry-run", false, "Check the secrets without writing")
+	_ = flags.Parse(args)
+
+	if *newKeyFile == "" || *newKeyFile == *keyFile {
+		fmt.Fprintln(w, "new key file should be defined and differ from the current one")
+		return 1
+	}
+	oldKey, err := secrets.ReadKey(*keyFile)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	if _, err := os.Stat(*newKeyFile); os.IsNotExist(err) && !*dryRun {
+		if err := writeKey(*newKeyFile); err != nil {
+			fmt.Fprintf(w, "could not write new key file: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(w, "generated key file: %s\n", *newKeyFile)
+	}
+	newKey := oldKey
+	if !*dryRun {
+		if newKey, err = secrets.ReadKey(*newKeyFile); err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+	}
+
+	fi, err := os.Stat(*configPath)
+	if err != nil {
+		fmt.Fprintf(w, "could not read config: %v\n", err)
+		return 1
+	}
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(w, "could not read config: %v\n", err)
+		return 1
+	}
+	output, count, err := secrets.Rotate(data, oldKey, newKey)
+	if err != nil {
+		fmt.Fprintf(w, "could not rotate secrets of %s: %v\n", *configPath, err)
+		return 1
+	}
+	if *dryRun {
+		fmt.Fprintf(w, "found %d secrets readable with current key in %s\n", count, *configPath)
+		return 0
+	}
+	/* replace the file at once to keep it consistent */
+	tmp := filepath.Join(filepath.Dir(*configPath), "."+filepath.Base(*configPath)+".tmp")
+	if err := os.WriteFile(tmp, output, fi.Mode().Perm()); err != nil {
+		fmt.Fprintf(w, "could not write config: %v\n", err)
+		return 1
+	}
+	if err := os.Rename(tmp, *configPath); err != nil {
+		_ = os.Remove(tmp)
+		fmt.Fprintf(w, "could not write config: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(w, "rotated %d secrets in %s, set %s=%s\n", count, *configPath, secrets.KeyFileEnv, *newKeyFile)
+	return 0
+}
+
+func writeKey(keyFile string) error {
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, append(key, '\n'), 0600)
+}
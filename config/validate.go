@@ -0,0 +1,517 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gwos/tcg/secrets"
+	"gopkg.in/yaml.v3"
+)
+
+// FieldIssue describes the issue of config field
+// Field is the path like "connector.natsAckWait" or "gwConnections[0].hostName"
+type FieldIssue struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (fi FieldIssue) String() string {
+	return fmt.Sprintf("%s: %s", fi.Field, fi.Message)
+}
+
+// Validation keeps the issues found in config
+// the errors make config unusable, the warnings point to suspicious values
+type Validation struct {
+	Errors   []FieldIssue `json:"errors"`
+	Warnings []FieldIssue `json:"warnings"`
+}
+
+// Valid returns true if there are no errors
+func (v *Validation) Valid() bool {
+	return len(v.Errors) == 0
+}
+
+// Err returns the errors combined, or nil
+func (v *Validation) Err() error {
+	if v.Valid() {
+		return nil
+	}
+	msgs := make([]string, len(v.Errors))
+	for i, fi := range v.Errors {
+		msgs[i] = fi.String()
+	}
+	return fmt.Errorf("invalid config: %s", strings.Join(msgs, "; "))
+}
+
+func (v *Validation) errorf(field, format string, a ...interface{}) {
+	v.Errors = append(v.Errors, FieldIssue{Field: field, Message: fmt.Sprintf(format, a...)})
+}
+
+func (v *Validation) warnf(field, format string, a ...interface{}) {
+	v.Warnings = append(v.Warnings, FieldIssue{Field: field, Message: fmt.Sprintf(format, a...)})
+}
+
+// Validate checks the config values
+// the fields are named by yaml keys, the env-only fields are named in lower camel case
+func (cfg *Config) Validate() Validation {
+	v := Validation{Errors: []FieldIssue{}, Warnings: []FieldIssue{}}
+	cfg.Connector.validate(&v, "connector")
+	if cfg.DSConnection != nil && cfg.DSConnection.HostName != "" {
+		validateHostName(&v, "dsConnection.hostName", cfg.DSConnection.HostName)
+	}
+	validateGWConnections(&v, "gwConnections", cfg.GWConnections)
+	validateTCGConnections(&v, "tcgConnections", cfg.TCGConnections)
+	if cfg.Jaegertracing != nil {
+		cfg.Jaegertracing.validate(&v, "jaegertracing")
+	}
+	return v
+}
+
+// Validate checks the ConnectorDTO values
+// the fields are named by json keys
+func (dto *ConnectorDTO) Validate() Validation {
+	v := Validation{Errors: []FieldIssue{}, Warnings: []FieldIssue{}}
+	validateLogLevel(&v, "logLevel", dto.LogLevel)
+	if dto.TcgURL != "" {
+		validateHostName(&v, "tcgUrl", dto.TcgURL)
+	}
+	if dto.DSConnection.HostName != "" {
+		validateHostName(&v, "dalekservicesConnection.hostName", dto.DSConnection.HostName)
+	}
+	validateGWConnections(&v, "groundworkConnections", dto.GWConnections)
+	validateTCGConnections(&v, "tcgConnections", dto.TCGConnections)
+	dto.validateRemoteSecrets(&v)
+	if dto.Enabled && len(dto.GWConnections) == 0 && len(dto.TCGConnections) == 0 {
+		v.warnf("enabled", "no connections defined")
+	}
+	return v
+}
+
+func (con *Connector) validate(v *Validation, prefix string) {
+	f := func(name string) string { return prefix + "." + name }
+
+	validateLogLevel(v, f("logLevel"), con.LogLevel)
+	if con.LogFileRotate < 0 {
+		v.errorf(f("logFileRotate"), "should not be negative")
+	}
+	if con.LogFile != "" && con.LogFileMaxSize <= 0 {
+		v.warnf(f("logFileMaxSize"), "log file is not rotated without positive size")
+	}
+	if con.LogCondense < 0 {
+		v.errorf(f("logCondense"), "should not be negative")
+	}
+
+	if con.BatchEvents < 0 {
+		v.errorf(f("batchEvents"), "should not be negative")
+	}
+	if con.BatchMetrics < 0 {
+		v.errorf(f("batchMetrics"), "should not be negative")
+	}
+	if (con.BatchEvents > 0 || con.BatchMetrics > 0) && con.BatchMaxBytes <= 0 {
+		v.errorf(f("batchMaxBytes"), "should be positive with batching enabled")
+	}
+	if con.BatchMaxBytes > int(con.NatsMaxPayload) && con.NatsMaxPayload > 0 {
+		v.warnf(f("batchMaxBytes"), "exceeds natsMaxPayload %d", con.NatsMaxPayload)
+	}
+	if con.BatchMaxItems < 0 {
+		v.errorf(f("batchMaxItems"), "should not be negative")
+	}
+	if con.BatchMaxBuffer < 0 {
+		v.errorf(f("batchMaxBuffer"), "should not be negative")
+	}
+	if con.BatchMaxBuffer > 0 && con.BatchMaxBuffer < con.BatchMaxBytes {
+		v.warnf(f("batchMaxBuffer"), "less than batchMaxBytes %d", con.BatchMaxBytes)
+	}
+	if con.BatchSuppressEvents < 0 {
+		v.errorf(f("batchSuppressEvents"), "should not be negative")
+	}
+	if con.BatchEventsHostRate < 0 {
+		v.errorf(f("batchEventsHostRate"), "should not be negative")
+	}
+	if (con.BatchSuppressEvents > 0 || con.BatchEventsHostRate > 0) && con.BatchEvents == 0 {
+		v.errorf(f("batchEvents"), "should be positive to suppress or limit events")
+	}
+
+	if con.AuditFileRotate < 0 {
+		v.errorf(f("auditFileRotate"), "should not be negative")
+	}
+	if con.ConfigWatchInterval < 0 {
+		v.errorf(f("configWatchInterval"), "should not be negative")
+	}
+	if con.ReadyFailureThreshold <= 0 {
+		v.errorf(f("readyFailureThreshold"), "should be positive")
+	}
+	if con.ShutdownTimeout < 0 {
+		v.errorf(f("shutdownTimeout"), "should not be negative")
+	}
+
+	if _, _, err := net.SplitHostPort(con.ControllerAddr); err != nil {
+		v.errorf(f("controllerAddr"), "should be like host:port: %v", err)
+	}
+	if (con.ControllerCertFile == "") != (con.ControllerKeyFile == "") {
+		v.errorf(f("controllerCertFile"), "should be defined with controllerKeyFile")
+	}
+	for _, it := range []struct {
+		name, fn string
+	}{
+		{"controllerCertFile", con.ControllerCertFile},
+		{"controllerKeyFile", con.ControllerKeyFile},
+		{"controllerClientCAFile", con.ControllerClientCAFile},
+	} {
+		if it.fn == "" {
+			continue
+		}
+		if _, err := os.Stat(it.fn); err != nil {
+			v.errorf(f(it.name), "could not access file: %v", err)
+		}
+	}
+	for _, it := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"controllerReadTimeout", con.ControllerReadTimeout},
+		{"controllerWriteTimeout", con.ControllerWriteTimeout},
+		{"controllerStartTimeout", con.ControllerStartTimeout},
+		{"controllerStopTimeout", con.ControllerStopTimeout},
+	} {
+		if it.d <= 0 {
+			v.errorf(f(it.name), "should be positive")
+		}
+	}
+	validateSecret(v, f("controllerPin"), con.ControllerPin)
+	validateRole(v, f("controllerBasicRole"), con.ControllerBasicRole)
+	tokens := make(map[string]bool, len(con.ControllerTokens))
+	for i, token := range con.ControllerTokens {
+		p := fmt.Sprintf("%s[%d]", f("controllerTokens"), i)
+		if token.Name == "" {
+			v.errorf(p+".name", "should not be empty")
+		}
+		if token.Token == "" {
+			v.errorf(p+".token", "should not be empty")
+		} else if tokens[token.Token] {
+			v.errorf(p+".token", "duplicates another token")
+		}
+		validateSecret(v, p+".token", token.Token)
+		tokens[token.Token] = true
+		validateRole(v, p+".role", token.Role)
+	}
+	for i, cert := range con.ControllerClientCerts {
+		p := fmt.Sprintf("%s[%d]", f("controllerClientCerts"), i)
+		if cert.CommonName == "" {
+			v.errorf(p+".commonName", `should not be empty, use "*" to match any`)
+		} else if _, err := path.Match(cert.CommonName, ""); err != nil {
+			v.errorf(p+".commonName", "invalid pattern: %v", err)
+		}
+		validateRole(v, p+".role", cert.Role)
+	}
+	if len(con.ControllerClientCerts) > 0 && con.ControllerClientCAFile == "" {
+		v.warnf(f("controllerClientCerts"), "ignored without controllerClientCAFile")
+	}
+
+	if con.NatsAckWait <= 0 {
+		v.errorf(f("natsAckWait"), "should be positive")
+	}
+	if con.NatsMaxInflight <= 0 {
+		v.errorf(f("natsMaxInflight"), "should be positive")
+	}
+	if con.NatsMaxPubAcksInflight <= 0 {
+		v.errorf(f("natsMaxPubAcksInflight"), "should be positive")
+	}
+	if con.NatsMaxPayload <= 0 {
+		v.errorf(f("natsMaxPayload"), "should be positive")
+	}
+	switch con.NatsBackend {
+	case "NATS", "LOCAL", "":
+	default:
+		v.errorf(f("natsBackend"), "unknown backend %q, expected NATS|LOCAL", con.NatsBackend)
+	}
+	switch con.NatsStoreType {
+	case "FILE":
+		if con.NatsStoreDir == "" {
+			v.errorf(f("natsFilestoreDir"), "should not be empty for FILE store")
+		}
+	case "MEMORY":
+	default:
+		v.errorf(f("natsStoreType"), "unknown store type %q, expected FILE|MEMORY", con.NatsStoreType)
+	}
+	if con.NatsStoreMaxAge == 0 {
+		v.warnf(f("natsStoreMaxAge"), "messages are kept without age limit")
+	}
+	validateRetryPolicy(v, f("natsRetry"), con.NatsRetry.RetryPolicy, false)
+	validateRetryPolicy(v, f("natsRetry.gateway"), con.NatsRetry.Gateway, true)
+	validateRetryPolicy(v, f("natsRetry.synchronizer"), con.NatsRetry.Synchronizer, true)
+
+	switch strings.ToLower(con.GWEncode) {
+	case "", "child", "force", "off":
+	default:
+		v.errorf(f("gwEncode"), "unknown value %q, expected child|force|off", con.GWEncode)
+	}
+}
+
+func (j *Jaegertracing) validate(v *Validation, prefix string) {
+	if j.Agent != "" {
+		if _, _, err := net.SplitHostPort(j.Agent); err != nil {
+			v.errorf(prefix+".agent", "should be like host:port: %v", err)
+		}
+	}
+	if j.Collector != "" {
+		if u, err := url.Parse(j.Collector); err != nil || u.Scheme == "" || u.Host == "" {
+			v.errorf(prefix+".collector", "should be absolute URL")
+		}
+		if j.Agent != "" {
+			v.warnf(prefix+".agent", "ignored with collector defined")
+		}
+	}
+}
+
+func validateLogLevel(v *Validation, field string, level LogLevel) {
+	if level < Error || level > Debug {
+		v.errorf(field, "should be in range %d..%d", Error, Debug)
+	}
+}
+
+func validateRole(v *Validation, field, role string) {
+	switch role {
+	case ControllerRoleMonitor, ControllerRoleControl:
+	default:
+		v.errorf(field, "unknown role %q, expected %s|%s", role, ControllerRoleMonitor, ControllerRoleControl)
+	}
+}
+
+func validateRetryPolicy(v *Validation, prefix string, p RetryPolicy, isOverride bool) {
+	switch {
+	case isOverride && p.InitialDelay < 0:
+		v.errorf(prefix+".initialDelay", "should not be negative")
+	case !isOverride && p.InitialDelay <= 0:
+		v.errorf(prefix+".initialDelay", "should be positive")
+	}
+	if p.MaxDelay < 0 {
+		v.errorf(prefix+".maxDelay", "should not be negative")
+	}
+	if p.Multiplier != 0 && p.Multiplier < 1 {
+		v.warnf(prefix+".multiplier", "values less than 1 are treated as 1")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		v.warnf(prefix+".jitter", "values out of range 0..1 are clamped")
+	}
+}
+
+// validateHostName checks the value accepted as "host:port" or URL
+// see the buildURI of clients
+func validateHostName(v *Validation, field, hostName string) {
+	if strings.IndexFunc(hostName, unicode.IsSpace) != -1 {
+		v.errorf(field, "should not contain spaces")
+		return
+	}
+	s := hostName
+	if !strings.HasPrefix(s, "http") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		v.errorf(field, "invalid host name: %v", err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		v.errorf(field, "unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		v.errorf(field, "host is empty")
+	}
+}
+
+// validateSecret checks the syntax of secret reference
+// the "enc:" one is checked for being readable with the key file if defined
+func validateSecret(v *Validation, field, value string) {
+	if err := secrets.Check(value); err != nil {
+		v.errorf(field, "%v", err)
+		return
+	}
+	if strings.HasPrefix(value, secrets.PrefixEnc) && os.Getenv(secrets.KeyFileEnv) == "" {
+		v.warnf(field, "encrypted secret requires %s", secrets.KeyFileEnv)
+	}
+}
+
+// ValidateRemote checks the ConnectorDTO received by API for the issues rejected on apply
+// the other issues are reported by Validate
+func (dto *ConnectorDTO) ValidateRemote() Validation {
+	v := Validation{Errors: []FieldIssue{}, Warnings: []FieldIssue{}}
+	dto.validateRemoteSecrets(&v)
+	return v
+}
+
+// validateRemoteSecrets denies the local secret references in the config api payload
+// so the caller cannot send the local files or environment to the host of choice
+func (dto *ConnectorDTO) validateRemoteSecrets(v *Validation) {
+	deny := func(field, value string) {
+		if secrets.IsLocalRef(value) {
+			v.errorf(field, "%s and %s references are accepted in the local config only",
+				secrets.PrefixEnv, secrets.PrefixFile)
+		}
+	}
+	for i, con := range dto.GWConnections {
+		if con != nil {
+			deny(fmt.Sprintf("groundworkConnections[%d].password", i), con.Password)
+		}
+	}
+	for i, con := range dto.TCGConnections {
+		if con != nil {
+			deny(fmt.Sprintf("tcgConnections[%d].password", i), con.Password)
+		}
+	}
+}
+
+func validateGWConnections(v *Validation, prefix string, cons GWConnections) {
+	ids := make(map[int]bool, len(cons))
+	for i, con := range cons {
+		p := fmt.Sprintf("%s[%d]", prefix, i)
+		if con == nil {
+			v.errorf(p, "should not be empty")
+			continue
+		}
+		if ids[con.ID] && con.ID != 0 {
+			v.errorf(p+".id", "duplicates another connection")
+		}
+		ids[con.ID] = true
+		if con.HostName == "" {
+			if con.Enabled {
+				v.errorf(p+".hostName", "should not be empty for enabled connection")
+			}
+		} else {
+			validateHostName(v, p+".hostName", con.HostName)
+		}
+		if con.Enabled && !con.LocalConnection && con.UserName == "" {
+			v.warnf(p+".userName", "empty for enabled connection")
+		}
+		validateSecret(v, p+".password", con.Password)
+		if con.PrefixResourceNames && con.ResourceNamePrefix == "" {
+			v.warnf(p+".resourceNamePrefix", "empty with prefixResourceNames set")
+		}
+	}
+}
+
+func validateTCGConnections(v *Validation, prefix string, cons TCGConnections) {
+	ids := make(map[int]bool, len(cons))
+	for i, con := range cons {
+		p := fmt.Sprintf("%s[%d]", prefix, i)
+		if con == nil {
+			v.errorf(p, "should not be empty")
+			continue
+		}
+		if ids[con.ID] && con.ID != 0 {
+			v.errorf(p+".id", "duplicates another connection")
+		}
+		ids[con.ID] = true
+		if con.HostName == "" {
+			if con.Enabled {
+				v.errorf(p+".hostName", "should not be empty for enabled connection")
+			}
+		} else {
+			validateHostName(v, p+".hostName", con.HostName)
+		}
+		validateSecret(v, p+".password", con.Password)
+		for j, rule := range con.RoutingRules {
+			rp := fmt.Sprintf("%s.routingRules[%d]", p, j)
+			for _, it := range []struct {
+				name, pattern string
+			}{
+				{"hostName", rule.HostName},
+				{"hostGroup", rule.HostGroup},
+				{"appType", rule.AppType},
+				{"serviceName", rule.ServiceName},
+			} {
+				if _, err := path.Match(it.pattern, ""); err != nil {
+					v.errorf(rp+"."+it.name, "invalid pattern: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// secretKeys lists the yaml keys masked in the effective config
+var secretKeys = map[string]bool{
+	"controllerPin": true,
+	"password":      true,
+	"token":         true,
+}
+
+// EffectiveYAML returns the config as yaml with secrets masked
+// the "env:" and "file:" references are not masked
+// the connector fields accepted from environment only are included too
+func (cfg *Config) EffectiveYAML() ([]byte, error) {
+	var doc yaml.Node
+	if err := doc.Encode(cfg); err != nil {
+		return nil, err
+	}
+	/* add env-only fields of connector */
+	if connector := mappingValue(&doc, "connector"); connector != nil {
+		val, typ := reflect.ValueOf(*cfg.Connector), reflect.TypeOf(*cfg.Connector)
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.Tag.Get("yaml") != "-" || runtimeFields[field.Name] {
+				continue
+			}
+			var node yaml.Node
+			if err := node.Encode(val.Field(i).Interface()); err != nil {
+				return nil, err
+			}
+			key := yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: lowerCamel(field.Name)}
+			connector.Content = append(connector.Content, &key, &node)
+		}
+	}
+	maskSecrets(&doc)
+	return yaml.Marshal(&doc)
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func maskSecrets(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if secretKeys[key.Value] && value.Kind == yaml.ScalarNode && value.Value != "" &&
+				!strings.HasPrefix(value.Value, secrets.PrefixEnv) &&
+				!strings.HasPrefix(value.Value, secrets.PrefixFile) {
+				value.Value, value.Tag, value.Style = "***", "!!str", 0
+			}
+		}
+	}
+	for _, n := range node.Content {
+		maskSecrets(n)
+	}
+}
+
+// lowerCamel converts the Go field name like "GWEncode" to "gwEncode"
+func lowerCamel(s string) string {
+	r := []rune(s)
+	for i := range r {
+		if !unicode.IsUpper(r[i]) {
+			break
+		}
+		if i > 0 && i+1 < len(r) && unicode.IsLower(r[i+1]) {
+			break
+		}
+		r[i] = unicode.ToLower(r[i])
+	}
+	return string(r)
+}
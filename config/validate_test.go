@@ -0,0 +1,101 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	cfg := defaults()
+	v := cfg.Validate()
+	assert.True(t, v.Valid(), v.Errors)
+	assert.NoError(t, v.Err())
+
+	cfg.Connector.BatchEvents = time.Second
+	cfg.Connector.BatchMaxBytes = 0
+	cfg.Connector.NatsAckWait = 0
+	cfg.Connector.NatsStoreType = "DISK"
+	cfg.Connector.ControllerTokens = ControllerTokens{{Name: "ci", Token: "secret", Role: "admin"}}
+	cfg.Connector.NatsRetry.Jitter = 2
+	cfg.Connector.NatsRetry.InitialDelay = 0
+	cfg.Connector.NatsRetry.MaxAttempts = -1
+	cfg.GWConnections = GWConnections{
+		{ID: 1, Enabled: true, HostName: "gw-host:8080", UserName: "user"},
+		{ID: 1, Enabled: true, HostName: "gw host"},
+	}
+	cfg.TCGConnections = TCGConnections{
+		{Enabled: true, HostName: "https://tcg-host/api/v1"},
+		{Enabled: true},
+	}
+	v = cfg.Validate()
+	assert.Equal(t, []FieldIssue{
+		{"connector.batchMaxBytes", "should be positive with batching enabled"},
+		{"connector.controllerTokens[0].role", `unknown role "admin", expected monitor|control`},
+		{"connector.natsAckWait", "should be positive"},
+		{"connector.natsStoreType", `unknown store type "DISK", expected FILE|MEMORY`},
+		{"connector.natsRetry.initialDelay", "should be positive"},
+		{"gwConnections[1].id", "duplicates another connection"},
+		{"gwConnections[1].hostName", "should not contain spaces"},
+		{"tcgConnections[1].hostName", "should not be empty for enabled connection"},
+	}, v.Errors)
+	assert.Equal(t, []FieldIssue{
+		{"connector.natsRetry.jitter", "values out of range 0..1 are clamped"},
+		{"gwConnections[1].userName", "empty for enabled connection"},
+	}, v.Warnings)
+	assert.EqualError(t, v.Err(), "invalid config: connector.batchMaxBytes: should be positive with batching enabled; "+
+		`connector.controllerTokens[0].role: unknown role "admin", expected monitor|control; `+
+		"connector.natsAckWait: should be positive; "+
+		`connector.natsStoreType: unknown store type "DISK", expected FILE|MEMORY; `+
+		"connector.natsRetry.initialDelay: should be positive; "+
+		"gwConnections[1].id: duplicates another connection; "+
+		"gwConnections[1].hostName: should not contain spaces; "+
+		"tcgConnections[1].hostName: should not be empty for enabled connection")
+
+	cfg = defaults()
+	cfg.Connector.BatchSuppressEvents = time.Minute
+	v = cfg.Validate()
+	assert.Equal(t, []FieldIssue{{"connector.batchEvents", "should be positive to suppress or limit events"}}, v.Errors)
+}
+
+func TestEffectiveYAML(t *testing.T) {
+	cfg := defaults()
+	cfg.Connector.ControllerPin = "1234"
+	cfg.Connector.ControllerTokens = ControllerTokens{{Name: "ci", Token: "secret", Role: ControllerRoleMonitor}}
+	cfg.GWConnections = GWConnections{{HostName: "gw-host", Password: "pass"}, {HostName: "gw-host", Password: "env:GW_PASSWORD"}}
+
+	output, err := cfg.EffectiveYAML()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(output), "1234")
+	assert.NotContains(t, string(output), "secret")
+	assert.NotContains(t, string(output), "pass\n")
+	assert.Contains(t, string(output), "controllerPin: '***'")
+	assert.Contains(t, string(output), "natsAckWait: 30s")
+	assert.Contains(t, string(output), "gwEncode: \"\"")
+	assert.Contains(t, string(output), "password: env:GW_PASSWORD")
+
+	cfg.GWConnections[1].Password = "env:"
+	v := cfg.Validate()
+	assert.Equal(t, []FieldIssue{{"gwConnections[1].password", "empty secret reference: env:"}}, v.Errors)
+}
+
+func TestConnectorDTO_remoteSecrets(t *testing.T) {
+	dto := ConnectorDTO{
+		GWConnections: GWConnections{
+			{ID: 1, HostName: "gw-host", Password: "file:/etc/shadow"},
+			{ID: 2, HostName: "gw-host", Password: "pass"},
+		},
+		TCGConnections: TCGConnections{{HostName: "https://tcg-host", Password: "env:TCG_SECKEY"}},
+	}
+	v := dto.Validate()
+	assert.Equal(t, []FieldIssue{
+		{"groundworkConnections[0].password", "env: and file: references are accepted in the local config only"},
+		{"tcgConnections[0].password", "env: and file: references are accepted in the local config only"},
+	}, v.Errors)
+
+	cfg := defaults()
+	_, err := cfg.loadConnector([]byte(`{"groundworkConnections":[{"hostName":"gw-host","password":"env:TCG_SECKEY"}]}`))
+	assert.EqualError(t, err, "invalid connector: groundworkConnections[0].password: "+
+		"env: and file: references are accepted in the local config only")
+}
@@ -1,18 +1,17 @@
 package connectors
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash/fnv"
 	"reflect"
 	regexp2 "regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gwos/tcg/clients"
 	"github.com/gwos/tcg/sdk/transit"
 	"github.com/gwos/tcg/services"
 	"github.com/gwos/tcg/tracing"
@@ -28,6 +27,10 @@ const DefaultCheckInterval = time.Minute * 2
 // CheckInterval comes from extensions field
 var CheckInterval = DefaultCheckInterval
 
+// ExtKeyStatusRollup defines field name of resource status rollup policy
+// the value is an object like {"mode": "reachability", "reachabilityService": "ping", "ignoreUnknown": true}
+const ExtKeyStatusRollup = "statusRollup"
+
 // statusTextPattern is a pattern to be found in status message template and replaced by the value extracted with appropriate method stored in statusTextValGetters
 // For example: status message template is "The value is {value}"
 //    pattern "{value}" will be extracted by statusTextPattern expression
@@ -47,11 +50,12 @@ const noneThresholdText = "-1"
 
 // UnmarshalConfig updates args with data
 func UnmarshalConfig(data []byte, metricsProfile *transit.MetricsProfile, monitorConnection *transit.MonitorConnection) error {
-	/* grab CheckInterval from MonitorConnection extensions */
+	/* grab CheckInterval and StatusRollup from MonitorConnection extensions */
 	var s struct {
 		MonitorConnection struct {
 			Extensions struct {
-				ExtensionsKeyTimer int `json:"checkIntervalMinutes"`
+				ExtensionsKeyTimer int                   `json:"checkIntervalMinutes"`
+				StatusRollup       *transit.RollupPolicy `json:"statusRollup"`
 			} `json:"extensions"`
 		} `json:"monitorConnection"`
 	}
@@ -61,6 +65,17 @@ func UnmarshalConfig(data []byte, metricsProfile *transit.MetricsProfile, monito
 		} else {
 			CheckInterval = DefaultCheckInterval
 		}
+		switch rollup := s.MonitorConnection.Extensions.StatusRollup; {
+		case rollup == nil:
+			transit.SetResourceRollupPolicy(nil)
+		case rollup.IsValid():
+			transit.SetResourceRollupPolicy(rollup)
+		default:
+			log.Warn().Interface(ExtKeyStatusRollup, rollup).
+				Msg("invalid status rollup policy, using default")
+			policy := transit.DefaultRollupPolicy
+			transit.SetResourceRollupPolicy(&policy)
+		}
 	}
 	/* process args */
 	cfg := struct {
@@ -571,22 +586,9 @@ func Name(defaultName string, customName string) string {
 }
 
 // Hashsum calculates FNV non-cryptographic hash suitable for checking the equality
+// the implementation is shared with TCG clients comparing delivered inventory
 func Hashsum(args ...interface{}) ([]byte, error) {
-	var b bytes.Buffer
-	for _, arg := range args {
-		s, err := json.Marshal(arg)
-		if err != nil {
-			return nil, err
-		}
-		if _, err := b.Write(s); err != nil {
-			return nil, err
-		}
-	}
-	h := fnv.New128()
-	if _, err := h.Write(b.Bytes()); err != nil {
-		return nil, err
-	}
-	return h.Sum(nil), nil
+	return clients.Hashsum(args...)
 }
 
 // MaxDuration returns maximum value
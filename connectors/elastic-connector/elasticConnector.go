@@ -15,6 +15,7 @@ import (
 	"github.com/gwos/tcg/connectors"
 	"github.com/gwos/tcg/connectors/elastic-connector/clients"
 	"github.com/gwos/tcg/sdk/transit"
+	"github.com/gwos/tcg/secrets"
 	"github.com/gwos/tcg/services"
 	"github.com/gwos/tcg/tracing"
 	"github.com/rs/zerolog/log"
@@ -94,13 +95,18 @@ const (
 )
 
 func initClients(cfg ExtConfig) (clients.KibanaClient, clients.EsClient, error) {
+	kibanaPassword, err := secrets.Resolve(cfg.Kibana.Password)
+	if err != nil {
+		log.Err(err).Msg("could not resolve Kibana password")
+		return clients.KibanaClient{}, clients.EsClient{}, errors.New("cannot resolve Kibana password")
+	}
 	kibanaClient := clients.KibanaClient{
 		ApiRoot:  cfg.Kibana.ServerName,
 		Username: cfg.Kibana.Username,
-		Password: cfg.Kibana.Password,
+		Password: kibanaPassword,
 	}
 	esClient := clients.EsClient{Servers: cfg.Servers}
-	err := esClient.InitEsClient()
+	err = esClient.InitEsClient()
 	if err != nil {
 		log.Err(err).Msg("could not initialize ES client")
 		return kibanaClient, esClient, errors.New("cannot initialize ES client")
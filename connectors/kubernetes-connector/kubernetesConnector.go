@@ -11,6 +11,7 @@ import (
 
 	"github.com/gwos/tcg/connectors"
 	"github.com/gwos/tcg/sdk/transit"
+	"github.com/gwos/tcg/secrets"
 	"github.com/rs/zerolog/log"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -135,11 +136,19 @@ func (connector *KubernetesConnector) Initialize(config ExtConfig) error {
 	case InCluster:
 		log.Info().Msg("using InCluster auth")
 	case Credentials:
+		password, err := secrets.Resolve(extConfig.KubernetesUserPassword)
+		if err != nil {
+			return err
+		}
 		kConfig.Username = extConfig.KubernetesUserName
-		kConfig.Password = extConfig.KubernetesUserPassword
+		kConfig.Password = password
 		log.Info().Msg("using Credentials auth")
 	case BearerToken:
-		kConfig.BearerToken = extConfig.KubernetesBearerToken
+		token, err := secrets.Resolve(extConfig.KubernetesBearerToken)
+		if err != nil {
+			return err
+		}
+		kConfig.BearerToken = token
 		log.Info().Msg("using Bearer Token auth")
 	case ConfigFile:
 		data, err := os.ReadFile(config.KubernetesConfigFile)
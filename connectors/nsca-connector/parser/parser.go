@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/gwos/tcg/connectors"
 	"github.com/gwos/tcg/sdk/transit"
@@ -19,7 +20,7 @@ var (
 	nscaRegexp = regexp.MustCompile(
 		`^((?P<ts>.*?);)?(?P<resName>.*?);(?P<svcName>.*?);(?P<status>.*?);(?P<msg>.*?)\s*\|\s*(?P<perf>.*?)$`)
 	perfDataRegexp = regexp.MustCompile(
-		`^(?P<label>.*?)=(?P<val>.*?)(?P<unitType>\D*?);(?P<warn>.*?)(\D*?);(?P<crit>.*?)(\D*?);` +
+		`^(?P<label>.*?)=(?P<val>.*?)(?P<unitType>\D*?);(?P<warn>[^;]*);(?P<crit>[^;]*);` +
 			`((?P<min>.*?)(\D*?);)?((?P<max>.*?)(\D*?);)?$`)
 
 	ErrInvalidMetricFormat = errors.New("invalid metric format")
@@ -129,6 +130,26 @@ func getStatus(str string) (transit.MonitorStatus, error) {
 	}
 }
 
+// parseThreshold returns the threshold of perf data ignoring units
+// the plain number is kept as float64 for the legacy comparison,
+// the Nagios range like "10:20" or "@~:5" is kept as string, see transit.ThresholdRange
+// returns nil for empty threshold
+func parseThreshold(str string) (interface{}, error) {
+	str = strings.TrimRightFunc(str, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.' && r != ':'
+	})
+	if str == "" {
+		return nil, nil
+	}
+	if v, err := strconv.ParseFloat(str, 64); err == nil {
+		return v, nil
+	}
+	if _, err := transit.ParseThresholdRange(str); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetricFormat, err)
+	}
+	return str, nil
+}
+
 func getNscaMetrics(metricsLines []string) (MetricsMap, error) {
 	metricsMap := make(MetricsMap)
 	re := nscaRegexp
@@ -148,9 +169,10 @@ func getNscaMetrics(metricsLines []string) (MetricsMap, error) {
 		perfData := match[re.SubexpIndex("perf")]
 		for _, metric := range strings.Split(strings.TrimSpace(perfData), " ") {
 			var (
-				match                    []string
-				label, val, warn, crit   string
-				value, warning, critical float64
+				match                  []string
+				label, val, warn, crit string
+				value                  float64
+				warning, critical      interface{}
 			)
 			match = perfDataRegexp.FindStringSubmatch(metric)
 			if match == nil {
@@ -168,19 +190,15 @@ func getNscaMetrics(metricsLines []string) (MetricsMap, error) {
 					return nil, err
 				}
 			}
-			if len(warn) > 0 {
-				if w, err := strconv.ParseFloat(warn, 64); err == nil {
-					warning = w
-				} else {
-					return nil, err
-				}
+			if w, err := parseThreshold(warn); err == nil {
+				warning = w
+			} else {
+				return nil, err
 			}
-			if len(crit) > 0 {
-				if c, err := strconv.ParseFloat(crit, 64); err == nil {
-					critical = c
-				} else {
-					return nil, err
-				}
+			if c, err := parseThreshold(crit); err == nil {
+				critical = c
+			} else {
+				return nil, err
 			}
 
 			timeSeries, err := connectors.BuildMetric(connectors.MetricBuilder{
@@ -258,9 +276,10 @@ func getBronxMetrics(metricsLines []string) (MetricsMap, error) {
 		perfData := match[re.SubexpIndex("perf")]
 		for _, metric := range strings.Split(strings.TrimSpace(perfData), " ") {
 			var (
-				match                    []string
-				label, val, warn, crit   string
-				value, warning, critical float64
+				match                  []string
+				label, val, warn, crit string
+				value                  float64
+				warning, critical      interface{}
 			)
 			match = perfDataRegexp.FindStringSubmatch(metric)
 			if match == nil {
@@ -278,19 +297,15 @@ func getBronxMetrics(metricsLines []string) (MetricsMap, error) {
 					return nil, err
 				}
 			}
-			if len(warn) > 0 {
-				if w, err := strconv.ParseFloat(warn, 64); err == nil {
-					warning = w
-				} else {
-					return nil, err
-				}
+			if w, err := parseThreshold(warn); err == nil {
+				warning = w
+			} else {
+				return nil, err
 			}
-			if len(crit) > 0 {
-				if c, err := strconv.ParseFloat(crit, 64); err == nil {
-					critical = c
-				} else {
-					return nil, err
-				}
+			if c, err := parseThreshold(crit); err == nil {
+				critical = c
+			} else {
+				return nil, err
 			}
 
 			timeSeries, err := connectors.BuildMetric(connectors.MetricBuilder{
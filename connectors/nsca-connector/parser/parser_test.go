@@ -3,6 +3,7 @@ package parser
 import (
 	"testing"
 
+	"github.com/gwos/tcg/sdk/transit"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -109,3 +110,33 @@ S;1628546296;awips-demo-2;example-service-5;0;OK - example-service-5 (2021-08-09
 		}
 	}
 }
+
+func TestParserRanges(t *testing.T) {
+	data := []byte(
+		`S;1628546296;host-1;svc-1;1;WARNING | temp=22C;10:20;@~:5;0; load=0.5;~:1;2:;0; disk=85%;80%;90%;0;`,
+	)
+
+	monitoredResources, err := Parse(data, Bronx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(*monitoredResources), "invalid count of monitored resources")
+
+	metrics := (*monitoredResources)[0].Services[0].Metrics
+	assert.Equal(t, 3, len(metrics), "invalid count of metrics for service")
+	thresholds := func(i int) []string {
+		var res []string
+		for _, th := range metrics[i].Thresholds {
+			res = append(res, th.Value.String())
+		}
+		return res
+	}
+	assert.Equal(t, []string{"10:20", "@~:5"}, thresholds(0))
+	assert.Equal(t, []string{"~:1", "2:"}, thresholds(1))
+	assert.Equal(t, []string{"80.000000", "90.000000"}, thresholds(2))
+
+	status, err := transit.CalculateServiceStatus(&metrics)
+	assert.NoError(t, err)
+	assert.Equal(t, transit.ServiceUnscheduledCritical, status)
+
+	_, err = Parse([]byte(`S;1628546296;host-1;svc-1;0;OK | temp=22;20:10;;0;`), Bronx)
+	assert.ErrorIs(t, err, ErrInvalidMetricFormat)
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/PaesslerAG/jsonpath"
 	"github.com/gwos/tcg/connectors"
 	"github.com/gwos/tcg/sdk/transit"
+	"github.com/gwos/tcg/secrets"
 	"github.com/rs/zerolog/log"
 )
 
@@ -38,6 +39,9 @@ func login(tenantID, clientID, clientSecret, resource string) (str string, err e
 		response     *http.Response
 	)
 
+	if clientSecret, err = secrets.Resolve(clientSecret); err != nil {
+		return
+	}
 	endPoint := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/token", tenantID)
 
 	auth := AuthRecord{
@@ -0,0 +1,225 @@
+package nats
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// the dead-letter stream keeps a message per dead letter
+// the purge and replay delete messages from the stream
+const subjDeadLetter = "dead-letter"
+
+var ErrDeadLetter = fmt.Errorf("%w: dead letter", ErrNATS)
+
+// storeLimits returns the config with store limits of subject
+// the dead letters are kept until purged or replayed, so the payload limits are not applied
+func storeLimits(subject string, config Config) Config {
+	if subject == subjDeadLetter {
+		config.StoreMaxAge, config.StoreMaxBytes, config.StoreMaxMsgs = 0, 0, 0
+	}
+	return config
+}
+
+// DeadLetter describes the message undelivered by durable
+type DeadLetter struct {
+	ID          string    `json:"id"`
+	DurableName string    `json:"durableName"`
+	Subject     string    `json:"subject"`
+	Sequence    uint64    `json:"sequence"`
+	Timestamp   time.Time `json:"timestamp"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError"`
+	Payload     []byte    `json:"payload,omitempty"`
+
+	// seq is the sequence in the dead-letter stream
+	seq uint64
+}
+
+// DeadLetterFilter selects dead letters, empty fields match any
+// DurableName supports glob pattern
+type DeadLetterFilter struct {
+	IDs         []string `json:"ids,omitempty"`
+	DurableName string   `json:"durableName,omitempty"`
+}
+
+// DeadLetterResult describes the replay or purge results
+type DeadLetterResult struct {
+	Processed int      `json:"processed"`
+	Failed    int      `json:"failed"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+func (f DeadLetterFilter) match(dl DeadLetter) bool {
+	if f.DurableName != "" {
+		if ok, _ := path.Match(f.DurableName, dl.DurableName); !ok {
+			return false
+		}
+	}
+	if len(f.IDs) == 0 {
+		return true
+	}
+	for _, id := range f.IDs {
+		if id == dl.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// ListDeadLetters returns dead letters in order of arrival
+func ListDeadLetters(filter DeadLetterFilter) ([]DeadLetter, error) {
+	letters, err := readDeadLetters()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]DeadLetter, 0, len(letters))
+	for _, dl := range letters {
+		if filter.match(dl) {
+			result = append(result, dl)
+		}
+	}
+	return result, nil
+}
+
+// GetDeadLetter returns dead letter by id
+func GetDeadLetter(id string) (*DeadLetter, error) {
+	letters, err := ListDeadLetters(DeadLetterFilter{IDs: []string{id}})
+	if err != nil {
+		return nil, err
+	}
+	if len(letters) == 0 {
+		return nil, fmt.Errorf("%w: not found: %s", ErrDeadLetter, id)
+	}
+	return &letters[0], nil
+}
+
+// PurgeDeadLetters removes dead letters
+func PurgeDeadLetters(filter DeadLetterFilter) (DeadLetterResult, error) {
+	result := DeadLetterResult{}
+	letters, err := ListDeadLetters(filter)
+	if err != nil || len(letters) == 0 {
+		return result, err
+	}
+	if err := removeDeadLetters(letters); err != nil {
+		return result, err
+	}
+	result.Processed = len(letters)
+	return result, nil
+}
+
+// ReplayDeadLetters redelivers dead letters with handlers of durables
+// the worker of durable is paused while its letters are handled,
+// so the replay doesn't interleave with the messages of durable
+// the replayed letters are removed, the failed ones are kept
+// the running dispatcher is required
+func ReplayDeadLetters(filter DeadLetterFilter) (DeadLetterResult, error) {
+	result := DeadLetterResult{}
+	letters, err := ListDeadLetters(filter)
+	if err != nil || len(letters) == 0 {
+		return result, err
+	}
+
+	d := getDispatcher()
+	d.Lock()
+	if !d.isRunning() {
+		d.Unlock()
+		return result, fmt.Errorf("%w: is not running", ErrDispatcher)
+	}
+	options := make(map[string]DispatcherOption, len(d.options))
+	handling := make(map[string]*sync.Mutex, len(d.options))
+	for k, v := range d.options {
+		options[k] = v
+		handling[k] = d.handlingMu(k)
+	}
+	d.Unlock()
+
+	replayed := make([]DeadLetter, 0, len(letters))
+	for _, dl := range letters {
+		opt, ok := options[dl.DurableName]
+		if !ok {
+			err = fmt.Errorf("%w: unknown durable: %s", ErrDeadLetter, dl.DurableName)
+		} else {
+			mu := handling[dl.DurableName]
+			mu.Lock()
+			err = opt.Handler(dl.Payload)
+			mu.Unlock()
+		}
+		if err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", dl.ID, err.Error()))
+			continue
+		}
+		replayed = append(replayed, dl)
+	}
+	if err := removeDeadLetters(replayed); err != nil {
+		return result, err
+	}
+	result.Processed = len(replayed)
+	return result, nil
+}
+
+// putDeadLetter stores the message undelivered by durable
+func putDeadLetter(payload []byte, opt DispatcherOption, sequence uint64, attempts int, lastErr error) error {
+	dl := DeadLetter{
+		ID:          fmt.Sprintf("%s#%d", opt.DurableName, sequence),
+		DurableName: opt.DurableName,
+		Subject:     opt.Subject,
+		Sequence:    sequence,
+		Timestamp:   time.Now(),
+		Attempts:    attempts,
+		LastError:   lastErr.Error(),
+		Payload:     payload,
+	}
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return Publish(subjDeadLetter, b)
+}
+
+func removeDeadLetters(letters []DeadLetter) error {
+	q, err := getQueue()
+	if err != nil {
+		return err
+	}
+	for _, dl := range letters {
+		if err := q.DeleteMsg(subjDeadLetter, dl.seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDeadLetters() ([]DeadLetter, error) {
+	q, err := getQueue()
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, 0)
+	for seq := uint64(0); ; {
+		msgs, err := q.Msgs(subjDeadLetter, seq, readBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			dl := DeadLetter{}
+			if err := json.Unmarshal(msg.Data, &dl); err != nil {
+				log.Warn().Err(err).Uint64("nats.sequence", msg.Sequence).
+					Msg("could not unmarshal dead letter")
+				continue
+			}
+			dl.seq = msg.Sequence
+			letters = append(letters, dl)
+		}
+		if len(msgs) < readBatchSize {
+			return letters, nil
+		}
+		seq = msgs[len(msgs)-1].Sequence + 1
+	}
+}
@@ -0,0 +1,90 @@
+package nats
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	tcgerr "github.com/gwos/tcg/sdk/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetters(t *testing.T) {
+	assert.NoError(t, StartServer(Config{
+		AckWait:            time.Second * 30,
+		MaxInflight:        100,
+		MaxPubAcksInflight: 100,
+		MaxPayload:         1024 * 1024,
+		StoreType:          "MEMORY",
+	}))
+	defer StopServer()
+
+	var delivered [][]byte
+	handlerErr := fmt.Errorf("%w: bad data", tcgerr.ErrUndecided)
+	assert.NoError(t, StartDispatcher([]DispatcherOption{{
+		DurableName: "#test#",
+		Subject:     "test",
+		Handler: func(b []byte) error {
+			if handlerErr != nil {
+				return handlerErr
+			}
+			delivered = append(delivered, b)
+			return nil
+		},
+	}}))
+	defer func() { _ = StopDispatcher() }()
+
+	assert.NoError(t, Publish("test", []byte(`"msg-1"`)))
+	assert.NoError(t, Publish("test", []byte(`"msg-2"`)))
+
+	var letters []DeadLetter
+	assert.Eventually(t, func() bool {
+		letters, _ = ListDeadLetters(DeadLetterFilter{})
+		return len(letters) == 2
+	}, time.Second*5, time.Millisecond*100)
+	assert.Equal(t, "#test#", letters[0].DurableName)
+	assert.Equal(t, []byte(`"msg-1"`), letters[0].Payload)
+	assert.Equal(t, 1, letters[0].Attempts)
+	assert.Contains(t, letters[0].LastError, "bad data")
+
+	dl, err := GetDeadLetter(letters[1].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`"msg-2"`), dl.Payload)
+
+	handlerErr = nil
+	res, err := ReplayDeadLetters(DeadLetterFilter{IDs: []string{letters[0].ID}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Processed)
+	assert.Equal(t, [][]byte{[]byte(`"msg-1"`)}, delivered)
+
+	res, err = PurgeDeadLetters(DeadLetterFilter{DurableName: "#test*"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Processed)
+
+	letters, err = ListDeadLetters(DeadLetterFilter{})
+	assert.NoError(t, err)
+	assert.Empty(t, letters)
+}
+
+func TestDeadLetters_storeLimits(t *testing.T) {
+	assert.NoError(t, StartServer(Config{
+		AckWait:            time.Second * 30,
+		MaxInflight:        100,
+		MaxPubAcksInflight: 100,
+		MaxPayload:         1024 * 1024,
+		StoreType:          "MEMORY",
+		StoreMaxAge:        time.Millisecond * 100,
+		StoreMaxMsgs:       1,
+	}))
+	defer StopServer()
+
+	opt := DispatcherOption{DurableName: "#test#", Subject: "test"}
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, putDeadLetter([]byte(`"msg"`), opt, uint64(i), 1, tcgerr.ErrUndecided))
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	letters, err := ListDeadLetters(DeadLetterFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, letters, 3)
+}
@@ -1,14 +1,13 @@
 package nats
 
 import (
+	"context"
 	"errors"
-	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	tcgerr "github.com/gwos/tcg/sdk/errors"
-	"github.com/gwos/tcg/taskQueue"
-	"github.com/nats-io/stan.go"
 	"github.com/patrickmn/go-cache"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -17,32 +16,40 @@ import (
 var (
 	dispatcher     *natsDispatcher
 	onceDispatcher sync.Once
-
-	retryDelays = map[int]time.Duration{
-		1: time.Second * 30,
-		2: time.Minute * 1,
-		3: time.Minute * 5,
-		4: time.Minute * 20,
-	}
 )
 
-const taskRetry = "taskRetry"
+// fetchBatch limits the number of messages processed by durable at once
+// each message takes the request to upstream and should be acked within AckWait
+// fetchWait limits the waiting for messages to check the stop signal
+const (
+	fetchBatch = 10
+	fetchWait  = time.Second * 5
+)
 
 type dispatcherRetry struct {
 	LastError error
 	Retry     int
+	RetryAt   time.Time
+	State     string
 }
 
-// natsDispatcher provides deliverer for nats messages
-// with retry logic based on subscribe/close durable subscriptions
+// natsDispatcher provides deliverer for queued messages
+// with retry logic based on pull subscriptions of durables
+// each durable is processed by separate worker to keep the order of messages
 type natsDispatcher struct {
 	*state
 
-	durables *cache.Cache
-	msgsDone *cache.Cache
-	retryes  *cache.Cache
+	retryes *cache.Cache
+	options map[string]DispatcherOption
+	/* handling serializes the handler calls of durable worker and dead letters replay */
+	handling map[string]*sync.Mutex
+
+	/* counters are cumulative across restarts of dispatcher */
+	countersMu sync.Mutex
+	counters   map[string]*DispatcherCounters
 
-	taskQueue *taskQueue.TaskQueue
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 func getDispatcher() *natsDispatcher {
@@ -50,147 +57,256 @@ func getDispatcher() *natsDispatcher {
 		dispatcher = &natsDispatcher{
 			state: s,
 
-			durables: cache.New(-1, -1),
-			msgsDone: cache.New(time.Minute*10, time.Minute*10),
-			retryes:  cache.New(time.Minute*30, time.Minute*30),
+			retryes:  cache.New(-1, -1),
+			options:  make(map[string]DispatcherOption),
+			handling: make(map[string]*sync.Mutex),
+			counters: make(map[string]*DispatcherCounters),
 		}
-		dispatcher.taskQueue = taskQueue.NewTaskQueue(
-			taskQueue.WithHandlers(map[taskQueue.Subject]taskQueue.Handler{
-				taskRetry: dispatcher.taskRetryHandler,
-			}),
-		)
 	})
 	return dispatcher
 }
 
-// handleError handles the error in the processor of durable subscription
+// handleError handles the error in the processor of durable
 // in case of some transient error (like networking issue)
-// it closes current subscription (doesn't unsubscribe) and plans retry
-func (d *natsDispatcher) handleError(subscription stan.Subscription, msg *stan.Msg, err error, opt DispatcherOption) {
-	log.Info().Err(err).Str("durableName", opt.DurableName)
+// it opens the circuit breaker and plans retry
+// otherwise it moves the message to the dead-letter stream
+// returns true if retry planned
+func (d *natsDispatcher) handleError(subscription Subscription, msg *Msg, err error, opt DispatcherOption) bool {
 	logEvent := log.Info().Err(err).Str("durableName", opt.DurableName).
 		Func(func(e *zerolog.Event) {
 			if zerolog.GlobalLevel() <= zerolog.DebugLevel {
-				e.RawJSON("stan.data", msg.Data).
-					Uint64("stan.sequence", msg.Sequence).
-					Int64("stan.timestamp", msg.Timestamp)
+				e.RawJSON("nats.data", msg.Data).
+					Uint64("nats.sequence", msg.Sequence).
+					Time("nats.timestamp", msg.Timestamp)
 			}
 		})
 
-	if errors.Is(err, tcgerr.ErrTransient) {
-		retry := dispatcherRetry{
-			LastError: nil,
-			Retry:     0,
-		}
-		if r, isRetry := d.retryes.Get(opt.DurableName); isRetry {
-			retry = r.(dispatcherRetry)
-		}
-		retry.LastError = err
-		retry.Retry++
+	retry := dispatcherRetry{
+		LastError: nil,
+		Retry:     0,
+	}
+	if r, isRetry := d.retryes.Get(opt.DurableName); isRetry {
+		retry = r.(dispatcherRetry)
+	}
+	retry.LastError = err
+	retry.Retry++
 
-		if retry.Retry < len(retryDelays) {
+	if errors.Is(err, tcgerr.ErrTransient) {
+		d.Lock()
+		policy := d.config.Retry.PolicyFor(err)
+		d.Unlock()
+		if policy.CanRetry(retry.Retry) {
+			delay := policy.Delay(retry.Retry)
+			retry.RetryAt = time.Now().Add(delay)
+			retry.State = BreakerOpen
 			logEvent.Int("retry", retry.Retry).
+				Dur("delay", delay).
 				Msg("dispatcher could not deliver: will retry")
-			d.retryes.Set(opt.DurableName, retry, 0)
-			delay := retryDelays[retry.Retry]
+			d.retryes.Set(opt.DurableName, retry, cache.NoExpiration)
+			d.count(opt.DurableName, func(c *DispatcherCounters) { c.Retries++ })
+			return true
+		}
+		logEvent.Msg("dispatcher could not deliver: stop retrying")
+	} else {
+		logEvent.Msg("dispatcher could not deliver: will not retry")
+	}
+	d.retryes.Delete(opt.DurableName)
+	d.moveToDeadLetter(subscription, msg, opt, retry)
+	return false
+}
 
-			go func() {
-				d.Lock()
-				_ = subscription.Close()
-				d.durables.Delete(opt.DurableName)
-				d.Unlock()
+// moveToDeadLetter stores the message in the dead-letter stream and acknowledges it
+// the message stays unacknowledged for redelivery if it cannot be stored
+func (d *natsDispatcher) moveToDeadLetter(subscription Subscription, msg *Msg, opt DispatcherOption, retry dispatcherRetry) {
+	if err := putDeadLetter(msg.Data, opt, msg.Sequence, retry.Retry, retry.LastError); err != nil {
+		log.Warn().Err(err).Str("durableName", opt.DurableName).
+			Uint64("nats.sequence", msg.Sequence).
+			Msg("dispatcher could not store dead letter")
+		_ = subscription.Nak(msg)
+		return
+	}
+	_ = subscription.Ack(msg)
+	d.count(opt.DurableName, func(c *DispatcherCounters) { c.DeadLetters++ })
+	log.Info().Str("durableName", opt.DurableName).
+		Uint64("nats.sequence", msg.Sequence).
+		Int("attempts", retry.Retry).
+		Msg("dispatcher moved message to dead letters")
+}
 
-				time.AfterFunc(delay, func() { _ = d.retryDurable(opt) })
-			}()
-		} else {
-			d.retryes.Delete(opt.DurableName)
-			logEvent.Msg("dispatcher could not deliver: stop retrying")
+// count updates the counters of durable
+func (d *natsDispatcher) count(durableName string, fn func(*DispatcherCounters)) {
+	d.countersMu.Lock()
+	defer d.countersMu.Unlock()
+	c, ok := d.counters[durableName]
+	if !ok {
+		c = &DispatcherCounters{DurableName: durableName}
+		d.counters[durableName] = c
+	}
+	fn(c)
+}
+
+// subscribe binds to durables
+// the caller should hold the lock
+func (d *natsDispatcher) subscribe() (map[string]Subscription, error) {
+	subscriptions := make(map[string]Subscription, len(d.options))
+	for _, opt := range d.options {
+		log.Debug().Msgf("Processing Durable: %s", opt.DurableName)
+		subscription, err := d.queue.Subscribe(opt.Subject, opt.DurableName)
+		if err != nil {
+			for _, subscription := range subscriptions {
+				_ = subscription.Close()
+			}
+			log.Warn().Err(err).
+				Str("durableName", opt.DurableName).
+				Msg("nats dispatcher failed")
+			return nil, err
 		}
+		subscriptions[opt.DurableName] = subscription
+	}
+	return subscriptions, nil
+}
 
-	} else {
-		logEvent.Msg("dispatcher could not deliver: will not retry")
+// run starts workers of durables
+// the caller should hold the lock
+func (d *natsDispatcher) run(subscriptions map[string]Subscription) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	for durableName, subscription := range subscriptions {
+		d.wg.Add(1)
+		go func(opt DispatcherOption, subscription Subscription, mu *sync.Mutex) {
+			defer d.wg.Done()
+			defer func() { _ = subscription.Close() }()
+			d.processDurable(ctx, opt, subscription, mu)
+		}(d.options[durableName], subscription, d.handlingMu(durableName))
 	}
 }
 
-func (d *natsDispatcher) openDurable(opt DispatcherOption) error {
-	var (
-		errSubs      error
-		subscription stan.Subscription
-	)
-
-	if subscription, errSubs = d.connDispatcher.Subscribe(
-		opt.Subject,
-		func(msg *stan.Msg) {
-			// Note: https://github.com/nats-io/nats-streaming-server/issues/1126#issuecomment-726903074
-			// ..when the subscription starts and has a lot of backlog messages,
-			// is that the server is going to send all pending messages for this consumer "at once",
-			// that is, without releasing the consumer lock.
-			// The application may get them and ack, but the ack won't be processed
-			// because the server is still sending messages to this consumer.
-			// ..if it takes longer to send all pending messages [then AckWait], the message will also get redelivered.
-			// ..If the server redelivers the message is that it thinks that the message has not been acknowledged,
-			// and it may in that case resend again, so you should Ack the message there.
-			ckDone := fmt.Sprintf("%s#%d", opt.DurableName, msg.Sequence)
-			if _, isDone := d.msgsDone.Get(ckDone); isDone {
-				_ = msg.Ack()
+// handlingMu returns the mutex held while the messages of durable are handled
+// the caller should hold the lock
+func (d *natsDispatcher) handlingMu(durableName string) *sync.Mutex {
+	mu, ok := d.handling[durableName]
+	if !ok {
+		mu = new(sync.Mutex)
+		d.handling[durableName] = mu
+	}
+	return mu
+}
+
+// stop signals workers and waits them
+func (d *natsDispatcher) stop() {
+	d.Lock()
+	cancel := d.cancel
+	d.cancel = nil
+	d.Unlock()
+
+	if cancel != nil {
+		cancel()
+		d.wg.Wait()
+	}
+}
+
+// isRunning checks the workers started
+// the caller should hold the lock
+func (d *natsDispatcher) isRunning() bool {
+	return d.cancel != nil
+}
+
+// processDurable fetches and delivers messages until the context is done
+// once the handler fails with retry planned the rest of fetched messages are not acknowledged
+// to be redelivered in order after the delay
+// the fetched messages are handled under mu to not interleave with the dead letters replay
+func (d *natsDispatcher) processDurable(ctx context.Context, opt DispatcherOption, subscription Subscription, mu *sync.Mutex) {
+	for {
+		if !d.waitRetry(ctx, opt) {
+			return
+		}
+
+		fetchCtx, cancel := context.WithTimeout(ctx, fetchWait)
+		msgs, err := subscription.Fetch(fetchCtx, fetchBatch)
+		cancel()
+		if ctx.Err() != nil {
+			for _, msg := range msgs {
+				_ = subscription.Nak(msg)
+			}
+			return
+		}
+		if err != nil {
+			log.Info().Err(err).
+				Str("durableName", opt.DurableName).
+				Msg("dispatcher failed to fetch")
+			select {
+			case <-ctx.Done():
 				return
+			case <-time.After(fetchWait):
 			}
+			continue
+		}
 
+		mu.Lock()
+		for i, msg := range msgs {
 			if err := opt.Handler(msg.Data); err != nil {
-				d.handleError(subscription, msg, err, opt)
-				return
+				if d.handleError(subscription, msg, err, opt) {
+					for _, msg := range msgs[i:] {
+						_ = subscription.Nak(msg)
+					}
+					break
+				}
+				continue
 			}
-			_ = msg.Ack()
-			_ = d.msgsDone.Add(ckDone, 0, 10*time.Minute)
+			_ = subscription.Ack(msg)
+			d.retryes.Delete(opt.DurableName)
 			log.Debug().Str("durableName", opt.DurableName).
 				Func(func(e *zerolog.Event) {
 					if zerolog.GlobalLevel() <= zerolog.DebugLevel {
-						e.RawJSON("stan.data", msg.Data).
-							Uint64("stan.sequence", msg.Sequence).
-							Int64("stan.timestamp", msg.Timestamp)
+						e.RawJSON("nats.data", msg.Data).
+							Uint64("nats.sequence", msg.Sequence).
+							Time("nats.timestamp", msg.Timestamp)
 					}
 				}).
 				Msg("dispatcher delivered")
-		},
-		stan.SetManualAckMode(),
-		stan.AckWait(d.config.AckWait),
-		stan.MaxInflight(d.config.MaxInflight),
-		stan.DurableName(opt.DurableName),
-		stan.StartWithLastReceived(),
-	); errSubs != nil {
-		return errSubs
+		}
+		mu.Unlock()
 	}
-
-	// Workaround v8.1.3 to fix processing large natsstore from prior versions
-	// Modern envs should use the correct value of MaxInflight setting
-	return subscription.SetPendingLimits(d.config.MaxPendingMsgs, d.config.MaxPendingBytes)
 }
 
-func (d *natsDispatcher) retryDurable(opt DispatcherOption) error {
-	_, err := d.taskQueue.PushAsync(taskRetry, opt)
-	return err
+// waitRetry waits the delay while the circuit breaker of durable is open
+// then switches it to half-open, returns false if the context is done
+func (d *natsDispatcher) waitRetry(ctx context.Context, opt DispatcherOption) bool {
+	r, isRetry := d.retryes.Get(opt.DurableName)
+	if !isRetry {
+		return ctx.Err() == nil
+	}
+	retry := r.(dispatcherRetry)
+	if retry.State != BreakerOpen {
+		return ctx.Err() == nil
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(time.Until(retry.RetryAt)):
+	}
+	retry.State = BreakerHalfOpen
+	d.retryes.Set(opt.DurableName, retry, cache.NoExpiration)
+	return true
 }
 
-func (d *natsDispatcher) taskRetryHandler(task *taskQueue.Task) error {
-	opt := task.Args[0].(DispatcherOption)
-
-	d.Lock()
-	defer d.Unlock()
-
-	var err error
-	if d.connDispatcher != nil {
-		if _, isOpen := d.durables.Get(opt.DurableName); !isOpen {
-			if err = d.openDurable(opt); err == nil {
-				d.durables.Set(opt.DurableName, 0, -1)
+// breakerStates returns the circuit breaker states of durables
+// the caller should hold the lock
+func (d *natsDispatcher) breakerStates() []BreakerState {
+	states := make([]BreakerState, 0, len(d.options))
+	for durableName := range d.options {
+		state := BreakerState{DurableName: durableName, State: BreakerClosed}
+		if r, isRetry := d.retryes.Get(durableName); isRetry {
+			retry := r.(dispatcherRetry)
+			state.State = retry.State
+			state.Attempts = retry.Retry
+			state.RetryAt = retry.RetryAt
+			if retry.LastError != nil {
+				state.LastError = retry.LastError.Error()
 			}
 		}
-	} else {
-		err = fmt.Errorf("%w: is not connected", ErrDispatcher)
-	}
-	if err != nil {
-		log.Info().Err(err).
-			Str("durableName", opt.DurableName).
-			Msg("dispatcher failed")
+		states = append(states, state)
 	}
-	return err
+	sort.Slice(states, func(i, j int) bool { return states[i].DurableName < states[j].DurableName })
+	return states
 }
@@ -0,0 +1,130 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gwos/tcg/config"
+	tcgerr "github.com/gwos/tcg/sdk/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcher_retry(t *testing.T) {
+	assert.NoError(t, StartServer(Config{
+		AckWait:            time.Second * 30,
+		MaxInflight:        100,
+		MaxPubAcksInflight: 100,
+		MaxPayload:         1024 * 1024,
+		StoreType:          "MEMORY",
+		Retry: config.RetryConfig{
+			RetryPolicy: config.RetryPolicy{
+				InitialDelay: time.Millisecond * 500,
+				MaxAttempts:  3,
+			},
+		},
+	}))
+	defer StopServer()
+
+	/* counters are cumulative */
+	countRetries := func() uint64 {
+		for _, c := range Counters() {
+			if c.DurableName == "#test#" {
+				return c.Retries
+			}
+		}
+		return 0
+	}
+	retries := countRetries()
+
+	var (
+		mu        sync.Mutex
+		failures  = 1
+		delivered []string
+	)
+	assert.NoError(t, StartDispatcher([]DispatcherOption{{
+		DurableName: "#test#",
+		Subject:     "test",
+		Handler: func(b []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if failures > 0 {
+				failures--
+				return fmt.Errorf("%w: bad gateway", tcgerr.ErrGateway)
+			}
+			delivered = append(delivered, string(b))
+			return nil
+		},
+	}}))
+
+	assert.NoError(t, Publish("test", []byte("msg-1")))
+	assert.NoError(t, Publish("test", []byte("msg-2")))
+
+	assert.Eventually(t, func() bool {
+		states := BreakerStates()
+		return len(states) == 1 && states[0].State == BreakerOpen
+	}, time.Second*5, time.Millisecond*50)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered) == 2
+	}, time.Second*5, time.Millisecond*100)
+	assert.Equal(t, []string{"msg-1", "msg-2"}, delivered)
+	assert.Equal(t, BreakerClosed, BreakerStates()[0].State)
+	assert.Equal(t, retries+1, countRetries())
+}
+
+func TestDrain(t *testing.T) {
+	assert.NoError(t, StartServer(Config{
+		AckWait:            time.Second * 30,
+		MaxInflight:        100,
+		MaxPubAcksInflight: 100,
+		MaxPayload:         1024 * 1024,
+		StoreType:          "MEMORY",
+	}))
+	defer StopServer()
+
+	release := make(chan struct{})
+	assert.NoError(t, StartDispatcher([]DispatcherOption{{
+		DurableName: "#drain#",
+		Subject:     "drain",
+		Handler: func(b []byte) error {
+			<-release
+			return nil
+		},
+	}}))
+
+	assert.NoError(t, Publish("drain", []byte("msg-1")))
+	assert.NoError(t, Publish("drain", []byte("msg-2")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+	undelivered, err := Drain(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	if assert.Len(t, undelivered, 1) {
+		assert.Equal(t, "#drain#", undelivered[0].DurableName)
+	}
+
+	close(release)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel2()
+	undelivered, err = Drain(ctx2)
+	assert.NoError(t, err)
+	for _, ds := range undelivered {
+		assert.Equal(t, 0, ds.NumAckPending)
+	}
+
+	assert.NoError(t, Publish("drain", []byte("msg-3")))
+	undelivered, err = Drain(ctx2)
+	assert.NoError(t, err)
+	if assert.Len(t, undelivered, 1) {
+		assert.Equal(t, "#drain#", undelivered[0].DurableName)
+		assert.NotZero(t, undelivered[0].NumPending)
+		assert.Equal(t, 0, undelivered[0].NumAckPending)
+	}
+
+	assert.NoError(t, StopDispatcher())
+}
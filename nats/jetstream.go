@@ -0,0 +1,447 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	natsd "github.com/nats-io/nats-server/v2/server"
+	natsc "github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// apiWait limits the waiting for the JetStream API response
+const apiWait = time.Second * 5
+
+// peekConsumerPrefix names the temporary consumers reading messages in batch
+const peekConsumerPrefix = "tcg-peek-"
+
+var peekConsumerSeq uint64
+
+// natsQueue provides the queue backend with the embedded NATS server and JetStream
+type natsQueue struct {
+	config     Config
+	natsServer *natsd.Server
+	// the client reconnects automatically, so there is no need in re-dial
+	conn    *natsc.Conn
+	js      natsc.JetStreamContext
+	streams map[string]bool
+}
+
+// natsSubscription wraps the pull subscription bound to the consumer of durable
+type natsSubscription struct {
+	subject      string
+	subscription *natsc.Subscription
+}
+
+// startNatsQueue runs the NATS server with JetStream and connects to it
+func startNatsQueue(config Config) (*natsQueue, error) {
+	natsOpts := &natsd.Options{
+		Host:       "127.0.0.1",
+		Port:       natsd.DEFAULT_PORT,
+		HTTPHost:   "0.0.0.0",
+		HTTPPort:   config.MonitorPort,
+		MaxPayload: config.MaxPayload,
+		JetStream:  true,
+		StoreDir:   config.StoreDir,
+		NoSigs:     true,
+		/* the store limits are applied per stream as they were per channel,
+		so the server doesn't limit the total reserved by streams */
+		JetStreamMaxMemory: math.MaxInt64 / 2,
+		JetStreamMaxStore:  math.MaxInt64 / 2,
+	}
+
+	natsServer, err := natsd.NewServer(natsOpts)
+	if err == nil {
+		go natsServer.Start()
+		if !natsServer.ReadyForConnections(time.Second * 10) {
+			natsServer.Shutdown()
+			err = fmt.Errorf("%w: server is not ready for connections", ErrNATS)
+		}
+	}
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Interface("natsOpts", natsOpts).
+			Msg("nats NewServer failed")
+		return nil, err
+	}
+	log.Info().
+		Func(func(e *zerolog.Event) {
+			if zerolog.GlobalLevel() <= zerolog.DebugLevel {
+				e.Interface("natsOpts", natsOpts)
+			}
+		}).
+		Msgf("nats started at: %s", natsServer.ClientURL())
+
+	conn, err := natsc.Connect(
+		natsServer.ClientURL(),
+		natsc.Name(clusterID),
+		natsc.MaxReconnects(-1),
+		natsc.DisconnectErrHandler(func(_ *natsc.Conn, e error) {
+			log.Warn().Err(e).Msg("nats client disconnected")
+		}),
+	)
+	if err != nil {
+		natsServer.Shutdown()
+		log.Warn().Err(err).Msg("nats client failed to connect")
+		return nil, err
+	}
+	js, err := conn.JetStream(natsc.PublishAsyncMaxPending(config.MaxPubAcksInflight))
+	if err != nil {
+		conn.Close()
+		natsServer.Shutdown()
+		log.Warn().Err(err).Msg("nats client failed to get JetStream")
+		return nil, err
+	}
+
+	q := &natsQueue{
+		config:     config,
+		natsServer: natsServer,
+		conn:       conn,
+		js:         js,
+		streams:    make(map[string]bool),
+	}
+	if err := q.migrateSTAN(); err != nil {
+		/* keep running, the migration is retried on next start */
+		log.Err(err).Msg("nats could not migrate NATS Streaming store")
+	}
+	return q, nil
+}
+
+// Close closes the connection and shutdowns the server
+func (q *natsQueue) Close() {
+	q.conn.Close()
+	q.natsServer.Shutdown()
+	q.natsServer.WaitForShutdown()
+}
+
+// Publish adds the message in the stream of subject
+func (q *natsQueue) Publish(subject string, data []byte) error {
+	stream, err := q.ensureStream(subject)
+	if err != nil {
+		log.Warn().Err(err).Msg("nats publisher failed to add stream")
+		return err
+	}
+	_, err = q.js.Publish(subject, data, natsc.ExpectStream(stream))
+	return err
+}
+
+// Subscribe adds the pull consumer for durable if it is absent and binds to it
+// the new consumer starts with the last message as the STAN durable did before
+func (q *natsQueue) Subscribe(subject, durableName string) (Subscription, error) {
+	stream, err := q.ensureStream(subject)
+	if err != nil {
+		return nil, err
+	}
+	consumer := consumerName(durableName)
+	if _, err = q.js.ConsumerInfo(stream, consumer); errors.Is(err, natsc.ErrConsumerNotFound) {
+		cfg := q.consumerConfig(durableName)
+		cfg.DeliverPolicy = natsc.DeliverLastPolicy
+		_, err = q.js.AddConsumer(stream, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	subscription, err := q.js.PullSubscribe(subject, consumer, natsc.Bind(stream, consumer))
+	if err != nil {
+		return nil, err
+	}
+	return &natsSubscription{subject: subject, subscription: subscription}, nil
+}
+
+// GetMsg returns the message from the stream of subject
+func (q *natsQueue) GetMsg(subject string, seq uint64) (*Msg, error) {
+	msg, err := q.js.GetMsg(streamName(subject), seq)
+	if errors.Is(err, natsc.ErrMsgNotFound) || errors.Is(err, natsc.ErrStreamNotFound) {
+		return nil, fmt.Errorf("%w: %s#%d", ErrMsgNotFound, subject, seq)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Msg{
+		Subject:   subject,
+		Sequence:  msg.Sequence,
+		Timestamp: msg.Time,
+		Data:      msg.Data,
+	}, nil
+}
+
+// Msgs returns up to limit messages from the stream of subject starting with the sequence
+// the messages are fetched in batch by the temporary consumer
+// the messages are not acked as the consumer is deleted after reading
+func (q *natsQueue) Msgs(subject string, startSeq uint64, limit int) ([]*Msg, error) {
+	stream := streamName(subject)
+	info, err := q.js.StreamInfo(stream)
+	if errors.Is(err, natsc.ErrStreamNotFound) {
+		return []*Msg{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.State.Msgs == 0 || startSeq > info.State.LastSeq || limit <= 0 {
+		return []*Msg{}, nil
+	}
+
+	name := fmt.Sprintf("%s%d", peekConsumerPrefix, atomic.AddUint64(&peekConsumerSeq, 1))
+	cfg := &natsc.ConsumerConfig{
+		Durable:           name,
+		Description:       name,
+		AckPolicy:         natsc.AckExplicitPolicy,
+		MaxAckPending:     limit,
+		DeliverPolicy:     natsc.DeliverAllPolicy,
+		InactiveThreshold: apiWait,
+	}
+	if startSeq > 0 {
+		cfg.DeliverPolicy = natsc.DeliverByStartSequencePolicy
+		cfg.OptStartSeq = startSeq
+	}
+	if _, err := q.js.AddConsumer(stream, cfg); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := q.js.DeleteConsumer(stream, name); err != nil {
+			log.Debug().Err(err).Str("consumer", name).Msg("nats could not delete temporary consumer")
+		}
+	}()
+	subscription, err := q.js.PullSubscribe(subject, name, natsc.Bind(stream, name))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = subscription.Unsubscribe() }()
+
+	msgs := make([]*Msg, 0, limit)
+	for len(msgs) < limit {
+		fetched, err := subscription.Fetch(limit-len(msgs), natsc.MaxWait(apiWait))
+		if errors.Is(err, natsc.ErrTimeout) {
+			/* the last messages of stream are deleted */
+			return msgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range fetched {
+			meta, err := m.Metadata()
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, &Msg{
+				Subject:   subject,
+				Sequence:  meta.Sequence.Stream,
+				Timestamp: meta.Timestamp,
+				Data:      m.Data,
+			})
+			/* the stream is read up to the end */
+			if meta.NumPending == 0 {
+				return msgs, nil
+			}
+		}
+	}
+	return msgs, nil
+}
+
+// DeleteMsg removes the message from the stream of subject
+func (q *natsQueue) DeleteMsg(subject string, seq uint64) error {
+	return q.js.DeleteMsg(streamName(subject), seq)
+}
+
+// Purge removes messages of stream with sequence less than upToSeq, all for zero
+// the request is sent directly as the client doesn't support the purge options
+func (q *natsQueue) Purge(subject string, upToSeq uint64) (uint64, error) {
+	req, err := json.Marshal(natsd.JSApiStreamPurgeRequest{Sequence: upToSeq})
+	if err != nil {
+		return 0, err
+	}
+	msg, err := q.conn.Request(fmt.Sprintf(natsd.JSApiStreamPurgeT, streamName(subject)), req, apiWait)
+	if err != nil {
+		return 0, err
+	}
+	resp := natsd.JSApiStreamPurgeResponse{}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return 0, err
+	}
+	if resp.Error != nil {
+		if natsd.IsNatsErr(resp.Error, natsd.JSStreamNotFoundErr) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("%w: %s", ErrNATS, resp.Error.Description)
+	}
+	return resp.Purged, nil
+}
+
+// ResetDurable replaces the consumer of durable to start with the sequence
+// zero sequence means new messages only
+func (q *natsQueue) ResetDurable(subject, durableName string, startSeq uint64) error {
+	stream, err := q.ensureStream(subject)
+	if err != nil {
+		return err
+	}
+	cfg := q.consumerConfig(durableName)
+	if startSeq > 0 {
+		cfg.DeliverPolicy = natsc.DeliverByStartSequencePolicy
+		cfg.OptStartSeq = startSeq
+	}
+	if err := q.js.DeleteConsumer(stream, cfg.Durable); err != nil && !errors.Is(err, natsc.ErrConsumerNotFound) {
+		return err
+	}
+	_, err = q.js.AddConsumer(stream, cfg)
+	return err
+}
+
+// Stats returns the state of streams and consumers
+func (q *natsQueue) Stats() (QueueStats, error) {
+	stats := QueueStats{Subjects: []SubjectStats{}, Durables: []DurableStats{}}
+	for info := range q.js.StreamsInfo() {
+		if len(info.Config.Subjects) == 0 {
+			continue
+		}
+		subject := info.Config.Subjects[0]
+		stats.Subjects = append(stats.Subjects, SubjectStats{
+			Subject:   subject,
+			Msgs:      info.State.Msgs,
+			Bytes:     info.State.Bytes,
+			FirstSeq:  info.State.FirstSeq,
+			LastSeq:   info.State.LastSeq,
+			FirstTime: info.State.FirstTime,
+		})
+		for consumer := range q.js.ConsumersInfo(info.Config.Name) {
+			if strings.HasPrefix(consumer.Name, peekConsumerPrefix) {
+				continue
+			}
+			durableName := consumer.Config.Description
+			if durableName == "" {
+				durableName = consumer.Name
+			}
+			stats.Durables = append(stats.Durables, DurableStats{
+				DurableName:    durableName,
+				Subject:        subject,
+				NumPending:     consumer.NumPending,
+				NumAckPending:  consumer.NumAckPending,
+				NumRedelivered: consumer.NumRedelivered,
+			})
+		}
+	}
+	sort.Slice(stats.Subjects, func(i, j int) bool { return stats.Subjects[i].Subject < stats.Subjects[j].Subject })
+	sort.Slice(stats.Durables, func(i, j int) bool { return stats.Durables[i].DurableName < stats.Durables[j].DurableName })
+	return stats, nil
+}
+
+// ensureStream adds the stream for subject or updates the limits of existing one
+// the store limits are applied per stream as they were applied per channel before
+// the dead-letter stream has no limits, see storeLimits
+func (q *natsQueue) ensureStream(subject string) (string, error) {
+	name := streamName(subject)
+	if q.streams[name] {
+		return name, nil
+	}
+	storage := natsc.FileStorage
+	if q.config.StoreType == "MEMORY" {
+		storage = natsc.MemoryStorage
+	}
+	limits := storeLimits(subject, q.config)
+	cfg := &natsc.StreamConfig{
+		Name:      name,
+		Subjects:  []string{subject},
+		Retention: natsc.LimitsPolicy,
+		Discard:   natsc.DiscardOld,
+		MaxAge:    limits.StoreMaxAge,
+		MaxBytes:  limits.StoreMaxBytes,
+		MaxMsgs:   int64(limits.StoreMaxMsgs),
+		Storage:   storage,
+		Replicas:  1,
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = -1
+	}
+	if cfg.MaxMsgs == 0 {
+		cfg.MaxMsgs = -1
+	}
+
+	_, err := q.js.StreamInfo(name)
+	switch {
+	case errors.Is(err, natsc.ErrStreamNotFound):
+		_, err = q.js.AddStream(cfg)
+	case err == nil:
+		_, err = q.js.UpdateStream(cfg)
+	}
+	if err != nil {
+		return "", err
+	}
+	q.streams[name] = true
+	return name, nil
+}
+
+// consumerConfig returns the consumer config for durable delivering new messages
+func (q *natsQueue) consumerConfig(durableName string) *natsc.ConsumerConfig {
+	return &natsc.ConsumerConfig{
+		Durable:       consumerName(durableName),
+		Description:   durableName,
+		DeliverPolicy: natsc.DeliverNewPolicy,
+		AckPolicy:     natsc.AckExplicitPolicy,
+		AckWait:       q.config.AckWait,
+		MaxAckPending: q.config.MaxInflight,
+	}
+}
+
+// Fetch pulls messages from the consumer
+func (sub *natsSubscription) Fetch(ctx context.Context, batch int) ([]*Msg, error) {
+	msgs, err := sub.subscription.Fetch(batch, natsc.Context(ctx))
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) ||
+		errors.Is(err, natsc.ErrTimeout) {
+		err = nil
+	}
+	result := make([]*Msg, 0, len(msgs))
+	for _, msg := range msgs {
+		m := &Msg{Subject: sub.subject, Data: msg.Data, raw: msg}
+		if meta, err := msg.Metadata(); err == nil {
+			m.Sequence = meta.Sequence.Stream
+			m.Timestamp = meta.Timestamp
+		}
+		result = append(result, m)
+	}
+	return result, err
+}
+
+// Ack acknowledges the message
+func (sub *natsSubscription) Ack(msg *Msg) error {
+	return msg.raw.(*natsc.Msg).Ack()
+}
+
+// Nak makes the message available for redelivery
+func (sub *natsSubscription) Nak(msg *Msg) error {
+	return msg.raw.(*natsc.Msg).Nak()
+}
+
+// Close unsubscribes keeping the consumer
+func (sub *natsSubscription) Close() error {
+	return sub.subscription.Unsubscribe()
+}
+
+// streamName returns the stream name for subject
+// as the JetStream names don't allow some characters
+func streamName(subject string) string {
+	return sanitizeName(subject)
+}
+
+// consumerName returns the consumer name for durable
+// as the JetStream names don't allow some characters
+func consumerName(durableName string) string {
+	return sanitizeName(durableName)
+}
+
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', '/', '\\', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, name)
+}
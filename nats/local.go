@@ -0,0 +1,941 @@
+package nats
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// localStoreFile keeps the local queue in the store dir
+// localPoll limits the waiting in fetch to check the ack deadlines and the store limits
+// localFlush defines the interval of persisting the states of acknowledging durables
+// localBatchDelay limits the waiting for concurrent publishers to write them together
+const (
+	localStoreFile  = "queue.db"
+	localPoll       = time.Second
+	localFlush      = time.Second
+	localBatchDelay = time.Millisecond * 2
+)
+
+var (
+	bucketMsgs     = []byte("msgs")
+	bucketDurables = []byte("durables")
+	keyLastSeq     = []byte("lastSeq")
+)
+
+// localQueue provides the in-process queue backend without listening ports
+// the messages and the states of durables are persisted in the bolt database for FILE store type
+// and kept in memory for MEMORY store type
+// the database keeps a bucket per subject with nested buckets of messages and durables
+// the concurrent publishers are written in single transaction,
+// the states of acknowledging durables are written in background within localFlush
+// so the messages acknowledged just before crash could be redelivered
+type localQueue struct {
+	sync.Mutex
+
+	config  Config
+	db      *bolt.DB
+	closed  bool
+	done    chan struct{}
+	streams map[string]*localStream
+}
+
+type localStream struct {
+	subject  string
+	firstSeq uint64
+	lastSeq  uint64
+	bytes    uint64
+	msgs     map[uint64]*localEntry
+	durables map[string]*localDurable
+	// nextSeq is the last sequence taken by publishers
+	// staged keeps the stored messages until the previous ones are stored, nil for failed
+	nextSeq uint64
+	staged  map[uint64]*localEntry
+	// notify is closed and replaced on new messages to wake up fetchers
+	notify chan struct{}
+}
+
+type localEntry struct {
+	timestamp time.Time
+	size      int
+	// data is kept in memory for MEMORY store type only
+	data []byte
+}
+
+// localDurable keeps the delivery state of durable
+// all messages up to AckFloor are acknowledged, Acked keeps acknowledged above AckFloor
+// the delivered and unacknowledged messages are redelivered after restart
+// numPending counts the messages not delivered yet, dirty marks the state to persist
+type localDurable struct {
+	AckFloor uint64   `json:"ackFloor"`
+	Acked    []uint64 `json:"acked,omitempty"`
+
+	acked      map[uint64]bool
+	next       uint64
+	pending    map[uint64]*localPending
+	numPending uint64
+	dirty      bool
+}
+
+type localPending struct {
+	deadline   time.Time
+	deliveries int
+}
+
+type localSubscription struct {
+	q           *localQueue
+	st          *localStream
+	durableName string
+	dur         *localDurable
+}
+
+// openLocalQueue opens the local queue and loads the persisted state
+func openLocalQueue(config Config) (*localQueue, error) {
+	q := &localQueue{
+		config:  config,
+		streams: make(map[string]*localStream),
+	}
+	if config.StoreType != "MEMORY" {
+		if config.StoreDir != "" {
+			if err := os.MkdirAll(config.StoreDir, 0o755); err != nil {
+				log.Warn().Err(err).Msg("nats local queue failed")
+				return nil, err
+			}
+		}
+		path := filepath.Join(config.StoreDir, localStoreFile)
+		db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second * 10})
+		if err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("nats local queue failed")
+			return nil, err
+		}
+		db.MaxBatchDelay = localBatchDelay
+		q.db = db
+		if err := q.load(); err != nil {
+			_ = db.Close()
+			log.Warn().Err(err).Str("path", path).Msg("nats local queue failed to load")
+			return nil, err
+		}
+		q.done = make(chan struct{})
+		go q.flushLoop()
+	}
+	log.Info().Str("storeType", config.StoreType).
+		Int("subjects", len(q.streams)).
+		Msg("nats local queue started")
+	return q, nil
+}
+
+// load reads the persisted streams, the message data stays on disk
+func (q *localQueue) load() error {
+	return q.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			st := newLocalStream(string(name))
+			if v := b.Get(keyLastSeq); v != nil {
+				st.lastSeq = binary.BigEndian.Uint64(v)
+			}
+			if mb := b.Bucket(bucketMsgs); mb != nil {
+				if err := mb.ForEach(func(k, v []byte) error {
+					if len(k) != 8 || len(v) < 8 {
+						return fmt.Errorf("%w: corrupted message in %s", ErrNATS, st.subject)
+					}
+					seq := binary.BigEndian.Uint64(k)
+					size := len(v) - 8
+					st.msgs[seq] = &localEntry{
+						timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(v[:8]))),
+						size:      size,
+					}
+					st.bytes += uint64(size)
+					if st.firstSeq == 0 {
+						st.firstSeq = seq
+					}
+					return nil
+				}); err != nil {
+					return err
+				}
+			}
+			if st.firstSeq == 0 {
+				st.firstSeq = st.lastSeq + 1
+			}
+			st.nextSeq = st.lastSeq
+			if durables := b.Bucket(bucketDurables); durables != nil {
+				if err := durables.ForEach(func(k, v []byte) error {
+					dur := new(localDurable)
+					if err := json.Unmarshal(v, dur); err != nil {
+						return err
+					}
+					dur.init(st)
+					st.durables[string(k)] = dur
+					return nil
+				}); err != nil {
+					return err
+				}
+			}
+			q.streams[st.subject] = st
+			return nil
+		})
+	})
+}
+
+// Close persists the states of durables, closes the database and wakes up fetchers
+func (q *localQueue) Close() {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for _, st := range q.streams {
+		close(st.notify)
+		st.notify = make(chan struct{})
+	}
+	if q.done != nil {
+		close(q.done)
+	}
+	if err := q.flushDurables(); err != nil {
+		log.Warn().Err(err).Msg("nats local queue failed to store durables")
+	}
+	if q.db != nil {
+		if err := q.db.Close(); err != nil {
+			log.Warn().Err(err).Msg("nats local queue failed to close")
+		}
+		q.db = nil
+	}
+}
+
+// Publish adds the message for subject and removes the messages exceeding the store limits
+// the store is written without holding the lock to batch the concurrent publishers
+func (q *localQueue) Publish(subject string, data []byte) error {
+	q.Lock()
+	if q.closed {
+		q.Unlock()
+		return fmt.Errorf("%v: unavailable", ErrNATS)
+	}
+	if q.config.MaxPayload > 0 && len(data) > int(q.config.MaxPayload) {
+		q.Unlock()
+		return fmt.Errorf("%w: maximum payload exceeded", ErrNATS)
+	}
+	st := q.stream(subject)
+	now := time.Now()
+	st.nextSeq++
+	seq := st.nextSeq
+	removed := st.trimmed(now, 1, len(data), storeLimits(subject, q.config))
+	for _, seq := range removed {
+		st.remove(seq)
+	}
+	db := q.db
+	q.Unlock()
+
+	entry := &localEntry{timestamp: now, size: len(data)}
+	var err error
+	if db != nil {
+		/* the function could be retried so it should be idempotent */
+		err = db.Batch(func(tx *bolt.Tx) error {
+			b, mb, err := streamBuckets(tx, subject)
+			if err != nil {
+				return err
+			}
+			v := make([]byte, 8+len(data))
+			binary.BigEndian.PutUint64(v, uint64(now.UnixNano()))
+			copy(v[8:], data)
+			if err := mb.Put(seqKey(seq), v); err != nil {
+				return err
+			}
+			for _, seq := range removed {
+				if err := mb.Delete(seqKey(seq)); err != nil {
+					return err
+				}
+			}
+			if v := b.Get(keyLastSeq); v != nil && binary.BigEndian.Uint64(v) > seq {
+				return nil
+			}
+			return b.Put(keyLastSeq, seqKey(seq))
+		})
+		if err != nil {
+			log.Warn().Err(err).Msg("nats publisher failed to store")
+			entry = nil
+		}
+	} else {
+		entry.data = append([]byte(nil), data...)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	st.commit(seq, entry)
+	return err
+}
+
+// Subscribe adds the durable if it is absent starting with the last message
+func (q *localQueue) Subscribe(subject, durableName string) (Subscription, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return nil, fmt.Errorf("%v: unavailable", ErrNATS)
+	}
+	st := q.stream(subject)
+	dur, ok := st.durables[durableName]
+	if !ok {
+		dur = &localDurable{AckFloor: st.lastSeq}
+		if _, ok := st.msgs[st.lastSeq]; ok {
+			dur.AckFloor--
+		}
+		dur.init(st)
+		if err := q.saveDurable(st, durableName, dur); err != nil {
+			return nil, err
+		}
+		st.durables[durableName] = dur
+	}
+	return &localSubscription{q: q, st: st, durableName: durableName, dur: dur}, nil
+}
+
+// GetMsg returns the message of subject by sequence
+func (q *localQueue) GetMsg(subject string, seq uint64) (*Msg, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return nil, fmt.Errorf("%v: unavailable", ErrNATS)
+	}
+	st, ok := q.streams[subject]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s#%d", ErrMsgNotFound, subject, seq)
+	}
+	return q.readMsg(st, seq)
+}
+
+// Msgs returns up to limit messages of subject in order starting with the sequence
+// the data is read in single transaction for FILE store type
+func (q *localQueue) Msgs(subject string, startSeq uint64, limit int) ([]*Msg, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return nil, fmt.Errorf("%v: unavailable", ErrNATS)
+	}
+	st, ok := q.streams[subject]
+	if !ok {
+		return []*Msg{}, nil
+	}
+	if startSeq < st.firstSeq {
+		startSeq = st.firstSeq
+	}
+	msgs := make([]*Msg, 0, limit)
+	for seq := startSeq; seq <= st.lastSeq && len(msgs) < limit; seq++ {
+		if entry, ok := st.msgs[seq]; ok {
+			msgs = append(msgs, &Msg{
+				Subject:   subject,
+				Sequence:  seq,
+				Timestamp: entry.timestamp,
+				Data:      entry.data,
+			})
+		}
+	}
+	if q.db == nil || len(msgs) == 0 {
+		return msgs, nil
+	}
+	if err := q.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(subject))
+		if b == nil {
+			return fmt.Errorf("%w: %s", ErrMsgNotFound, subject)
+		}
+		mb := b.Bucket(bucketMsgs)
+		if mb == nil {
+			return fmt.Errorf("%w: %s", ErrMsgNotFound, subject)
+		}
+		for _, msg := range msgs {
+			v := mb.Get(seqKey(msg.Sequence))
+			if len(v) < 8 {
+				return fmt.Errorf("%w: %s#%d", ErrMsgNotFound, subject, msg.Sequence)
+			}
+			/* the value is valid only during the transaction */
+			msg.Data = append([]byte(nil), v[8:]...)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// DeleteMsg removes the message of subject by sequence
+func (q *localQueue) DeleteMsg(subject string, seq uint64) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return fmt.Errorf("%v: unavailable", ErrNATS)
+	}
+	st, ok := q.streams[subject]
+	if !ok {
+		return fmt.Errorf("%w: %s#%d", ErrMsgNotFound, subject, seq)
+	}
+	if _, ok := st.msgs[seq]; !ok {
+		return fmt.Errorf("%w: %s#%d", ErrMsgNotFound, subject, seq)
+	}
+	return q.removeMsgs(st, []uint64{seq})
+}
+
+// Purge removes messages of subject with sequence less than upToSeq, all for zero
+func (q *localQueue) Purge(subject string, upToSeq uint64) (uint64, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return 0, fmt.Errorf("%v: unavailable", ErrNATS)
+	}
+	st, ok := q.streams[subject]
+	if !ok {
+		return 0, nil
+	}
+	seqs := make([]uint64, 0, len(st.msgs))
+	for seq := range st.msgs {
+		if upToSeq == 0 || seq < upToSeq {
+			seqs = append(seqs, seq)
+		}
+	}
+	if err := q.removeMsgs(st, seqs); err != nil {
+		return 0, err
+	}
+	return uint64(len(seqs)), nil
+}
+
+// ResetDurable moves the durable of subject to start with the sequence
+// zero sequence means new messages only
+func (q *localQueue) ResetDurable(subject, durableName string, startSeq uint64) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return fmt.Errorf("%v: unavailable", ErrNATS)
+	}
+	st := q.stream(subject)
+	dur, ok := st.durables[durableName]
+	if !ok {
+		dur = new(localDurable)
+	}
+	dur.AckFloor, dur.Acked = st.lastSeq, nil
+	if startSeq > 0 {
+		dur.AckFloor = startSeq - 1
+	}
+	dur.init(st)
+	if err := q.saveDurable(st, durableName, dur); err != nil {
+		return err
+	}
+	st.durables[durableName] = dur
+	return nil
+}
+
+// Stats returns the state of subjects and durables
+func (q *localQueue) Stats() (QueueStats, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	stats := QueueStats{Subjects: []SubjectStats{}, Durables: []DurableStats{}}
+	if q.closed {
+		return stats, fmt.Errorf("%v: unavailable", ErrNATS)
+	}
+	for _, st := range q.streams {
+		subjectStats := SubjectStats{
+			Subject:  st.subject,
+			Msgs:     uint64(len(st.msgs)),
+			Bytes:    st.bytes,
+			FirstSeq: st.firstSeq,
+			LastSeq:  st.lastSeq,
+		}
+		if entry, ok := st.msgs[st.firstSeq]; ok {
+			subjectStats.FirstTime = entry.timestamp
+		}
+		stats.Subjects = append(stats.Subjects, subjectStats)
+
+		for durableName, dur := range st.durables {
+			durableStats := DurableStats{
+				DurableName:   durableName,
+				Subject:       st.subject,
+				NumAckPending: len(dur.pending),
+				NumPending:    dur.numPending,
+			}
+			for _, p := range dur.pending {
+				if p.deliveries > 1 {
+					durableStats.NumRedelivered++
+				}
+			}
+			stats.Durables = append(stats.Durables, durableStats)
+		}
+	}
+	sort.Slice(stats.Subjects, func(i, j int) bool { return stats.Subjects[i].Subject < stats.Subjects[j].Subject })
+	sort.Slice(stats.Durables, func(i, j int) bool { return stats.Durables[i].DurableName < stats.Durables[j].DurableName })
+	return stats, nil
+}
+
+// stream returns the stream of subject adding absent one
+// the caller should hold the lock
+func (q *localQueue) stream(subject string) *localStream {
+	st, ok := q.streams[subject]
+	if !ok {
+		st = newLocalStream(subject)
+		st.firstSeq = 1
+		q.streams[subject] = st
+	}
+	return st
+}
+
+// readMsg returns the message reading the data from the database for FILE store type
+// the caller should hold the lock
+func (q *localQueue) readMsg(st *localStream, seq uint64) (*Msg, error) {
+	entry, ok := st.msgs[seq]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s#%d", ErrMsgNotFound, st.subject, seq)
+	}
+	msg := &Msg{
+		Subject:   st.subject,
+		Sequence:  seq,
+		Timestamp: entry.timestamp,
+		Data:      entry.data,
+	}
+	if q.db == nil {
+		return msg, nil
+	}
+	if err := q.db.View(func(tx *bolt.Tx) error {
+		var v []byte
+		if b := tx.Bucket([]byte(st.subject)); b != nil {
+			if mb := b.Bucket(bucketMsgs); mb != nil {
+				v = mb.Get(seqKey(seq))
+			}
+		}
+		if len(v) < 8 {
+			return fmt.Errorf("%w: %s#%d", ErrMsgNotFound, st.subject, seq)
+		}
+		/* the value is valid only during the transaction */
+		msg.Data = append([]byte(nil), v[8:]...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// removeMsgs removes messages of stream
+// the caller should hold the lock
+func (q *localQueue) removeMsgs(st *localStream, seqs []uint64) error {
+	if q.db != nil {
+		if err := q.db.Update(func(tx *bolt.Tx) error {
+			_, mb, err := streamBuckets(tx, st.subject)
+			if err != nil {
+				return err
+			}
+			for _, seq := range seqs {
+				if err := mb.Delete(seqKey(seq)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	for _, seq := range seqs {
+		st.remove(seq)
+	}
+	return nil
+}
+
+// saveDurable persists the state of durable
+// the caller should hold the lock
+func (q *localQueue) saveDurable(st *localStream, durableName string, dur *localDurable) error {
+	if q.db == nil {
+		return nil
+	}
+	v, err := dur.marshal()
+	if err != nil {
+		return err
+	}
+	if err := q.db.Update(func(tx *bolt.Tx) error {
+		return putDurable(tx, st.subject, durableName, v)
+	}); err != nil {
+		return err
+	}
+	dur.dirty = false
+	return nil
+}
+
+// flushDurables persists the states of acknowledging durables in single transaction
+// the caller should hold the lock
+func (q *localQueue) flushDurables() error {
+	if q.db == nil {
+		return nil
+	}
+	type dirtyDurable struct {
+		subject, durableName string
+		dur                  *localDurable
+		v                    []byte
+	}
+	dirty := make([]dirtyDurable, 0)
+	for _, st := range q.streams {
+		for durableName, dur := range st.durables {
+			if !dur.dirty {
+				continue
+			}
+			v, err := dur.marshal()
+			if err != nil {
+				return err
+			}
+			dirty = append(dirty, dirtyDurable{st.subject, durableName, dur, v})
+		}
+	}
+	if len(dirty) == 0 {
+		return nil
+	}
+	if err := q.db.Update(func(tx *bolt.Tx) error {
+		for _, d := range dirty {
+			if err := putDurable(tx, d.subject, d.durableName, d.v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, d := range dirty {
+		d.dur.dirty = false
+	}
+	return nil
+}
+
+// flushLoop persists the states of acknowledging durables until closed
+func (q *localQueue) flushLoop() {
+	ticker := time.NewTicker(localFlush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+			q.Lock()
+			if !q.closed {
+				if err := q.flushDurables(); err != nil {
+					log.Warn().Err(err).Msg("nats local queue failed to store durables")
+				}
+			}
+			q.Unlock()
+		}
+	}
+}
+
+// Fetch returns up to batch messages waiting them until the context is done
+// the unacknowledged messages are redelivered first in order
+func (sub *localSubscription) Fetch(ctx context.Context, batch int) ([]*Msg, error) {
+	for {
+		sub.q.Lock()
+		if sub.q.closed {
+			sub.q.Unlock()
+			return nil, fmt.Errorf("%v: unavailable", ErrNATS)
+		}
+		msgs, err := sub.take(time.Now(), batch)
+		notify := sub.st.notify
+		sub.q.Unlock()
+		if err != nil || len(msgs) > 0 {
+			return msgs, err
+		}
+
+		timer := time.NewTimer(localPoll)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil
+		case <-notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// take delivers messages to durable
+// the caller should hold the lock
+func (sub *localSubscription) take(now time.Time, batch int) ([]*Msg, error) {
+	q, st, dur := sub.q, sub.st, sub.dur
+	if removed := st.trimmed(now, 0, 0, storeLimits(st.subject, q.config)); len(removed) > 0 {
+		if err := q.removeMsgs(st, removed); err != nil {
+			return nil, err
+		}
+	}
+
+	seqs := make([]uint64, 0, batch)
+	redeliver := make([]uint64, 0)
+	for seq, p := range dur.pending {
+		if !p.deadline.After(now) {
+			redeliver = append(redeliver, seq)
+		}
+	}
+	sort.Slice(redeliver, func(i, j int) bool { return redeliver[i] < redeliver[j] })
+	for _, seq := range redeliver {
+		if len(seqs) >= batch {
+			break
+		}
+		if _, ok := st.msgs[seq]; !ok {
+			delete(dur.pending, seq)
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	if dur.next < st.firstSeq {
+		dur.next = st.firstSeq
+	}
+	for len(seqs) < batch && dur.next <= st.lastSeq &&
+		(q.config.MaxInflight <= 0 || len(dur.pending) < q.config.MaxInflight) {
+		seq := dur.next
+		dur.next++
+		if _, ok := st.msgs[seq]; !ok || dur.acked[seq] {
+			continue
+		}
+		dur.numPending--
+		dur.pending[seq] = &localPending{}
+		seqs = append(seqs, seq)
+	}
+
+	ackWait := q.config.AckWait
+	if ackWait <= 0 {
+		ackWait = time.Second * 30
+	}
+	msgs := make([]*Msg, 0, len(seqs))
+	for _, seq := range seqs {
+		msg, err := q.readMsg(st, seq)
+		if err != nil {
+			return msgs, err
+		}
+		p := dur.pending[seq]
+		p.deadline = now.Add(ackWait)
+		p.deliveries++
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// Ack acknowledges the message and moves the ack floor of durable
+func (sub *localSubscription) Ack(msg *Msg) error {
+	sub.q.Lock()
+	defer sub.q.Unlock()
+
+	if sub.q.closed {
+		return fmt.Errorf("%v: unavailable", ErrNATS)
+	}
+	dur := sub.dur
+	if _, ok := dur.pending[msg.Sequence]; !ok {
+		return nil
+	}
+	delete(dur.pending, msg.Sequence)
+	dur.acked[msg.Sequence] = true
+	dur.advance(sub.st)
+	dur.dirty = true
+	return nil
+}
+
+// Nak makes the message available for redelivery
+func (sub *localSubscription) Nak(msg *Msg) error {
+	sub.q.Lock()
+	defer sub.q.Unlock()
+
+	if p, ok := sub.dur.pending[msg.Sequence]; ok {
+		p.deadline = time.Time{}
+	}
+	return nil
+}
+
+// Close makes the unacknowledged messages available for redelivery keeping the durable
+func (sub *localSubscription) Close() error {
+	sub.q.Lock()
+	defer sub.q.Unlock()
+
+	for _, p := range sub.dur.pending {
+		p.deadline = time.Time{}
+	}
+	return nil
+}
+
+func newLocalStream(subject string) *localStream {
+	return &localStream{
+		subject:  subject,
+		msgs:     make(map[uint64]*localEntry),
+		durables: make(map[string]*localDurable),
+		staged:   make(map[uint64]*localEntry),
+		notify:   make(chan struct{}),
+	}
+}
+
+// commit adds the stored message in order of sequence and wakes up fetchers
+// nil entry skips the sequence of message failed to store
+func (st *localStream) commit(seq uint64, entry *localEntry) {
+	st.staged[seq] = entry
+	added := false
+	for {
+		entry, ok := st.staged[st.lastSeq+1]
+		if !ok {
+			break
+		}
+		delete(st.staged, st.lastSeq+1)
+		st.lastSeq++
+		if entry == nil {
+			if len(st.msgs) == 0 {
+				st.firstSeq = st.lastSeq + 1
+			}
+			continue
+		}
+		st.msgs[st.lastSeq] = entry
+		st.bytes += uint64(entry.size)
+		if len(st.msgs) == 1 {
+			st.firstSeq = st.lastSeq
+		}
+		for _, dur := range st.durables {
+			if dur.isPending(st.lastSeq) {
+				dur.numPending++
+			}
+		}
+		added = true
+	}
+	if added {
+		close(st.notify)
+		st.notify = make(chan struct{})
+	}
+}
+
+// trimmed returns the first messages exceeding the store limits
+// once the number of messages and bytes are added
+func (st *localStream) trimmed(now time.Time, addMsgs, addBytes int, config Config) []uint64 {
+	var seqs []uint64
+	msgs, bytes := len(st.msgs)+addMsgs, st.bytes+uint64(addBytes)
+	for seq := st.firstSeq; seq <= st.lastSeq; seq++ {
+		entry, ok := st.msgs[seq]
+		if !ok {
+			continue
+		}
+		if !(config.StoreMaxMsgs > 0 && msgs > config.StoreMaxMsgs ||
+			config.StoreMaxBytes > 0 && bytes > uint64(config.StoreMaxBytes) ||
+			config.StoreMaxAge > 0 && now.Sub(entry.timestamp) > config.StoreMaxAge) {
+			break
+		}
+		seqs = append(seqs, seq)
+		msgs--
+		bytes -= uint64(entry.size)
+	}
+	return seqs
+}
+
+// remove removes the message from memory and moves the first sequence
+func (st *localStream) remove(seq uint64) {
+	entry, ok := st.msgs[seq]
+	if !ok {
+		return
+	}
+	for _, dur := range st.durables {
+		if dur.isPending(seq) {
+			dur.numPending--
+		}
+	}
+	delete(st.msgs, seq)
+	st.bytes -= uint64(entry.size)
+	if len(st.msgs) == 0 {
+		st.firstSeq = st.lastSeq + 1
+		return
+	}
+	for seq == st.firstSeq && st.firstSeq <= st.lastSeq {
+		if _, ok := st.msgs[st.firstSeq]; ok {
+			break
+		}
+		st.firstSeq++
+		seq = st.firstSeq
+	}
+}
+
+// init restores the delivery state and counts the messages of stream not delivered yet
+func (dur *localDurable) init(st *localStream) {
+	dur.acked = make(map[uint64]bool, len(dur.Acked))
+	for _, seq := range dur.Acked {
+		dur.acked[seq] = true
+	}
+	dur.next = dur.AckFloor + 1
+	dur.pending = make(map[uint64]*localPending)
+	dur.numPending = 0
+	for seq := range st.msgs {
+		if dur.isPending(seq) {
+			dur.numPending++
+		}
+	}
+}
+
+// isPending checks the message is not delivered yet
+func (dur *localDurable) isPending(seq uint64) bool {
+	return seq >= dur.next && !dur.acked[seq]
+}
+
+func (dur *localDurable) marshal() ([]byte, error) {
+	dur.Acked = dur.Acked[:0]
+	for seq := range dur.acked {
+		dur.Acked = append(dur.Acked, seq)
+	}
+	sort.Slice(dur.Acked, func(i, j int) bool { return dur.Acked[i] < dur.Acked[j] })
+	return json.Marshal(dur)
+}
+
+// advance moves the ack floor over acknowledged and removed messages
+func (dur *localDurable) advance(st *localStream) {
+	if dur.AckFloor+1 < st.firstSeq && len(dur.pending) == 0 {
+		floor := st.firstSeq - 1
+		if floor >= dur.next {
+			floor = dur.next - 1
+		}
+		for seq := range dur.acked {
+			if seq <= floor {
+				delete(dur.acked, seq)
+			}
+		}
+		if floor > dur.AckFloor {
+			dur.AckFloor = floor
+		}
+	}
+	for dur.AckFloor+1 < dur.next {
+		seq := dur.AckFloor + 1
+		if dur.acked[seq] {
+			delete(dur.acked, seq)
+		} else if _, ok := st.msgs[seq]; ok || dur.pending[seq] != nil {
+			break
+		}
+		dur.AckFloor = seq
+	}
+}
+
+// putDurable writes the state of durable
+func putDurable(tx *bolt.Tx, subject, durableName string, v []byte) error {
+	b, _, err := streamBuckets(tx, subject)
+	if err != nil {
+		return err
+	}
+	durables, err := b.CreateBucketIfNotExists(bucketDurables)
+	if err != nil {
+		return err
+	}
+	return durables.Put([]byte(durableName), v)
+}
+
+// streamBuckets returns the buckets of subject adding absent ones
+func streamBuckets(tx *bolt.Tx, subject string) (*bolt.Bucket, *bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(subject))
+	if err != nil {
+		return nil, nil, err
+	}
+	mb, err := b.CreateBucketIfNotExists(bucketMsgs)
+	return b, mb, err
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
@@ -0,0 +1,150 @@
+package nats
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalQueue(t *testing.T) {
+	cfg := Config{
+		AckWait:     time.Second * 30,
+		MaxInflight: 100,
+		MaxPayload:  1024 * 1024,
+		Backend:     BackendLocal,
+		StoreDir:    t.TempDir(),
+		StoreType:   "FILE",
+	}
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	options := []DispatcherOption{{
+		DurableName: "#test#",
+		Subject:     "test",
+		Handler: func(b []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered = append(delivered, string(b))
+			return nil
+		},
+	}}
+	waitDelivered := func(expected ...string) {
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(delivered) == len(expected)
+		}, time.Second*5, time.Millisecond*50)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, expected, delivered)
+		delivered = nil
+	}
+
+	assert.NoError(t, StartServer(cfg))
+	assert.NoError(t, StartDispatcher(options))
+	assert.NoError(t, Publish("test", []byte("msg-1")))
+	assert.NoError(t, Publish("test", []byte("msg-2")))
+	waitDelivered("msg-1", "msg-2")
+	assert.NoError(t, StopDispatcher())
+	assert.NoError(t, Publish("test", []byte("msg-3")))
+	StopServer()
+
+	/* the messages and the state of durable are kept in the store */
+	assert.NoError(t, StartServer(cfg))
+	defer StopServer()
+	stats, err := Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, []SubjectStats{{
+		Subject: "test", Msgs: 3, Bytes: 15, FirstSeq: 1, LastSeq: 3,
+		FirstTime: stats.Subjects[0].FirstTime,
+	}}, stats.Subjects)
+	assert.Equal(t, []DurableStats{{
+		DurableName: "#test#", Subject: "test", NumPending: 1,
+	}}, stats.Durables)
+
+	assert.NoError(t, StartDispatcher(options))
+	waitDelivered("msg-3")
+	assert.NoError(t, StopDispatcher())
+}
+
+func TestLocalQueue_limits(t *testing.T) {
+	assert.NoError(t, StartServer(Config{
+		MaxInflight:  100,
+		Backend:      BackendLocal,
+		StoreType:    "MEMORY",
+		StoreMaxMsgs: 2,
+	}))
+	defer StopServer()
+
+	for _, msg := range []string{"msg-1", "msg-2", "msg-3"} {
+		assert.NoError(t, Publish("test", []byte(msg)))
+	}
+	stats, err := Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.Subjects[0].Msgs)
+	assert.Equal(t, uint64(2), stats.Subjects[0].FirstSeq)
+
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.queue.GetMsg("test", 1)
+	assert.ErrorIs(t, err, ErrMsgNotFound)
+	msg, err := s.queue.GetMsg("test", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, "msg-3", string(msg.Data))
+}
+
+func TestLocalQueue_batch(t *testing.T) {
+	cfg := Config{
+		AckWait:     time.Second * 30,
+		MaxInflight: 100,
+		Backend:     BackendLocal,
+		StoreDir:    t.TempDir(),
+		StoreType:   "FILE",
+	}
+	assert.NoError(t, StartServer(cfg))
+	q, err := getQueue()
+	assert.NoError(t, err)
+	sub, err := q.Subscribe("test", "#test#")
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				assert.NoError(t, Publish("test", []byte("msg")))
+			}
+		}()
+	}
+	wg.Wait()
+	stats, err := Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), stats.Subjects[0].Msgs)
+	assert.Equal(t, uint64(100), stats.Subjects[0].LastSeq)
+	assert.Equal(t, uint64(100), stats.Durables[0].NumPending)
+
+	msgs, err := sub.Fetch(context.Background(), 30)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 30)
+	for _, msg := range msgs[:20] {
+		assert.NoError(t, sub.Ack(msg))
+	}
+	stats, err = Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(70), stats.Durables[0].NumPending)
+	assert.Equal(t, 10, stats.Durables[0].NumAckPending)
+	StopServer()
+
+	/* the acknowledged states are persisted on close */
+	assert.NoError(t, StartServer(cfg))
+	defer StopServer()
+	stats, err = Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), stats.Subjects[0].Msgs)
+	assert.Equal(t, uint64(80), stats.Durables[0].NumPending)
+}
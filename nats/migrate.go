@@ -0,0 +1,347 @@
+package nats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	natsd "github.com/nats-io/nats-server/v2/server"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/nats-io/nats-streaming-server/stores"
+	natsc "github.com/nats-io/nats.go"
+	"github.com/nats-io/stan.go"
+	"github.com/rs/zerolog/log"
+)
+
+// stanMigratingDir keeps the NATS Streaming file store during migration
+// as the store recovery treats any directory as channel
+// stanMigratedDir keeps the NATS Streaming file store after migration
+// stanProgressFile keeps the progress of migration per channel to resume after failure
+// stanWait limits the waiting for messages from NATS Streaming
+const (
+	stanMigratingDir = "stan-migrating"
+	stanMigratedDir  = "stan-migrated"
+	stanProgressFile = "tcg-migrate.json"
+	stanWait         = time.Second * 5
+)
+
+// channelProgress describes the migration of channel
+// LastSeq is the sequence of the last copied message of channel
+// Starts maps the durables to the start sequences in the stream
+type channelProgress struct {
+	Done    bool              `json:"done"`
+	LastSeq uint64            `json:"lastSeq"`
+	Starts  map[string]uint64 `json:"starts"`
+}
+
+// migrateProgress keeps the progress of migration in the store directory
+type migrateProgress struct {
+	path     string
+	Channels map[string]*channelProgress `json:"channels"`
+}
+
+// migratePublish copies the message into the stream, could be overridden in tests
+var migratePublish = func(js natsc.JetStreamContext, subject string, data []byte, opts ...natsc.PubOpt) (*natsc.PubAck, error) {
+	return js.Publish(subject, data, opts...)
+}
+
+// migrateSTAN drains the NATS Streaming file store into the streams once
+// it runs the NATS Streaming server on the store, copies the messages pending for durables
+// and adds the consumers starting at the first unacknowledged message of each durable
+// the store files are moved aside before, and archived after, so the migration is not repeated
+// the failed migration is resumed on next start from the progress kept per channel
+func (q *natsQueue) migrateSTAN() error {
+	if q.config.StoreType == "MEMORY" || q.config.StoreDir == "" {
+		return nil
+	}
+	srcDir := filepath.Join(q.config.StoreDir, stanMigratingDir)
+	if _, err := os.Stat(filepath.Join(q.config.StoreDir, "server.dat")); err == nil {
+		if err := moveSTANStore(q.config.StoreDir, srcDir); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(srcDir, "server.dat")); err != nil {
+		return nil
+	}
+	log.Info().Str("storeDir", srcDir).Msg("nats migrating NATS Streaming store")
+	progress, err := loadMigrateProgress(filepath.Join(srcDir, stanProgressFile))
+	if err != nil {
+		return err
+	}
+
+	natsOpts := stand.DefaultNatsServerOptions.Clone()
+	natsOpts.Host = "127.0.0.1"
+	natsOpts.Port = natsd.RANDOM_PORT
+	natsOpts.MaxPayload = q.config.MaxPayload
+
+	stanOpts := stand.GetDefaultOptions().Clone()
+	stanOpts.ID = clusterID
+	stanOpts.StoreType = stores.TypeFile
+	stanOpts.FilestoreDir = srcDir
+	stanOpts.FileStoreOpts.BufferSize = q.config.StoreBufferSize
+	stanOpts.FileStoreOpts.ReadBufferSize = q.config.StoreReadBufferSize
+	/* keep the messages of store as is */
+	stanOpts.StoreLimits.MaxAge = 0
+	stanOpts.StoreLimits.MaxBytes = 0
+	stanOpts.StoreLimits.MaxMsgs = 0
+
+	stanServer, err := stand.RunServerWithOpts(stanOpts, natsOpts)
+	if err != nil {
+		return err
+	}
+	channelsz, err := getChannelsz(stanServer)
+	if err != nil {
+		stanServer.Shutdown()
+		return err
+	}
+	conn, err := stan.Connect(clusterID, dispatcherID, stan.NatsURL(stanServer.ClientURL()))
+	if err != nil {
+		stanServer.Shutdown()
+		return err
+	}
+
+	for _, channelz := range channelsz.Channels {
+		durables := make([]string, 0)
+		for _, sub := range channelz.Subscriptions {
+			if sub.IsDurable && sub.QueueName == "" {
+				durables = append(durables, sub.DurableName)
+			}
+		}
+		if len(durables) == 0 {
+			continue
+		}
+		cp := progress.channel(channelz.Name)
+		if cp.Done {
+			continue
+		}
+		count, err := q.migrateChannel(conn, channelz, durables, progress)
+		if err != nil {
+			_ = conn.Close()
+			stanServer.Shutdown()
+			return fmt.Errorf("%w: could not migrate channel %s: %v", ErrNATS, channelz.Name, err)
+		}
+		log.Info().Str("channel", channelz.Name).
+			Strs("durables", durables).
+			Int("count", count).
+			Msg("nats migrated channel")
+	}
+	_ = conn.Close()
+	stanServer.Shutdown()
+
+	dstDir := filepath.Join(q.config.StoreDir, stanMigratedDir)
+	if err := os.MkdirAll(dstDir, 0o755); err != nil {
+		return err
+	}
+	dstDir = filepath.Join(dstDir, time.Now().Format("20060102T150405"))
+	if err := os.Rename(srcDir, dstDir); err != nil {
+		return err
+	}
+	log.Info().Str("path", dstDir).Msg("nats migrated NATS Streaming store")
+	return nil
+}
+
+// migrateChannel copies messages pending for durables into the stream and adds consumers
+// the messages copied by previous attempts are skipped
+// returns the number of copied messages
+func (q *natsQueue) migrateChannel(conn stan.Conn, channelz *stand.Channelz, durables []string, progress *migrateProgress) (int, error) {
+	cp := progress.channel(channelz.Name)
+	/* find the first unacknowledged message of durables
+	by resuming durables, the server redelivers the pending messages first */
+	starts := make(map[string]uint64, len(durables))
+	minStart := channelz.LastSeq + 1
+	for _, durableName := range durables {
+		start, err := firstPending(conn, channelz.Name, durableName)
+		if err != nil {
+			return 0, err
+		}
+		if start == 0 {
+			continue
+		}
+		starts[durableName] = start
+		if start < minStart {
+			minStart = start
+		}
+	}
+
+	stream, err := q.ensureStream(channelz.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	/* copy messages and map the start sequences of durables */
+	count := 0
+	jsStarts := cp.Starts
+	if minStart <= cp.LastSeq {
+		minStart = cp.LastSeq + 1
+	}
+	if minStart <= channelz.LastSeq {
+		msgs, done := make(chan *stan.Msg, 64), make(chan struct{})
+		subscription, err := conn.Subscribe(channelz.Name, func(msg *stan.Msg) {
+			select {
+			case msgs <- msg:
+			case <-done:
+			}
+		}, stan.StartAtSequence(minStart))
+		if err != nil {
+			return 0, err
+		}
+		defer func() { _ = subscription.Close() }()
+		defer close(done)
+
+		for isDone := false; !isDone; {
+			select {
+			case msg := <-msgs:
+				ack, err := migratePublish(q.js, channelz.Name, msg.Data, natsc.ExpectStream(stream))
+				if err != nil {
+					return count, err
+				}
+				count++
+				for durableName, start := range starts {
+					if _, ok := jsStarts[durableName]; !ok && msg.Sequence >= start {
+						jsStarts[durableName] = ack.Sequence
+					}
+				}
+				cp.LastSeq = msg.Sequence
+				if err := progress.save(); err != nil {
+					return count, err
+				}
+				isDone = msg.Sequence >= channelz.LastSeq
+			case <-time.After(stanWait):
+				return count, fmt.Errorf("%w: read timeout", ErrNATS)
+			}
+		}
+	}
+
+	for _, durableName := range durables {
+		cfg := q.consumerConfig(durableName)
+		if start, ok := jsStarts[durableName]; ok {
+			cfg.DeliverPolicy = natsc.DeliverByStartSequencePolicy
+			cfg.OptStartSeq = start
+		}
+		_ = q.js.DeleteConsumer(stream, cfg.Durable)
+		if _, err := q.js.AddConsumer(stream, cfg); err != nil {
+			return count, err
+		}
+	}
+	cp.Done = true
+	return count, progress.save()
+}
+
+// loadMigrateProgress reads the progress of migration if exists
+func loadMigrateProgress(path string) (*migrateProgress, error) {
+	progress := &migrateProgress{path: path, Channels: make(map[string]*channelProgress)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, progress); err != nil {
+		return nil, fmt.Errorf("%w: could not read migration progress: %v", ErrNATS, err)
+	}
+	if progress.Channels == nil {
+		progress.Channels = make(map[string]*channelProgress)
+	}
+	return progress, nil
+}
+
+// channel returns the progress of channel
+func (p *migrateProgress) channel(name string) *channelProgress {
+	cp, ok := p.Channels[name]
+	if !ok {
+		cp = new(channelProgress)
+		p.Channels[name] = cp
+	}
+	if cp.Starts == nil {
+		cp.Starts = make(map[string]uint64)
+	}
+	return cp
+}
+
+// save writes the progress replacing the file at once
+func (p *migrateProgress) save() error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// firstPending returns the sequence of the first unacknowledged message of durable
+// returns 0 if there are no pending messages
+// the subscription is closed without unsubscribe to keep the durable untouched
+func firstPending(conn stan.Conn, subject, durableName string) (uint64, error) {
+	seqs := make(chan uint64, 1)
+	subscription, err := conn.Subscribe(subject, func(msg *stan.Msg) {
+		select {
+		case seqs <- msg.Sequence:
+		default:
+		}
+	},
+		stan.DurableName(durableName),
+		stan.SetManualAckMode(),
+		stan.MaxInflight(1),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = subscription.Close() }()
+
+	select {
+	case seq := <-seqs:
+		return seq, nil
+	case <-time.After(stanWait):
+		return 0, nil
+	}
+}
+
+// getChannelsz returns the channels state with subscriptions from the monitoring handler
+// the handler is invoked in-process so it doesn't require the monitor port
+func getChannelsz(stanServer *stand.StanServer) (*stand.Channelsz, error) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, stand.ChannelsPath+"?subs=1&limit=1024", nil)
+	stanServer.HandleChannelsz(rec, req)
+	if rec.Code != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrNATS, rec.Body.String())
+	}
+	channelsz := new(stand.Channelsz)
+	if err := json.Unmarshal(rec.Body.Bytes(), channelsz); err != nil {
+		return nil, err
+	}
+	return channelsz, nil
+}
+
+// moveSTANStore moves the NATS Streaming file store files into dst directory
+func moveSTANStore(storeDir, dst string) error {
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(storeDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		isSTAN := name == "server.dat" || name == "clients.dat"
+		if entry.IsDir() {
+			_, err := os.Stat(filepath.Join(storeDir, name, "subs.dat"))
+			isSTAN = err == nil
+		}
+		if !isSTAN {
+			continue
+		}
+		if err := os.Rename(filepath.Join(storeDir, name), filepath.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package nats
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	natsd "github.com/nats-io/nats-server/v2/server"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/nats-io/nats-streaming-server/stores"
+	natsc "github.com/nats-io/nats.go"
+	"github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateSTAN(t *testing.T) {
+	storeDir := t.TempDir()
+	prepareSTANStore(t, storeDir)
+
+	assert.NoError(t, StartServer(Config{
+		AckWait:            time.Second * 30,
+		MaxInflight:        100,
+		MaxPubAcksInflight: 100,
+		MaxPayload:         1024 * 1024,
+		StoreDir:           storeDir,
+		StoreType:          "FILE",
+	}))
+	defer StopServer()
+
+	_, err := os.Stat(filepath.Join(storeDir, "server.dat"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(storeDir, stanMigratingDir))
+	assert.True(t, os.IsNotExist(err))
+	archived, _ := filepath.Glob(filepath.Join(storeDir, stanMigratedDir, "*", "server.dat"))
+	assert.Len(t, archived, 1)
+
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	assert.NoError(t, StartDispatcher([]DispatcherOption{{
+		DurableName: "#test#host.example#",
+		Subject:     "test",
+		Handler: func(b []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered = append(delivered, string(b))
+			return nil
+		},
+	}}))
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered) == 2
+	}, time.Second*5, time.Millisecond*100)
+	assert.Equal(t, []string{"msg-3", "msg-4"}, delivered)
+}
+
+func TestMigrateSTAN_resume(t *testing.T) {
+	storeDir := t.TempDir()
+	prepareSTANStore(t, storeDir)
+	cfg := Config{
+		AckWait:            time.Second * 30,
+		MaxInflight:        100,
+		MaxPubAcksInflight: 100,
+		MaxPayload:         1024 * 1024,
+		StoreDir:           storeDir,
+		StoreType:          "FILE",
+	}
+
+	/* fail on copying the second pending message */
+	publish := migratePublish
+	defer func() { migratePublish = publish }()
+	migratePublish = func(js natsc.JetStreamContext, subject string, data []byte, opts ...natsc.PubOpt) (*natsc.PubAck, error) {
+		if string(data) == "msg-4" {
+			return nil, fmt.Errorf("%w: test failure", ErrNATS)
+		}
+		return publish(js, subject, data, opts...)
+	}
+	assert.NoError(t, StartServer(cfg))
+	StopServer()
+	_, err := os.Stat(filepath.Join(storeDir, stanMigratingDir, stanProgressFile))
+	assert.NoError(t, err)
+
+	migratePublish = publish
+	assert.NoError(t, StartServer(cfg))
+	defer StopServer()
+	_, err = os.Stat(filepath.Join(storeDir, stanMigratingDir))
+	assert.True(t, os.IsNotExist(err))
+
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	assert.NoError(t, StartDispatcher([]DispatcherOption{{
+		DurableName: "#test#host.example#",
+		Subject:     "test",
+		Handler: func(b []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered = append(delivered, string(b))
+			return nil
+		},
+	}}))
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered) == 2
+	}, time.Second*5, time.Millisecond*100)
+	time.Sleep(time.Millisecond * 200)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"msg-3", "msg-4"}, delivered)
+}
+
+// prepareSTANStore creates the store with durable that acknowledged first two messages of four
+func prepareSTANStore(t *testing.T, storeDir string) {
+	natsOpts := stand.DefaultNatsServerOptions.Clone()
+	natsOpts.Port = natsd.RANDOM_PORT
+	stanOpts := stand.GetDefaultOptions().Clone()
+	stanOpts.ID = clusterID
+	stanOpts.StoreType = stores.TypeFile
+	stanOpts.FilestoreDir = storeDir
+	stanServer, err := stand.RunServerWithOpts(stanOpts, natsOpts)
+	assert.NoError(t, err)
+	defer stanServer.Shutdown()
+
+	conn, err := stan.Connect(clusterID, dispatcherID, stan.NatsURL(stanServer.ClientURL()))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	acked := make(chan struct{}, 2)
+	subscription, err := conn.Subscribe("test", func(msg *stan.Msg) {
+		if msg.Sequence <= 2 {
+			_ = msg.Ack()
+			acked <- struct{}{}
+		}
+	},
+		stan.DurableName("#test#host.example#"),
+		stan.SetManualAckMode(),
+		stan.MaxInflight(1),
+		stan.DeliverAllAvailable(),
+	)
+	assert.NoError(t, err)
+
+	for _, msg := range []string{"msg-1", "msg-2", "msg-3", "msg-4"} {
+		assert.NoError(t, conn.Publish("test", []byte(msg)))
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-acked:
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+	assert.NoError(t, subscription.Close())
+}
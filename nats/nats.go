@@ -1,15 +1,13 @@
 package nats
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
-	natsd "github.com/nats-io/nats-server/v2/server"
-	stand "github.com/nats-io/nats-streaming-server/server"
-	"github.com/nats-io/nats-streaming-server/stores"
-	"github.com/nats-io/stan.go"
-	"github.com/rs/zerolog"
+	"github.com/gwos/tcg/config"
 	"github.com/rs/zerolog/log"
 )
 
@@ -17,7 +15,6 @@ import (
 const (
 	clusterID    = "tcg-cluster"
 	dispatcherID = "tcg-dispatcher"
-	publisherID  = "tcg-publisher"
 )
 
 var (
@@ -30,29 +27,28 @@ var (
 type state struct {
 	sync.Mutex
 
-	config     Config
-	stanServer *stand.StanServer
-	// if a client is too slow the server will eventually cut them off by closing the connection
-	connDispatcher stan.Conn
-	connPublisher  stan.Conn
+	config Config
+	queue  Queue
 }
 
 // Config defines NATS configurable options
 type Config struct {
-	AckWait             time.Duration
-	MaxInflight         int
-	MaxPubAcksInflight  int
-	MaxPayload          int32
-	MaxPendingBytes     int
-	MaxPendingMsgs      int
-	MonitorPort         int
-	StoreDir            string
-	StoreType           string
-	StoreMaxAge         time.Duration
-	StoreMaxBytes       int64
-	StoreMaxMsgs        int
+	AckWait            time.Duration
+	MaxInflight        int
+	MaxPubAcksInflight int
+	MaxPayload         int32
+	MonitorPort        int
+	// Backend accepts "NATS"|"LOCAL", defaults to "NATS"
+	Backend       string
+	StoreDir      string
+	StoreType     string
+	StoreMaxAge   time.Duration
+	StoreMaxBytes int64
+	StoreMaxMsgs  int
+	// StoreBufferSize and StoreReadBufferSize are used by migration from the NATS Streaming file store
 	StoreBufferSize     int
 	StoreReadBufferSize int
+	Retry               config.RetryConfig
 }
 
 // DispatcherOption defines subscription
@@ -62,78 +58,58 @@ type DispatcherOption struct {
 	Handler     func([]byte) error
 }
 
-// StartServer runs NATS
+// StartServer runs the queue backend
 func StartServer(config Config) error {
-	natsOpts := stand.DefaultNatsServerOptions.Clone()
-	natsOpts.MaxPayload = config.MaxPayload
-	natsOpts.HTTPHost = "0.0.0.0"
-	natsOpts.HTTPPort = config.MonitorPort
-	natsOpts.Port = natsd.DEFAULT_PORT
-
-	stanOpts := stand.GetDefaultOptions().Clone()
-	stanOpts.ID = clusterID
-	stanOpts.FilestoreDir = config.StoreDir
-	switch config.StoreType {
-	case "MEMORY":
-		stanOpts.StoreType = stores.TypeMemory
-	case "FILE":
-		stanOpts.StoreType = stores.TypeFile
-	default:
-		stanOpts.StoreType = stores.TypeFile
-	}
-	stanOpts.StoreLimits.MaxAge = config.StoreMaxAge
-	stanOpts.StoreLimits.MaxBytes = config.StoreMaxBytes
-	stanOpts.StoreLimits.MaxMsgs = config.StoreMaxMsgs
-	stanOpts.FileStoreOpts.BufferSize = config.StoreBufferSize
-	stanOpts.FileStoreOpts.ReadBufferSize = config.StoreReadBufferSize
-
 	s.Lock()
 	defer s.Unlock()
 
 	s.config = config
-	if s.stanServer == nil {
-		if stanServer, err := stand.RunServerWithOpts(stanOpts, natsOpts); err == nil {
-			s.stanServer = stanServer
-			log.Info().
-				Func(func(e *zerolog.Event) {
-					if zerolog.GlobalLevel() <= zerolog.DebugLevel {
-						e.Interface("stanOpts", stanOpts).
-							Interface("natsOpts", natsOpts)
-					}
-				}).
-				Msgf("nats started at: %s", s.stanServer.ClientURL())
-		} else {
-			log.Warn().
-				Err(err).
-				Interface("stanOpts", stanOpts).
-				Interface("natsOpts", natsOpts).
-				Msg("nats RunServerWithOpts failed")
-			return err
-		}
+	if s.queue != nil {
+		return nil
+	}
+
+	var (
+		queue Queue
+		err   error
+	)
+	switch config.Backend {
+	case BackendLocal:
+		queue, err = openLocalQueue(config)
+	case BackendNATS, "":
+		queue, err = startNatsQueue(config)
+	default:
+		err = fmt.Errorf("%w: unknown backend: %s", ErrNATS, config.Backend)
+		log.Warn().Err(err).Msg("nats failed")
 	}
+	if err != nil {
+		return err
+	}
+	s.queue = queue
 	return nil
 }
 
-// StopServer shutdowns NATS
+// StopServer stops the queue backend
 func StopServer() {
+	_ = StopDispatcher()
+
 	s.Lock()
 	defer s.Unlock()
 
-	if s.connDispatcher != nil {
-		_ = s.connDispatcher.Close()
-		s.connDispatcher = nil
-	}
-	if s.connPublisher != nil {
-		_ = s.connPublisher.Close()
-		s.connPublisher = nil
-	}
-	if s.stanServer != nil {
-		s.stanServer.Shutdown()
-		s.stanServer = nil
+	if s.queue != nil {
+		s.queue.Close()
+		s.queue = nil
 	}
 }
 
-// StartDispatcher connects to stan and adds durable subscriptions
+// SetRetryConfig applies the retry policy of dispatcher
+// the planned retries keep their delays
+func SetRetryConfig(retry config.RetryConfig) {
+	s.Lock()
+	defer s.Unlock()
+	s.config.Retry = retry
+}
+
+// StartDispatcher adds durables and runs delivering
 func StartDispatcher(options []DispatcherOption) error {
 	if err := StopDispatcher(); err != nil {
 		return err
@@ -142,56 +118,122 @@ func StartDispatcher(options []DispatcherOption) error {
 	d.Lock()
 	defer d.Unlock()
 
-	if d.connDispatcher == nil {
-		if d.stanServer == nil {
-			err := fmt.Errorf("%v: unavailable", ErrNATS)
-			log.Warn().Err(err).Msg("nats dispatcher failed")
-			return err
-		}
-		var err error
-		if d.connDispatcher, err = stan.Connect(
-			clusterID,
-			dispatcherID,
-			stan.NatsURL(d.stanServer.ClientURL()),
-			stan.SetConnectionLostHandler(func(c stan.Conn, e error) {
-				log.Warn().Err(e).Msg("nats dispatcher invoked ConnectionLostHandler")
-				d.Lock()
-				_ = c.Close()
-				d.connDispatcher = nil
-				d.Unlock()
-				StartDispatcher(options)
-			}),
-		); err != nil {
-			log.Warn().Err(err).Msg("nats dispatcher failed to connect")
-			return err
-		}
+	if d.queue == nil {
+		err := fmt.Errorf("%v: unavailable", ErrNATS)
+		log.Warn().Err(err).Msg("nats dispatcher failed")
+		return err
 	}
 
-	d.durables.Flush()
+	d.options = make(map[string]DispatcherOption, len(options))
 	for _, opt := range options {
-		log.Debug().Msgf("Processing Durable: %s", opt.DurableName)
-		if err := d.retryDurable(opt); err != nil {
-			return err
-		}
+		d.options[opt.DurableName] = opt
+	}
+	subscriptions, err := d.subscribe()
+	if err != nil {
+		return err
 	}
+	d.run(subscriptions)
 	return nil
 }
 
 // StopDispatcher ends dispatching
 func StopDispatcher() error {
 	d := getDispatcher()
+	d.stop()
+
 	d.Lock()
 	defer d.Unlock()
+	d.retryes.Flush()
+	return nil
+}
 
-	var err error
-	if d.connDispatcher != nil {
-		err = d.connDispatcher.Close()
-		d.connDispatcher = nil
+// BreakerStates returns the circuit breaker states of durables
+func BreakerStates() []BreakerState {
+	d := getDispatcher()
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.isRunning() {
+		return nil
 	}
-	d.durables.Flush()
-	d.msgsDone.Flush()
-	d.retryes.Flush()
-	return err
+	return d.breakerStates()
+}
+
+// DispatcherCounters describes the cumulative counters of durable
+// Retries counts the planned retries, DeadLetters counts the messages moved to dead letters
+type DispatcherCounters struct {
+	DurableName string
+	Retries     uint64
+	DeadLetters uint64
+}
+
+// Counters returns the dispatcher counters of durables ordered by name
+func Counters() []DispatcherCounters {
+	d := getDispatcher()
+	d.countersMu.Lock()
+	defer d.countersMu.Unlock()
+
+	counters := make([]DispatcherCounters, 0, len(d.counters))
+	for _, c := range d.counters {
+		counters = append(counters, *c)
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		return counters[i].DurableName < counters[j].DurableName
+	})
+	return counters
+}
+
+// readBatchSize limits the messages read at once on scanning the subject
+const readBatchSize = 256
+
+// Drain stops the dispatcher fetching and waits for the in-flight messages to be handled until the context is done
+// returns the state of dispatched durables with messages left not delivered or not acknowledged,
+// the backlog is not waited and stays queued for the next start
+func Drain(ctx context.Context) ([]DurableStats, error) {
+	d := getDispatcher()
+	d.Lock()
+	cancel := d.cancel
+	d.cancel = nil
+	d.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		res, err := undelivered()
+		return res, err
+	case <-ctx.Done():
+		res, _ := undelivered()
+		return res, ctx.Err()
+	}
+}
+
+// undelivered returns the state of dispatched durables with messages pending or not acknowledged
+func undelivered() ([]DurableStats, error) {
+	d := getDispatcher()
+	d.Lock()
+	defer d.Unlock()
+
+	if d.queue == nil {
+		return nil, fmt.Errorf("%v: unavailable", ErrNATS)
+	}
+	stats, err := d.queue.Stats()
+	if err != nil {
+		return nil, err
+	}
+	var res []DurableStats
+	for _, ds := range stats.Durables {
+		if _, ok := d.options[ds.DurableName]; ok && (ds.NumPending > 0 || ds.NumAckPending > 0) {
+			res = append(res, ds)
+		}
+	}
+	return res, nil
 }
 
 // Publish adds message in queue
@@ -199,29 +241,42 @@ func Publish(subject string, msg []byte) error {
 	s.Lock()
 	defer s.Unlock()
 
-	if s.connPublisher == nil {
-		if s.stanServer == nil {
-			err := fmt.Errorf("%v: unavailable", ErrNATS)
-			log.Warn().Err(err).Msg("nats publisher failed")
-			return err
-		}
-		var err error
-		if s.connPublisher, err = stan.Connect(
-			clusterID,
-			publisherID,
-			stan.NatsURL(s.stanServer.ClientURL()),
-			stan.MaxPubAcksInflight(s.config.MaxPubAcksInflight),
-			stan.SetConnectionLostHandler(func(c stan.Conn, e error) {
-				log.Warn().Err(e).Msg("nats publisher invoked ConnectionLostHandler")
-				s.Lock()
-				_ = c.Close()
-				s.connPublisher = nil
-				s.Unlock()
-			}),
-		); err != nil {
-			log.Warn().Err(err).Msg("nats publisher failed to connect")
-			return err
-		}
+	if s.queue == nil {
+		err := fmt.Errorf("%v: unavailable", ErrNATS)
+		log.Warn().Err(err).Msg("nats publisher failed")
+		return err
+	}
+	return s.queue.Publish(subject, msg)
+}
+
+// Stats returns the state of subjects and durables
+func Stats() (QueueStats, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.queue == nil {
+		return QueueStats{}, fmt.Errorf("%v: unavailable", ErrNATS)
+	}
+	return s.queue.Stats()
+}
+
+// PeekMsgs returns up to limit first messages of subject
+func PeekMsgs(subject string, limit int) ([]*Msg, error) {
+	q, err := getQueue()
+	if err != nil {
+		return nil, err
+	}
+	return q.Msgs(subject, 0, limit)
+}
+
+// getQueue returns the queue releasing the state lock
+// so the long reads don't block the publishers
+func getQueue() (Queue, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.queue == nil {
+		return nil, fmt.Errorf("%v: unavailable", ErrNATS)
 	}
-	return s.connPublisher.Publish(subject, msg)
+	return s.queue, nil
 }
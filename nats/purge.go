@@ -0,0 +1,122 @@
+package nats
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PurgeFilter selects messages to purge, empty fields match any
+// Before selects messages published before the time
+// Match selects messages by content
+type PurgeFilter struct {
+	Before time.Time
+	Match  func(*Msg) bool
+}
+
+// PurgeMsgs removes messages of subject selected by filter
+// returns the number of removed messages
+func PurgeMsgs(subject string, filter PurgeFilter) (uint64, error) {
+	q, err := getQueue()
+	if err != nil {
+		return 0, err
+	}
+	if filter.Match == nil && filter.Before.IsZero() {
+		return q.Purge(subject, 0)
+	}
+
+	var removed, keepSeq, lastSeq uint64
+	for seq := uint64(0); keepSeq == 0; {
+		msgs, err := q.Msgs(subject, seq, readBatchSize)
+		if err != nil {
+			return removed, err
+		}
+		for _, msg := range msgs {
+			/* the messages are kept in order of publishing */
+			if !filter.Before.IsZero() && !msg.Timestamp.Before(filter.Before) {
+				keepSeq = msg.Sequence
+				break
+			}
+			lastSeq = msg.Sequence
+			if filter.Match != nil && filter.Match(msg) {
+				if err := q.DeleteMsg(subject, msg.Sequence); err != nil {
+					return removed, err
+				}
+				removed++
+			}
+		}
+		if len(msgs) < readBatchSize {
+			break
+		}
+		seq = msgs[len(msgs)-1].Sequence + 1
+	}
+	if filter.Match == nil {
+		/* purge up to the first kept message as the stream can have gaps,
+		the messages published after the scan are kept too */
+		if keepSeq == 0 {
+			if lastSeq == 0 {
+				return 0, nil
+			}
+			keepSeq = lastSeq + 1
+		}
+		return q.Purge(subject, keepSeq)
+	}
+	return removed, nil
+}
+
+// ResetDurable moves the durable to start with the sequence
+// zero sequence means new messages only
+// the workers of running dispatcher are restarted keeping the retry states of other durables
+// returns the number of messages skipped by durable
+func ResetDurable(durableName string, startSeq uint64) (uint64, error) {
+	d := getDispatcher()
+	d.Lock()
+	if d.queue == nil {
+		d.Unlock()
+		return 0, fmt.Errorf("%v: unavailable", ErrNATS)
+	}
+	before, ok, err := durableStats(d.queue, durableName)
+	isRunning := d.isRunning()
+	d.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("%w: unknown durable: %s", ErrDispatcher, durableName)
+	}
+
+	if isRunning {
+		d.stop()
+	}
+	d.Lock()
+	defer d.Unlock()
+
+	err = d.queue.ResetDurable(before.Subject, durableName, startSeq)
+	d.retryes.Delete(durableName)
+	if isRunning {
+		subscriptions, err := d.subscribe()
+		if err != nil {
+			return 0, err
+		}
+		d.run(subscriptions)
+	}
+	if err != nil {
+		return 0, err
+	}
+	after, _, err := durableStats(d.queue, durableName)
+	if err != nil {
+		return 0, err
+	}
+
+	var skipped uint64
+	pending := before.NumPending + uint64(before.NumAckPending)
+	if pendingAfter := after.NumPending + uint64(after.NumAckPending); pending > pendingAfter {
+		skipped = pending - pendingAfter
+	}
+	log.Info().Str("durableName", durableName).
+		Uint64("startSeq", startSeq).
+		Uint64("skipped", skipped).
+		Msg("nats reset durable")
+	return skipped, nil
+}
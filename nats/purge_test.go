@@ -0,0 +1,192 @@
+package nats
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurgeMsgs(t *testing.T) {
+	assert.NoError(t, StartServer(Config{
+		MaxInflight: 100,
+		Backend:     BackendLocal,
+		StoreType:   "MEMORY",
+	}))
+	defer StopServer()
+
+	for _, msg := range []string{"a-1", "b-2", "a-3"} {
+		assert.NoError(t, Publish("test", []byte(msg)))
+	}
+	before := time.Now()
+	for _, msg := range []string{"b-4", "a-5"} {
+		assert.NoError(t, Publish("test", []byte(msg)))
+	}
+
+	removed, err := PurgeMsgs("test", PurgeFilter{
+		Before: before,
+		Match:  func(msg *Msg) bool { return bytes.HasPrefix(msg.Data, []byte("a-")) },
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), removed)
+	removed, err = PurgeMsgs("test", PurgeFilter{Before: before})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), removed)
+
+	msgs, err := PeekMsgs("test", 10)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, "b-4", string(msgs[0].Data))
+
+	removed, err = PurgeMsgs("test", PurgeFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), removed)
+}
+
+// publishOnScan publishes the message once the scan reached the end of subject
+type publishOnScan struct {
+	Queue
+	data []byte
+}
+
+func (q *publishOnScan) Msgs(subject string, startSeq uint64, limit int) ([]*Msg, error) {
+	msgs, err := q.Queue.Msgs(subject, startSeq, limit)
+	if err == nil && len(msgs) < limit && q.data != nil {
+		err = q.Queue.Publish(subject, q.data)
+		q.data = nil
+	}
+	return msgs, err
+}
+
+func TestPurgeMsgs_publishedAfterScan(t *testing.T) {
+	assert.NoError(t, StartServer(Config{
+		MaxInflight: 100,
+		Backend:     BackendLocal,
+		StoreType:   "MEMORY",
+	}))
+	defer StopServer()
+
+	for _, msg := range []string{"old-1", "old-2"} {
+		assert.NoError(t, Publish("test", []byte(msg)))
+	}
+	before := time.Now()
+
+	s.Lock()
+	s.queue = &publishOnScan{Queue: s.queue, data: []byte("new-3")}
+	s.Unlock()
+
+	removed, err := PurgeMsgs("test", PurgeFilter{Before: before})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), removed)
+
+	msgs, err := PeekMsgs("test", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, "new-3", string(msgs[0].Data))
+	}
+
+	removed, err = PurgeMsgs("empty", PurgeFilter{Before: before})
+	assert.NoError(t, err)
+	assert.Zero(t, removed)
+}
+
+func TestResetDurable(t *testing.T) {
+	assert.NoError(t, StartServer(Config{
+		AckWait:     time.Second * 30,
+		MaxInflight: 100,
+		Backend:     BackendLocal,
+		StoreType:   "MEMORY",
+	}))
+	defer StopServer()
+
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	options := []DispatcherOption{{
+		DurableName: "#test#",
+		Subject:     "test",
+		Handler: func(b []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered = append(delivered, string(b))
+			return nil
+		},
+	}}
+	waitDelivered := func(expected ...string) {
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(delivered) == len(expected)
+		}, time.Second*5, time.Millisecond*50)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, expected, delivered)
+		delivered = nil
+	}
+
+	assert.NoError(t, StartDispatcher(options))
+	assert.NoError(t, Publish("test", []byte("msg-1")))
+	waitDelivered("msg-1")
+	assert.NoError(t, StopDispatcher())
+	assert.NoError(t, Publish("test", []byte("msg-2")))
+	assert.NoError(t, Publish("test", []byte("msg-3")))
+
+	/* skip pending messages */
+	skipped, err := ResetDurable("#test#", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), skipped)
+	assert.NoError(t, StartDispatcher(options))
+	assert.NoError(t, Publish("test", []byte("msg-4")))
+	waitDelivered("msg-4")
+
+	/* rewind running durable */
+	skipped, err = ResetDurable("#test#", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), skipped)
+	waitDelivered("msg-2", "msg-3", "msg-4")
+
+	_, err = ResetDurable("#unknown#", 0)
+	assert.ErrorIs(t, err, ErrDispatcher)
+	assert.NoError(t, StopDispatcher())
+}
+
+func TestQueueMsgs(t *testing.T) {
+	for _, backend := range []string{BackendNATS, BackendLocal} {
+		t.Run(backend, func(t *testing.T) {
+			assert.NoError(t, StartServer(Config{
+				AckWait:            time.Second * 30,
+				MaxInflight:        100,
+				MaxPubAcksInflight: 100,
+				MaxPayload:         1024 * 1024,
+				Backend:            backend,
+				StoreType:          "MEMORY",
+			}))
+			defer StopServer()
+
+			for _, msg := range []string{"msg-1", "msg-2", "msg-3", "msg-4"} {
+				assert.NoError(t, Publish("test", []byte(msg)))
+			}
+			q, err := getQueue()
+			assert.NoError(t, err)
+			assert.NoError(t, q.DeleteMsg("test", 2))
+
+			msgs, err := q.Msgs("test", 0, 2)
+			assert.NoError(t, err)
+			assert.Len(t, msgs, 2)
+			assert.Equal(t, []uint64{1, 3}, []uint64{msgs[0].Sequence, msgs[1].Sequence})
+			assert.Equal(t, "msg-3", string(msgs[1].Data))
+
+			msgs, err = q.Msgs("test", 4, 10)
+			assert.NoError(t, err)
+			assert.Len(t, msgs, 1)
+			assert.Equal(t, "msg-4", string(msgs[0].Data))
+
+			msgs, err = q.Msgs("unknown", 0, 10)
+			assert.NoError(t, err)
+			assert.Empty(t, msgs)
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Define queue backends
+// the NATS backend runs the embedded NATS server with JetStream
+// the LOCAL backend runs the in-process queue without listening ports
+const (
+	BackendNATS  = "NATS"
+	BackendLocal = "LOCAL"
+)
+
+var ErrMsgNotFound = fmt.Errorf("%w: message not found", ErrNATS)
+
+// Queue defines the backend of persistent queue
+// the messages are kept per subject and delivered to durables in order
+type Queue interface {
+	// Publish adds the message for subject
+	Publish(subject string, data []byte) error
+	// Subscribe binds to the durable of subject
+	// the absent durable is added starting with the last message
+	Subscribe(subject, durableName string) (Subscription, error)
+	// GetMsg returns the message of subject by sequence
+	// returns ErrMsgNotFound for removed message
+	GetMsg(subject string, seq uint64) (*Msg, error)
+	// Msgs returns up to limit messages of subject in order starting with the sequence
+	// the removed messages are skipped, zero sequence means the first message
+	Msgs(subject string, startSeq uint64, limit int) ([]*Msg, error)
+	// DeleteMsg removes the message of subject by sequence
+	DeleteMsg(subject string, seq uint64) error
+	// Purge removes messages of subject with sequence less than upToSeq, all for zero
+	// returns the number of removed messages
+	Purge(subject string, upToSeq uint64) (uint64, error)
+	// ResetDurable moves the durable of subject to start with the sequence
+	// zero sequence means new messages only, the absent durable is added
+	ResetDurable(subject, durableName string, startSeq uint64) error
+	// Stats returns the state of subjects and durables
+	Stats() (QueueStats, error)
+	// Close stops the backend
+	Close()
+}
+
+// Subscription defines the pull subscription of durable
+type Subscription interface {
+	// Fetch returns up to batch messages waiting them until the context is done
+	// returns no messages and no error if nothing arrived in time
+	Fetch(ctx context.Context, batch int) ([]*Msg, error)
+	// Ack acknowledges the message
+	Ack(msg *Msg) error
+	// Nak makes the message available for redelivery
+	Nak(msg *Msg) error
+	// Close unbinds from the durable keeping its state
+	Close() error
+}
+
+// Msg describes the queued message
+type Msg struct {
+	Subject   string
+	Sequence  uint64
+	Timestamp time.Time
+	Data      []byte
+
+	// raw keeps the message of backend
+	raw interface{}
+}
+
+// QueueStats describes the state of queue
+type QueueStats struct {
+	Subjects []SubjectStats `json:"subjects"`
+	Durables []DurableStats `json:"durables"`
+}
+
+// SubjectStats describes the messages kept for subject
+type SubjectStats struct {
+	Subject   string    `json:"subject"`
+	Msgs      uint64    `json:"msgs"`
+	Bytes     uint64    `json:"bytes"`
+	FirstSeq  uint64    `json:"firstSeq"`
+	LastSeq   uint64    `json:"lastSeq"`
+	FirstTime time.Time `json:"firstTime"`
+}
+
+// DurableStats describes the delivery state of durable
+// NumPending counts messages not delivered yet
+// NumAckPending counts messages delivered and not acknowledged
+type DurableStats struct {
+	DurableName    string `json:"durableName"`
+	Subject        string `json:"subject"`
+	NumPending     uint64 `json:"numPending"`
+	NumAckPending  int    `json:"numAckPending"`
+	NumRedelivered int    `json:"numRedelivered"`
+}
+
+// durableStats returns the state of durable
+// returns false for unknown durable
+func durableStats(q Queue, durableName string) (DurableStats, bool, error) {
+	stats, err := q.Stats()
+	if err != nil {
+		return DurableStats{}, false, err
+	}
+	for _, dur := range stats.Durables {
+		if dur.DurableName == durableName {
+			return dur, true, nil
+		}
+	}
+	return DurableStats{}, false, nil
+}
@@ -0,0 +1,19 @@
+package nats
+
+import "time"
+
+// Define circuit breaker states of durable
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BreakerState describes the circuit breaker of durable
+type BreakerState struct {
+	DurableName string    `json:"durableName"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+	RetryAt     time.Time `json:"retryAt,omitempty"`
+}
@@ -108,8 +108,13 @@ func (client *GWClient) Connect() error {
 		/* token already changed */
 		return nil
 	}
+	password, err := ResolveSecret(client.GWConnection.Password)
+	if err != nil {
+		logper.Warn(map[string]interface{}{"error": err, "url": client.uriConnect}, "could not resolve groundwork password")
+		return fmt.Errorf("%w: %v", tcgerr.ErrUnauthorized, err)
+	}
 	if client.LocalConnection {
-		token, err := client.connectLocal()
+		token, err := client.connectLocal(password)
 		if err == nil {
 			client.token = token
 		}
@@ -117,18 +122,18 @@ func (client *GWClient) Connect() error {
 	}
 	token, err := client.AuthenticatePassword(
 		client.GWConnection.UserName,
-		client.GWConnection.Password)
+		password)
 	if err == nil {
 		client.token = token
 	}
 	return err
 }
 
-func (client *GWClient) connectLocal() (string, error) {
+func (client *GWClient) connectLocal(password string) (string, error) {
 	formValues := map[string]string{
 		"gwos-app-name": client.AppName,
 		"user":          client.GWConnection.UserName,
-		"password":      client.GWConnection.Password,
+		"password":      password,
 	}
 	headers := map[string]string{
 		"Accept":       "text/plain",
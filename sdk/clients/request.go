@@ -22,6 +22,12 @@ var HookRequestContext = func(ctx context.Context, req *http.Request) (context.C
 	return ctx, req
 }
 
+// ResolveSecret resolves the credential value on connect
+// returns value as is by default, the agent hooks the references like "env:NAME"
+var ResolveSecret = func(value string) (string, error) {
+	return value, nil
+}
+
 var GZIP = func(ctx context.Context, p []byte) (context.Context, []byte, error) {
 	buf := &bytes.Buffer{}
 	gw := gzip.NewWriter(buf)
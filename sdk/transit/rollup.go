@@ -0,0 +1,144 @@
+package transit
+
+import "sync/atomic"
+
+// Define rollup modes of host status
+// RollupWorstService takes the worst status of services
+// RollupMajority takes the status of most services, the ties are resolved to the worst one
+// RollupReachability takes the host down if the named reachability service is critical
+const (
+	RollupWorstService = "worst-service"
+	RollupMajority     = "majority"
+	RollupReachability = "reachability"
+)
+
+// RollupPolicy defines how the host status is calculated from its services
+// IgnoreUnknown skips the services in unknown status
+type RollupPolicy struct {
+	Mode                string `json:"mode"`
+	ReachabilityService string `json:"reachabilityService,omitempty"`
+	IgnoreUnknown       bool   `json:"ignoreUnknown,omitempty"`
+}
+
+// DefaultRollupPolicy defines the policy used if the configured one is invalid
+var DefaultRollupPolicy = RollupPolicy{Mode: RollupWorstService}
+
+// resourceRollupPolicy keeps the *RollupPolicy used by CalculateResourceStatus
+// it is set on connector config while the collectors read it
+var resourceRollupPolicy atomic.Value
+
+// SetResourceRollupPolicy sets the policy used by CalculateResourceStatus
+// could be overridden per connector with MonitorConnection extensions
+// the nil policy keeps the hosts up regardless of services
+func SetResourceRollupPolicy(p *RollupPolicy) {
+	resourceRollupPolicy.Store(p)
+}
+
+// GetResourceRollupPolicy returns the policy used by CalculateResourceStatus
+// returns nil if not configured
+func GetResourceRollupPolicy() *RollupPolicy {
+	p, _ := resourceRollupPolicy.Load().(*RollupPolicy)
+	return p
+}
+
+// MonitorStatusWeightHost defines weight of Monitor Status for multi-state comparison
+// the weights are equivalent to MonitorStatusWeightService
+var MonitorStatusWeightHost = map[MonitorStatus]int{
+	HostUp:              0,
+	HostPending:         10,
+	HostUnreachable:     20,
+	HostWarning:         30,
+	HostScheduledDown:   50,
+	HostUnscheduledDown: 100,
+}
+
+// hostStatusByService maps the service status to the host status of equivalent weight
+// except the unknown one kept as pending, the unreachable host is reported by the reachability check
+var hostStatusByService = map[MonitorStatus]MonitorStatus{
+	ServiceOk:                  HostUp,
+	ServicePending:             HostPending,
+	ServiceUnknown:             HostPending,
+	ServiceWarning:             HostWarning,
+	ServiceScheduledCritical:   HostScheduledDown,
+	ServiceUnscheduledCritical: HostUnscheduledDown,
+}
+
+// IsValid checks the policy mode is known and has required fields
+func (p RollupPolicy) IsValid() bool {
+	switch p.Mode {
+	case RollupWorstService, RollupMajority:
+		return true
+	case RollupReachability:
+		return p.ReachabilityService != ""
+	}
+	return false
+}
+
+// Calculate returns the host status for services
+// returns HostUp if there are no services to take into account
+func (p RollupPolicy) Calculate(services []MonitoredService) MonitorStatus {
+	switch p.Mode {
+	case RollupMajority:
+		return p.majority(services)
+	case RollupReachability:
+		return p.reachability(services)
+	}
+	return p.worstService(services)
+}
+
+func (p RollupPolicy) worstService(services []MonitoredService) MonitorStatus {
+	status := HostUp
+	for _, svc := range services {
+		if p.skip(svc) {
+			continue
+		}
+		if s := hostStatus(svc.Status); MonitorStatusWeightHost[s] > MonitorStatusWeightHost[status] {
+			status = s
+		}
+	}
+	return status
+}
+
+func (p RollupPolicy) majority(services []MonitoredService) MonitorStatus {
+	counts := make(map[MonitorStatus]int)
+	for _, svc := range services {
+		if !p.skip(svc) {
+			counts[hostStatus(svc.Status)]++
+		}
+	}
+	status, count := HostUp, 0
+	for s, c := range counts {
+		if c > count || (c == count && MonitorStatusWeightHost[s] > MonitorStatusWeightHost[status]) {
+			status, count = s, c
+		}
+	}
+	return status
+}
+
+func (p RollupPolicy) reachability(services []MonitoredService) MonitorStatus {
+	for _, svc := range services {
+		if svc.Name != p.ReachabilityService || p.skip(svc) {
+			continue
+		}
+		switch svc.Status {
+		case ServiceUnscheduledCritical:
+			return HostUnscheduledDown
+		case ServiceScheduledCritical:
+			return HostScheduledDown
+		}
+	}
+	return HostUp
+}
+
+func (p RollupPolicy) skip(svc MonitoredService) bool {
+	return p.IgnoreUnknown && svc.Status == ServiceUnknown
+}
+
+// hostStatus returns the host status equivalent to the service status
+// the unsupported status is treated as unknown
+func hostStatus(status MonitorStatus) MonitorStatus {
+	if s, ok := hostStatusByService[status]; ok {
+		return s
+	}
+	return HostPending
+}
@@ -0,0 +1,80 @@
+package transit
+
+import "testing"
+
+func TestRollupPolicy_Calculate(t *testing.T) {
+	services := func(statuses ...MonitorStatus) []MonitoredService {
+		res := make([]MonitoredService, len(statuses))
+		for i, s := range statuses {
+			res[i].Name = string(s)
+			res[i].Status = s
+		}
+		return res
+	}
+	reachability := RollupPolicy{Mode: RollupReachability, ReachabilityService: "ping"}
+	ping := func(status MonitorStatus) MonitoredService {
+		svc := MonitoredService{}
+		svc.Name, svc.Status = "ping", status
+		return svc
+	}
+
+	for _, tc := range []struct {
+		name     string
+		policy   RollupPolicy
+		services []MonitoredService
+		expect   MonitorStatus
+	}{
+		{"no services", DefaultRollupPolicy, nil, HostUp},
+		{"worst ok", DefaultRollupPolicy, services(ServiceOk, ServiceOk), HostUp},
+		{"worst warning", DefaultRollupPolicy, services(ServiceOk, ServiceWarning, ServicePending), HostWarning},
+		{"worst critical", DefaultRollupPolicy, services(ServiceOk, ServiceUnscheduledCritical, ServiceScheduledCritical), HostUnscheduledDown},
+		{"worst unknown", DefaultRollupPolicy, services(ServiceOk, ServiceUnknown), HostPending},
+		{"worst ignore unknown", RollupPolicy{Mode: RollupWorstService, IgnoreUnknown: true}, services(ServiceOk, ServiceUnknown), HostUp},
+		{"unknown mode", RollupPolicy{Mode: "other"}, services(ServiceWarning), HostWarning},
+		{"majority", RollupPolicy{Mode: RollupMajority}, services(ServiceOk, ServiceOk, ServiceUnscheduledCritical), HostUp},
+		{"majority tie", RollupPolicy{Mode: RollupMajority}, services(ServiceOk, ServiceWarning), HostWarning},
+		{"majority ignore unknown", RollupPolicy{Mode: RollupMajority, IgnoreUnknown: true}, services(ServiceUnknown, ServiceUnknown, ServiceWarning), HostWarning},
+		{"reachability critical", reachability, append(services(ServiceOk), ping(ServiceUnscheduledCritical)), HostUnscheduledDown},
+		{"reachability scheduled", reachability, append(services(ServiceOk), ping(ServiceScheduledCritical)), HostScheduledDown},
+		{"reachability ok", reachability, append(services(ServiceUnscheduledCritical), ping(ServiceOk)), HostUp},
+		{"reachability missing", reachability, services(ServiceUnscheduledCritical), HostUp},
+	} {
+		if status := tc.policy.Calculate(tc.services); status != tc.expect {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expect, status)
+		}
+	}
+}
+
+func TestRollupPolicy_IsValid(t *testing.T) {
+	for _, tc := range []struct {
+		policy RollupPolicy
+		expect bool
+	}{
+		{DefaultRollupPolicy, true},
+		{RollupPolicy{Mode: RollupMajority, IgnoreUnknown: true}, true},
+		{RollupPolicy{Mode: RollupReachability, ReachabilityService: "ping"}, true},
+		{RollupPolicy{Mode: RollupReachability}, false},
+		{RollupPolicy{Mode: "other"}, false},
+		{RollupPolicy{}, false},
+	} {
+		if tc.policy.IsValid() != tc.expect {
+			t.Errorf("%+v: expected valid %v", tc.policy, tc.expect)
+		}
+	}
+}
+
+func TestCalculateResourceStatus(t *testing.T) {
+	defer SetResourceRollupPolicy(nil)
+	services := make([]MonitoredService, 2)
+	services[0].Status = ServiceOk
+	services[1].Status = ServiceUnscheduledCritical
+
+	SetResourceRollupPolicy(nil)
+	if status := CalculateResourceStatus(services); status != HostUp {
+		t.Errorf("not configured: expected %s, got %s", HostUp, status)
+	}
+	SetResourceRollupPolicy(&DefaultRollupPolicy)
+	if status := CalculateResourceStatus(services); status != HostUnscheduledDown {
+		t.Errorf("configured: expected %s, got %s", HostUnscheduledDown, status)
+	}
+}
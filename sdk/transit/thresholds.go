@@ -0,0 +1,175 @@
+package transit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ThresholdRange defines the threshold in Nagios range format
+// https://nagios-plugins.org/doc/guidelines.html#THRESHOLDFORMAT
+//
+//	"10"     alert if value < 0 or > 10
+//	"10:"    alert if value < 10
+//	"~:10"   alert if value > 10
+//	"10:20"  alert if value < 10 or > 20
+//	"@10:20" alert if value >= 10 and <= 20
+//
+// the open ends are kept as infinities
+type ThresholdRange struct {
+	Start  float64
+	End    float64
+	Inside bool
+}
+
+// ParseThresholdRange parses the range in Nagios format
+func ParseThresholdRange(s string) (ThresholdRange, error) {
+	r := ThresholdRange{}
+	str := strings.TrimSpace(s)
+	if strings.HasPrefix(str, "@") {
+		r.Inside = true
+		str = str[1:]
+	}
+	if str == "" {
+		return r, fmt.Errorf("empty threshold range: %q", s)
+	}
+
+	start, end := "0", str
+	if i := strings.Index(str, ":"); i >= 0 {
+		start, end = str[:i], str[i+1:]
+	}
+	var err error
+	switch start {
+	case "~":
+		r.Start = math.Inf(-1)
+	case "":
+		r.Start = 0
+	default:
+		if r.Start, err = strconv.ParseFloat(start, 64); err != nil {
+			return r, fmt.Errorf("invalid threshold range start: %q", s)
+		}
+	}
+	if end == "" {
+		r.End = math.Inf(1)
+	} else if r.End, err = strconv.ParseFloat(end, 64); err != nil {
+		return r, fmt.Errorf("invalid threshold range end: %q", s)
+	}
+	if r.Start > r.End {
+		return r, fmt.Errorf("threshold range start greater than end: %q", s)
+	}
+	return r, nil
+}
+
+// String implements Stringer interface
+// returns the range in Nagios format
+func (r ThresholdRange) String() string {
+	var sb strings.Builder
+	if r.Inside {
+		sb.WriteString("@")
+	}
+	switch {
+	case math.IsInf(r.Start, -1):
+		sb.WriteString("~:")
+	case r.Start != 0 || math.IsInf(r.End, 1):
+		sb.WriteString(strconv.FormatFloat(r.Start, 'f', -1, 64))
+		sb.WriteString(":")
+	}
+	if !math.IsInf(r.End, 1) {
+		sb.WriteString(strconv.FormatFloat(r.End, 'f', -1, 64))
+	}
+	return sb.String()
+}
+
+// Alert returns true if the value raises an alert
+func (r ThresholdRange) Alert(value float64) bool {
+	inside := value >= r.Start && value <= r.End
+	return inside == r.Inside
+}
+
+// IsThresholdRange checks the threshold value is defined in range format
+// only the strings with range markers ":", "@" or "~" are treated as ranges,
+// the other ones keep the legacy handling
+func IsThresholdRange(threshold *TypedValue) bool {
+	return threshold != nil && threshold.ValueType == StringType && threshold.StringValue != nil &&
+		strings.ContainsAny(*threshold.StringValue, ":@~")
+}
+
+// thresholdAlert returns the alert check of threshold value
+// the range keeps the Nagios semantics, see ThresholdRange.Alert,
+// the numeric value keeps the legacy comparison: alert if value >= threshold, the -1 means none
+// returns nil for none
+func thresholdAlert(threshold *TypedValue) (func(float64) bool, error) {
+	if threshold == nil {
+		return nil, nil
+	}
+	if IsThresholdRange(threshold) {
+		r, err := ParseThresholdRange(*threshold.StringValue)
+		if err != nil {
+			return nil, err
+		}
+		return r.Alert, nil
+	}
+	v, ok := threshold.Float()
+	if !ok {
+		return nil, fmt.Errorf("unsupported threshold value type: %s", threshold.ValueType)
+	}
+	if v == -1 {
+		return nil, nil
+	}
+	return func(value float64) bool { return value >= v }, nil
+}
+
+// Float returns the value as float64
+// the Boolean is converted to 0 or 1, the Time to unix seconds,
+// the String is parsed, returns false if not convertible
+func (value TypedValue) Float() (float64, bool) {
+	switch value.ValueType {
+	case IntegerType:
+		if value.IntegerValue != nil {
+			return float64(*value.IntegerValue), true
+		}
+	case DoubleType:
+		if value.DoubleValue != nil {
+			return *value.DoubleValue, true
+		}
+	case BooleanType:
+		if value.BoolValue != nil {
+			if *value.BoolValue {
+				return 1, true
+			}
+			return 0, true
+		}
+	case TimeType:
+		if value.TimeValue != nil {
+			return float64(value.TimeValue.Unix()), true
+		}
+	case StringType:
+		if value.StringValue != nil {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(*value.StringValue), 64); err == nil {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// calculateRangeStatus returns the status for thresholds in range format
+// the numeric threshold mixed with the range one keeps the legacy comparison
+func calculateRangeStatus(value float64, warning, critical *TypedValue) MonitorStatus {
+	criticalAlert, err := thresholdAlert(critical)
+	if err != nil {
+		return ServiceUnknown
+	}
+	warningAlert, err := thresholdAlert(warning)
+	if err != nil {
+		return ServiceUnknown
+	}
+	if criticalAlert != nil && criticalAlert(value) {
+		return ServiceUnscheduledCritical
+	}
+	if warningAlert != nil && warningAlert(value) {
+		return ServiceWarning
+	}
+	return ServiceOk
+}
@@ -0,0 +1,147 @@
+package transit
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseThresholdRange(t *testing.T) {
+	for _, tc := range []struct {
+		input  string
+		expect ThresholdRange
+		format string
+	}{
+		{"10", ThresholdRange{Start: 0, End: 10}, "10"},
+		{"10:", ThresholdRange{Start: 10, End: math.Inf(1)}, "10:"},
+		{"~:5", ThresholdRange{Start: math.Inf(-1), End: 5}, "~:5"},
+		{"10:20", ThresholdRange{Start: 10, End: 20}, "10:20"},
+		{"@10:20", ThresholdRange{Start: 10, End: 20, Inside: true}, "@10:20"},
+		{"-1.5:2.5", ThresholdRange{Start: -1.5, End: 2.5}, "-1.5:2.5"},
+		{"0:10", ThresholdRange{Start: 0, End: 10}, "10"},
+	} {
+		r, err := ParseThresholdRange(tc.input)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.input, err)
+			continue
+		}
+		if r != tc.expect {
+			t.Errorf("%q: expected %+v, got %+v", tc.input, tc.expect, r)
+		}
+		if r.String() != tc.format {
+			t.Errorf("%q: expected format %q, got %q", tc.input, tc.format, r.String())
+		}
+	}
+
+	for _, input := range []string{"", "@", "abc", "20:10", "10:x"} {
+		if _, err := ParseThresholdRange(input); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+func TestThresholdRange_Alert(t *testing.T) {
+	for _, tc := range []struct {
+		r      string
+		value  float64
+		expect bool
+	}{
+		{"10", -1, true},
+		{"10", 5, false},
+		{"10", 11, true},
+		{"10:", 9, true},
+		{"10:", 10, false},
+		{"~:5", -100, false},
+		{"~:5", 6, true},
+		{"10:20", 15, false},
+		{"10:20", 21, true},
+		{"@10:20", 10, true},
+		{"@10:20", 21, false},
+	} {
+		r, err := ParseThresholdRange(tc.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Alert(tc.value) != tc.expect {
+			t.Errorf("%q %v: expected alert %v", tc.r, tc.value, tc.expect)
+		}
+	}
+}
+
+func TestCalculateStatus(t *testing.T) {
+	for _, tc := range []struct {
+		value             interface{}
+		warning, critical interface{}
+		expect            MonitorStatus
+	}{
+		/* legacy numeric thresholds */
+		{50, 80, 90, ServiceOk},
+		{85, 80, 90, ServiceWarning},
+		{95.0, 80.0, 90.0, ServiceUnscheduledCritical},
+		{15, 20, 10, ServiceWarning},
+		{5, 20, 10, ServiceUnscheduledCritical},
+		{5, -1, -1, ServiceOk},
+		/* range thresholds */
+		{15, "10:20", "5:25", ServiceOk},
+		{22, "10:20", "5:25", ServiceWarning},
+		{30, "10:20", "5:25", ServiceUnscheduledCritical},
+		{3.0, "@~:5", nil, ServiceWarning},
+		{3, nil, "@0:5", ServiceUnscheduledCritical},
+		{15, "10:20", 25, ServiceOk},
+		{26, "10:20", 25, ServiceUnscheduledCritical},
+		/* mixed thresholds keep the legacy comparison for the numeric one */
+		{25, "10:20", 25, ServiceUnscheduledCritical},
+		{-5, "~:20", 25, ServiceOk},
+		{12, 10, "@~:5", ServiceWarning},
+		{3, 10, "@~:5", ServiceUnscheduledCritical},
+		{15, "bad:", nil, ServiceUnknown},
+		/* plain string thresholds keep the legacy handling as 0 */
+		{15, "10", "20", ServiceUnscheduledCritical},
+		{15, "bad", nil, ServiceOk},
+		/* non-numeric values */
+		{"95", 80, 90, ServiceUnscheduledCritical},
+		{true, nil, "@1:1", ServiceUnscheduledCritical},
+		{false, nil, "@1:1", ServiceOk},
+		{"n/a", 80, 90, ServiceUnknown},
+	} {
+		var warning, critical *TypedValue
+		if tc.warning != nil {
+			warning = NewTypedValue(tc.warning)
+		}
+		if tc.critical != nil {
+			critical = NewTypedValue(tc.critical)
+		}
+		if status := CalculateStatus(NewTypedValue(tc.value), warning, critical); status != tc.expect {
+			t.Errorf("%v %v %v: expected %s, got %s", tc.value, tc.warning, tc.critical, tc.expect, status)
+		}
+	}
+
+	ts := &Timestamp{Time: time.Unix(100, 0)}
+	if status := CalculateStatus(&TypedValue{ValueType: TimeType, TimeValue: ts}, NewTypedValue("~:50"), nil); status != ServiceWarning {
+		t.Errorf("time value: expected %s, got %s", ServiceWarning, status)
+	}
+}
+
+func TestCalculateServiceStatus(t *testing.T) {
+	metric := func(value interface{}, warning, critical string) TimeSeries {
+		return TimeSeries{
+			Value: NewTypedValue(value),
+			Thresholds: []ThresholdValue{
+				{SampleType: Warning, Value: NewTypedValue(warning)},
+				{SampleType: Critical, Value: NewTypedValue(critical)},
+			},
+		}
+	}
+	metrics := []TimeSeries{
+		metric(15, "10:20", "5:25"),
+		metric(22, "10:20", "5:25"),
+	}
+	if status, err := CalculateServiceStatus(&metrics); err != nil || status != ServiceWarning {
+		t.Errorf("expected %s, got %s %v", ServiceWarning, status, err)
+	}
+
+	metrics = append(metrics, metric(7, "@5:10", "@6:8"))
+	if status, err := CalculateServiceStatus(&metrics); err != nil || status != ServiceUnscheduledCritical {
+		t.Errorf("expected %s, got %s %v", ServiceUnscheduledCritical, status, err)
+	}
+}
@@ -707,10 +707,12 @@ type AgentIdentity struct {
 	AppType string `json:"appType" yaml:"appType"`
 }
 
+// CalculateResourceStatus returns the host status for services with the resource rollup policy
+// returns HostUp if the policy is not configured, see SetResourceRollupPolicy
 func CalculateResourceStatus(services []MonitoredService) MonitorStatus {
-
-	// TODO: implement logic
-
+	if p := GetResourceRollupPolicy(); p != nil {
+		return p.Calculate(services)
+	}
 	return HostUp
 }
 
@@ -742,10 +744,34 @@ func CalculateServiceStatus(metrics *[]TimeSeries) (MonitorStatus, error) {
 	return previousStatus, nil
 }
 
+// CalculateStatus returns the status of value by thresholds
+// the thresholds may be defined with numbers or with strings in Nagios range format,
+// see ThresholdRange and IsThresholdRange, the other ones keep the legacy comparison:
+// the -1 means none and warning greater than critical means reverse comparison,
+// the numeric threshold mixed with the range one alerts if value >= threshold
+// the String, Boolean and Time values are compared as numbers, see TypedValue.Float,
+// returns ServiceUnknown if the value or range is not convertible
 func CalculateStatus(value *TypedValue, warning *TypedValue, critical *TypedValue) MonitorStatus {
 	if warning == nil && critical == nil {
 		return ServiceOk
 	}
+	if value == nil {
+		return ServiceUnknown
+	}
+	if IsThresholdRange(warning) || IsThresholdRange(critical) {
+		v, ok := value.Float()
+		if !ok {
+			return ServiceUnknown
+		}
+		return calculateRangeStatus(v, warning, critical)
+	}
+	if value.ValueType != IntegerType && value.ValueType != DoubleType {
+		v, ok := value.Float()
+		if !ok {
+			return ServiceUnknown
+		}
+		value = &TypedValue{ValueType: DoubleType, DoubleValue: &v}
+	}
 
 	var warningValue float64
 	var criticalValue float64
@@ -0,0 +1,189 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Define prefixes of secret references
+// PrefixEnv refers to environment variable like "env:GW_PASSWORD"
+// PrefixFile refers to file content like "file:/run/secrets/gw_password"
+// PrefixEnc keeps base64 secretbox blob encrypted with the key from KeyFileEnv
+const (
+	PrefixEnv  = "env:"
+	PrefixFile = "file:"
+	PrefixEnc  = "enc:"
+)
+
+// KeyFileEnv defines environment variable for the key file path used by "enc:" references
+const KeyFileEnv = "TCG_SECRETS_KEYFILE"
+
+// encPattern matches "enc:" references in text
+var encPattern = regexp.MustCompile(regexp.QuoteMeta(PrefixEnc) + `[A-Za-z0-9+/]+=*`)
+
+// IsRef checks the value is a secret reference
+func IsRef(value string) bool {
+	return strings.HasPrefix(value, PrefixEnv) ||
+		strings.HasPrefix(value, PrefixFile) ||
+		strings.HasPrefix(value, PrefixEnc)
+}
+
+// IsLocalRef checks the value refers to the local environment variable or file
+// such references are accepted from the local config only
+func IsLocalRef(value string) bool {
+	return strings.HasPrefix(value, PrefixEnv) ||
+		strings.HasPrefix(value, PrefixFile)
+}
+
+// Check verifies the reference syntax without resolving
+func Check(value string) error {
+	switch {
+	case strings.HasPrefix(value, PrefixEnv) && len(value) == len(PrefixEnv),
+		strings.HasPrefix(value, PrefixFile) && len(value) == len(PrefixFile):
+		return fmt.Errorf("empty secret reference: %s", value)
+	case strings.HasPrefix(value, PrefixEnc):
+		if _, err := base64.StdEncoding.DecodeString(value[len(PrefixEnc):]); err != nil {
+			return fmt.Errorf("invalid encrypted secret: %w", err)
+		}
+	}
+	return nil
+}
+
+// Resolve returns the secret value for reference
+// the plain values are returned as is
+func Resolve(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, PrefixEnv):
+		name := value[len(PrefixEnv):]
+		v, ok := os.LookupEnv(name)
+		if !ok || name == "" {
+			return "", fmt.Errorf("secret environment variable is not set: %s", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, PrefixFile):
+		data, err := os.ReadFile(value[len(PrefixFile):])
+		if err != nil {
+			return "", fmt.Errorf("could not read secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(value, PrefixEnc):
+		key, err := ReadKey(os.Getenv(KeyFileEnv))
+		if err != nil {
+			return "", err
+		}
+		return Open(value, key)
+	}
+	return value, nil
+}
+
+// ReadKey reads the key file, surrounding whitespace is ignored
+func ReadKey(keyFile string) ([]byte, error) {
+	if keyFile == "" {
+		return nil, fmt.Errorf("secrets key file is not defined: set %s", KeyFileEnv)
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read secrets key file: %w", err)
+	}
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) == 0 {
+		return nil, fmt.Errorf("secrets key file is empty: %s", keyFile)
+	}
+	return key, nil
+}
+
+// GenerateKey returns the random key suitable for key file
+func GenerateKey() ([]byte, error) {
+	buf := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(buf)), nil
+}
+
+// Seal returns the "enc:" reference for value
+func Seal(value string, key []byte) (string, error) {
+	encrypted, err := Encrypt([]byte(value), key)
+	if err != nil {
+		return "", err
+	}
+	return PrefixEnc + base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+// Open returns the value of "enc:" reference
+func Open(ref string, key []byte) (string, error) {
+	if !strings.HasPrefix(ref, PrefixEnc) {
+		return "", fmt.Errorf("not encrypted secret")
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(ref[len(PrefixEnc):])
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted secret: %w", err)
+	}
+	decrypted, err := Decrypt(encrypted, key)
+	if err != nil {
+		return "", err
+	}
+	return string(decrypted), nil
+}
+
+// Rotate re-encrypts all "enc:" references found in text with the new key
+// returns the updated text and the number of references
+func Rotate(text []byte, oldKey, newKey []byte) ([]byte, int, error) {
+	var (
+		count int
+		err   error
+	)
+	res := encPattern.ReplaceAllFunc(text, func(ref []byte) []byte {
+		if err != nil {
+			return ref
+		}
+		var value, sealed string
+		if value, err = Open(string(ref), oldKey); err != nil {
+			return ref
+		}
+		if sealed, err = Seal(value, newKey); err != nil {
+			return ref
+		}
+		count++
+		return []byte(sealed)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return res, count, nil
+}
+
+// Decrypt decrypts small messages
+// golang.org/x/crypto/nacl/secretbox
+func Decrypt(message, secret []byte) ([]byte, error) {
+	var nonce [24]byte
+	var secretKey [32]byte = sha256.Sum256(secret)
+	if len(message) < len(nonce) {
+		return nil, fmt.Errorf("decryption error")
+	}
+	copy(nonce[:], message[:24])
+	decrypted, ok := secretbox.Open(nil, message[24:], &nonce, &secretKey)
+	if !ok {
+		return nil, fmt.Errorf("decryption error")
+	}
+	return decrypted, nil
+}
+
+// Encrypt encrypts small messages
+// golang.org/x/crypto/nacl/secretbox
+func Encrypt(message, secret []byte) ([]byte, error) {
+	var nonce [24]byte
+	var secretKey [32]byte = sha256.Sum256(secret)
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], message, &nonce, &secretKey), nil
+}
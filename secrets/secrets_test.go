@@ -0,0 +1,83 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	keyFile := filepath.Join(dir, "key")
+	assert.NoError(t, os.WriteFile(secretFile, []byte("file-secret\n"), 0600))
+	key, err := GenerateKey()
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(keyFile, append(key, '\n'), 0600))
+	ref, err := Seal("enc-secret", key)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(ref, PrefixEnc))
+
+	t.Setenv("TCG_TEST_SECRET", "env-secret")
+	t.Setenv(KeyFileEnv, keyFile)
+
+	for value, expected := range map[string]string{
+		"plain":               "plain",
+		"":                    "",
+		"env:TCG_TEST_SECRET": "env-secret",
+		"file:" + secretFile:  "file-secret",
+		ref:                   "enc-secret",
+	} {
+		actual, err := Resolve(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, actual, value)
+	}
+
+	for _, value := range []string{
+		"env:TCG_TEST_MISSING",
+		"file:" + filepath.Join(dir, "missing"),
+		"enc:bad",
+		"enc:" + strings.Repeat("A", 60),
+	} {
+		_, err := Resolve(value)
+		assert.Error(t, err, value)
+	}
+	assert.Error(t, Check("env:"))
+	assert.Error(t, Check("enc:@@"))
+	assert.NoError(t, Check("plain"))
+
+	t.Setenv(KeyFileEnv, "")
+	_, err = Resolve(ref)
+	assert.Error(t, err)
+}
+
+func TestRotate(t *testing.T) {
+	oldKey, newKey := []byte("old-key"), []byte("new-key")
+	ref1, err := Seal("secret1", oldKey)
+	assert.NoError(t, err)
+	ref2, err := Seal("secret2", oldKey)
+	assert.NoError(t, err)
+	text := []byte("a: " + ref1 + " # comment\nb:\n  - '" + ref2 + "'\nc: plain\n")
+
+	res, count, err := Rotate(text, oldKey, newKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.NotContains(t, string(res), ref1)
+	assert.Contains(t, string(res), " # comment\nb:\n  - '")
+	assert.Contains(t, string(res), "c: plain\n")
+
+	refs := encPattern.FindAllString(string(res), -1)
+	if assert.Len(t, refs, 2) {
+		v, err := Open(refs[1], newKey)
+		assert.NoError(t, err)
+		assert.Equal(t, "secret2", v)
+		_, err = Open(refs[1], oldKey)
+		assert.Error(t, err)
+	}
+
+	_, _, err = Rotate(text, newKey, oldKey)
+	assert.Error(t, err)
+}
@@ -11,6 +11,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,8 +19,10 @@ import (
 	"github.com/gwos/tcg/config"
 	"github.com/gwos/tcg/logzer"
 	"github.com/gwos/tcg/nats"
+	sdkclients "github.com/gwos/tcg/sdk/clients"
 	tcgerr "github.com/gwos/tcg/sdk/errors"
 	"github.com/gwos/tcg/sdk/transit"
+	"github.com/gwos/tcg/secrets"
 	"github.com/gwos/tcg/taskQueue"
 	"github.com/gwos/tcg/tracing"
 	"github.com/hashicorp/go-uuid"
@@ -35,12 +38,13 @@ import (
 type AgentService struct {
 	*config.Connector
 
-	agentStats  *AgentStats
+	agentStats  *agentStats
 	agentStatus *AgentStatus
 	//dsClient    *clients.DSClient
 	//gwClients   []*clients.GWClient
 	tcgClients []*clients.TCGClient
-	quitChan   chan struct{}
+	quitChan   chan ExitReport
+	draining   int32
 	statsChan  chan statsCounter
 	taskQueue  *taskQueue.TaskQueue
 
@@ -56,6 +60,8 @@ type statsCounter struct {
 	bytesSent   int
 	payloadType payloadType
 	timestamp   transit.Timestamp
+	connection  string
+	failed      bool
 }
 
 type taskSubject string
@@ -63,6 +69,7 @@ type taskSubject string
 const (
 	taskConfig          taskSubject = "config"
 	taskExit            taskSubject = "exit"
+	taskReloadConfig    taskSubject = "reloadConfig"
 	taskResetNats       taskSubject = "resetNats"
 	taskStartController taskSubject = "startController"
 	taskStopController  taskSubject = "stopController"
@@ -82,7 +89,7 @@ const (
 )
 
 // AllowSignalHandlers defines setting the signal handlers
-// true by default, handle signals: os.Interrupt, syscall.SIGTERM
+// true by default, handle signals: os.Interrupt, syscall.SIGTERM, syscall.SIGHUP
 // false on init of C-shared library libtransit
 var AllowSignalHandlers = true
 
@@ -94,17 +101,15 @@ func GetAgentService() *AgentService {
 	onceAgentService.Do(func() {
 		agentConnector := config.GetConfig().Connector
 		agentService = &AgentService{
-			Connector: agentConnector,
-			agentStats: &AgentStats{
-				UpSince: transit.NewTimestamp(),
-			},
+			Connector:  agentConnector,
+			agentStats: newAgentStats(),
 			agentStatus: &AgentStatus{
 				Controller: StatusStopped,
 				Nats:       StatusStopped,
 				Transport:  StatusStopped,
 			},
 			//dsClient:    &clients.DSClient{DSConnection: (*clients.DSConnection)(config.GetConfig().DSConnection)},
-			quitChan:    make(chan struct{}, 1),
+			quitChan:    make(chan ExitReport, 1),
 			statsChan:   make(chan statsCounter),
 			tracerCache: cache.New(-1, -1),
 
@@ -112,12 +117,23 @@ func GetAgentService() *AgentService {
 			exitHandler:   defaultExitHandler,
 		}
 
+		/* resolve the secret references of GW connections on connect */
+		sdkclients.ResolveSecret = secrets.Resolve
+
+		agentService.restoreStats()
 		go agentService.listenStatsChan()
+		if agentService.statsPersisted() {
+			go agentService.snapshotStats(statsSnapshotInterval)
+		}
 		agentService.initTracerToken()
 		agentService.initOTEL()
 		agentService.handleTasks()
 		if AllowSignalHandlers {
 			agentService.hookInterrupt()
+			agentService.hookReload()
+		}
+		if agentService.ConfigWatchInterval > 0 {
+			go agentService.watchConfig(agentService.ConfigWatchInterval)
 		}
 
 		log.Debug().
@@ -204,8 +220,8 @@ func defaultConfigHandler([]byte) {}
 func defaultExitHandler() {}
 
 // Quit returns channel
-// usefull for main loop
-func (service *AgentService) Quit() <-chan struct{} {
+// usefull for main loop, receives the report of draining on exit
+func (service *AgentService) Quit() <-chan ExitReport {
 	return service.quitChan
 }
 
@@ -235,6 +251,11 @@ func (service *AgentService) ExitAsync() (*taskQueue.Task, error) {
 	return service.taskQueue.PushAsync(taskExit)
 }
 
+// ReloadConfigAsync implements AgentServices.ReloadConfigAsync interface
+func (service *AgentService) ReloadConfigAsync() (*taskQueue.Task, error) {
+	return service.taskQueue.PushAsync(taskReloadConfig)
+}
+
 // ResetNatsAsync implements AgentServices.ResetNatsAsync interface
 func (service *AgentService) ResetNatsAsync() (*taskQueue.Task, error) {
 	return service.taskQueue.PushAsync(taskResetNats)
@@ -275,6 +296,11 @@ func (service *AgentService) Exit() error {
 	return service.taskQueue.PushSync(taskExit)
 }
 
+// ReloadConfig implements AgentServices.ReloadConfig interface
+func (service *AgentService) ReloadConfig() error {
+	return service.taskQueue.PushSync(taskReloadConfig)
+}
+
 // ResetNats implements AgentServices.ResetNats interface
 func (service *AgentService) ResetNats() error {
 	return service.taskQueue.PushSync(taskResetNats)
@@ -314,7 +340,7 @@ func (service *AgentService) StopTransport() error {
 func (service *AgentService) Stats() AgentStatsExt {
 	return AgentStatsExt{
 		AgentIdentity: service.Connector.AgentIdentity,
-		AgentStats:    *service.agentStats,
+		AgentStats:    service.agentStats.stats(),
 		LastErrors:    logzer.LastErrors(),
 	}
 }
@@ -328,12 +354,13 @@ func (service *AgentService) Status() AgentStatus {
 func (service *AgentService) handleTasks() {
 	hAlarm := func(task *taskQueue.Task) error {
 		log.Error().Msgf("taskQueue timed over: %s", task.Subject)
+		selfMetrics.observeTaskAlarm(task.Subject.(taskSubject))
 		return nil
 	}
 	hTask := func(task *taskQueue.Task) error {
 		log.Debug().
 			Interface("Subject", task.Subject).
-			Uint8("Idx", task.Idx).
+			Uint64("Idx", task.Idx).
 			Msg("taskQueue")
 		service.agentStatus.task = task
 		var err error
@@ -342,6 +369,8 @@ func (service *AgentService) handleTasks() {
 			err = service.config(task.Args[0].([]byte))
 		case taskExit:
 			err = service.exit()
+		case taskReloadConfig:
+			err = service.reloadConfig()
 		case taskResetNats:
 			err = service.resetNats()
 		case taskStartController:
@@ -358,6 +387,7 @@ func (service *AgentService) handleTasks() {
 			err = service.stopTransport()
 		}
 		service.agentStatus.task = nil
+		selfMetrics.observeTask(task.Subject.(taskSubject), err)
 		return err
 	}
 
@@ -367,6 +397,7 @@ func (service *AgentService) handleTasks() {
 		taskQueue.WithHandlers(map[taskQueue.Subject]taskQueue.Handler{
 			taskConfig:          hTask,
 			taskExit:            hTask,
+			taskReloadConfig:    hTask,
 			taskResetNats:       hTask,
 			taskStartController: hTask,
 			taskStopController:  hTask,
@@ -380,19 +411,7 @@ func (service *AgentService) handleTasks() {
 
 func (service *AgentService) listenStatsChan() {
 	for {
-		res := <-service.statsChan
-		service.agentStats.BytesSent += res.bytesSent
-		service.agentStats.MessagesSent++
-		switch res.payloadType {
-		case typeInventory:
-			service.agentStats.LastInventoryRun = &res.timestamp
-		case typeMetrics:
-			service.agentStats.LastMetricsRun = &res.timestamp
-			service.agentStats.MetricsSent++
-		case typeEvents:
-			// TODO: handle events acks, unacks
-			service.agentStats.LastAlertRun = &res.timestamp
-		}
+		service.agentStats.add(<-service.statsChan)
 	}
 }
 
@@ -403,47 +422,88 @@ func (service *AgentService) updateStats(c statsCounter) {
 func (service *AgentService) makeDispatcherOptions() []nats.DispatcherOption {
 	var dispatcherOptions []nats.DispatcherOption
 	for _, tcgClient := range service.tcgClients {
-		// TODO: filter the message by rules per gwClient
 		tcgClient := tcgClient
+		rules := routingRules(tcgClient.RoutingRules)
+		hosts := &routingHosts{}
 		dispatcherOptions = append(
 			dispatcherOptions,
+			service.makeDispatcherOption(
+				fmt.Sprintf("#%s#%s#", subjDowntime, tcgClient.HostName),
+				subjDowntime, tcgClient.HostName,
+				rules.wrap(tcgClient.AppType, hosts, func(ctx context.Context, p natsPayload) error {
+					var err error
+					switch p.Type {
+					case typeClearInDowntime:
+						_, err = tcgClient.ClearInDowntime(ctx, p.Payload)
+					case typeSetInDowntime:
+						_, err = tcgClient.SetInDowntime(ctx, p.Payload)
+					default:
+						err = fmt.Errorf("%v: failed to process payload type %s:%s", nats.ErrDispatcher, p.Type, subjDowntime)
+					}
+					return err
+				}),
+			),
 			service.makeDispatcherOption(
 				fmt.Sprintf("#%s#%s#", subjEvents, tcgClient.HostName),
-				subjEvents,
-				func(ctx context.Context, p natsPayload) error {
+				subjEvents, tcgClient.HostName,
+				rules.wrap(tcgClient.AppType, hosts, func(ctx context.Context, p natsPayload) error {
 					var err error
 					switch p.Type {
 					case typeEvents:
-						_, err = tcgClient.SendEvent(ctx, p.Payload)
+						_, err = tcgClient.SendEvents(ctx, p.Payload)
+					case typeEventsAck, typeEventsUnack:
+						/* processed by separate durable */
+						err = errSkipPayload
 					default:
 						err = fmt.Errorf("%v: failed to process payload type %s:%s", nats.ErrDispatcher, p.Type, subjEvents)
 					}
 					return err
-				},
+				}),
+			),
+			/* events actions share the subject with events
+			but processed by separate durable with own retrying
+			so the failed ack doesn't delay the events delivery */
+			service.makeDispatcherOption(
+				fmt.Sprintf("#%s#%s#", durableEventsAck, tcgClient.HostName),
+				subjEvents, tcgClient.HostName,
+				rules.wrap(tcgClient.AppType, hosts, func(ctx context.Context, p natsPayload) error {
+					var err error
+					switch p.Type {
+					case typeEventsAck:
+						_, err = tcgClient.SendEventsAck(ctx, p.Payload)
+					case typeEventsUnack:
+						_, err = tcgClient.SendEventsUnack(ctx, p.Payload)
+					case typeEvents:
+						/* processed by separate durable */
+						err = errSkipPayload
+					default:
+						err = fmt.Errorf("%v: failed to process payload type %s:%s", nats.ErrDispatcher, p.Type, subjEvents)
+					}
+					return err
+				}),
 			),
 			service.makeDispatcherOption(
 				fmt.Sprintf("#%s#%s#", subjInventoryMetrics, tcgClient.HostName),
-				subjInventoryMetrics,
-				func(ctx context.Context, p natsPayload) error {
+				subjInventoryMetrics, tcgClient.HostName,
+				rules.wrap(tcgClient.AppType, hosts, func(ctx context.Context, p natsPayload) error {
 					var err error
 					switch p.Type {
 					case typeInventory:
-						// We don't care about inventory data at collection
-						//_, err = tcgClient.SendData(ctx, p.Payload)
+						_, err = tcgClient.SynchronizeInventory(ctx, p.Payload)
 					case typeMetrics:
-						_, err = tcgClient.SendData(ctx, p.Payload)
+						_, err = tcgClient.SendResourcesWithMetrics(ctx, p.Payload)
 					default:
-						err = fmt.Errorf("%v: failed to process payload type %s:%s", nats.ErrDispatcher, p.Type, subjEvents)
+						err = fmt.Errorf("%v: failed to process payload type %s:%s", nats.ErrDispatcher, p.Type, subjInventoryMetrics)
 					}
 					return err
-				},
+				}),
 			),
 		)
 	}
 	return dispatcherOptions
 }
 
-func (service *AgentService) makeDispatcherOption(durableName, subj string, handler func(context.Context, natsPayload) error) nats.DispatcherOption {
+func (service *AgentService) makeDispatcherOption(durableName, subj, connection string, handler func(context.Context, natsPayload) error) nats.DispatcherOption {
 	return nats.DispatcherOption{
 		DurableName: durableName,
 		Subject:     subj,
@@ -469,10 +529,21 @@ func (service *AgentService) makeDispatcherOption(durableName, subj string, hand
 				)
 			}()
 
-			if err = handler(ctx, p); err == nil {
-				service.updateStats(
-					statsCounter{bytesSent: len(p.Payload), payloadType: p.Type, timestamp: *transit.NewTimestamp()})
+			t0 := time.Now()
+			err = handler(ctx, p)
+			if errors.Is(err, errSkipPayload) {
+				/* the payload type is processed by another durable */
+				err = nil
+				return nil
 			}
+			selfMetrics.observeDispatch(subj, p.Type, time.Since(t0), err)
+			service.updateStats(statsCounter{
+				bytesSent:   len(p.Payload),
+				payloadType: p.Type,
+				timestamp:   *transit.NewTimestamp(),
+				connection:  connection,
+				failed:      err != nil,
+			})
 			if errors.Is(err, tcgerr.ErrUnauthorized) {
 				/* it looks like an issue with credentialed user
 				so, wait for configuration update */
@@ -504,8 +575,7 @@ func (service *AgentService) config(data []byte) error {
 		Msg("loaded config")
 
 	// ensure nested services properly initialized
-	GetTransitService().eventsBatcher.Reset(service.Connector.BatchEvents, service.Connector.BatchMaxBytes)
-	GetTransitService().metricsBatcher.Reset(service.Connector.BatchMetrics, service.Connector.BatchMaxBytes)
+	GetTransitService().resetBatchers()
 	GetController().authCache.Flush()
 	// custom connector may provide additional handler for extended fields
 	service.configHandler(data)
@@ -524,13 +594,55 @@ func (service *AgentService) config(data []byte) error {
 	return nil
 }
 
-func (service *AgentService) exit() error {
-	GetTransitService().eventsBatcher.Exit()
-	GetTransitService().metricsBatcher.Exit()
+// reloadConfig applies the changes of config file
+// the changes of NATS store and controller server are reported as requiring restart
+func (service *AgentService) reloadConfig() error {
+	diff, err := config.GetConfig().Reload()
+	if err != nil {
+		log.Warn().Err(err).
+			Str("configPath", config.GetConfig().ConfigPath()).
+			Msg("could not reload config")
+		return err
+	}
+	if len(diff) == 0 {
+		log.Debug().Msg("reloaded config without changes")
+		return nil
+	}
+	log.Info().Interface("changes", diff).Msg("reloaded config")
+	if restart := diff.RestartRequired(); len(restart) > 0 {
+		log.Warn().Interface("changes", restart).
+			Msg("config changes are not applied until restart")
+	}
 
-	if service.tracerProvider != nil {
-		service.tracerProvider.ForceFlush(context.Background())
+	if diff.Changed("Connector.Batch") {
+		GetTransitService().resetBatchers()
+	}
+	if diff.Changed("Connector.Controller") {
+		GetController().authCache.Flush()
 	}
+	if diff.Changed("Connector.NatsRetry") {
+		nats.SetRetryConfig(service.Connector.NatsRetry)
+	}
+	if diff.Changed("Jaegertracing") {
+		if service.tracerProvider != nil {
+			service.tracerProvider.ForceFlush(context.Background())
+		}
+		service.initOTEL()
+	}
+	if diff.Changed("TCGConnections", "GWConnections", "Connector.Enabled", "Connector.GWEncode",
+		"Connector.AgentID", "Connector.AppName", "Connector.AppType") {
+		// restart nats processing with new clients
+		_ = service.stopTransport()
+		if service.Connector.Enabled {
+			_ = service.startTransport()
+		}
+	}
+	return nil
+}
+
+func (service *AgentService) exit() error {
+	/* refuse the controller writes while draining */
+	atomic.StoreInt32(&service.draining, 1)
 
 	/* wrap exitHandler with recover */
 	c := make(chan struct{}, 1)
@@ -545,6 +657,11 @@ func (service *AgentService) exit() error {
 	}(service.exitHandler)
 	/* wait for exitHandler done */
 	<-c
+
+	report := service.drain()
+	if service.tracerProvider != nil {
+		service.tracerProvider.ForceFlush(context.Background())
+	}
 	if err := service.stopController(); err != nil {
 		log.Err(err).Msg("handleExit")
 	}
@@ -554,17 +671,65 @@ func (service *AgentService) exit() error {
 	if err := service.stopNats(); err != nil {
 		log.Err(err).Msg("handleExit")
 	}
+	service.saveStats()
 	/* send quit signal */
-	service.quitChan <- struct{}{}
+	service.quitChan <- report
 	return nil
 }
 
+// drain flushes batchers and waits for the dispatcher to handle the in-flight messages
+// limited by ShutdownTimeout, with zero timeout the dispatcher is not waited
+func (service *AgentService) drain() ExitReport {
+	ctx, cancel := context.Background(), func() {}
+	if service.Connector.ShutdownTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, service.Connector.ShutdownTimeout)
+	}
+	defer cancel()
+
+	var report ExitReport
+	t0 := time.Now()
+	if err := GetTransitService().eventsBatcher.Drain(ctx); err != nil {
+		st := GetTransitService().eventsBatcher.Stats()
+		report.EventsLeft = st.BufLen + st.Pending
+	}
+	if err := GetTransitService().metricsBatcher.Drain(ctx); err != nil {
+		st := GetTransitService().metricsBatcher.Stats()
+		report.MetricsLeft = st.BufLen + st.Pending
+	}
+	if service.Connector.ShutdownTimeout > 0 {
+		undelivered, err := nats.Drain(ctx)
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			log.Debug().Err(err).Msg("could not drain nats")
+		}
+		report.Undelivered = undelivered
+	}
+	report.TimedOut = ctx.Err() != nil
+
+	logEvent := log.Info()
+	if !report.Drained() {
+		logEvent = log.Warn()
+	}
+	logEvent.Dur("duration", time.Since(t0)).
+		Bool("timedOut", report.TimedOut).
+		Int("eventsLeft", report.EventsLeft).
+		Int("metricsLeft", report.MetricsLeft).
+		Interface("undelivered", report.Undelivered).
+		Msg("drained on exit")
+	return report
+}
+
+// isDraining returns true while exiting
+func (service *AgentService) isDraining() bool {
+	return atomic.LoadInt32(&service.draining) == 1
+}
+
 func (service *AgentService) resetNats() error {
 	st0 := *(service.agentStatus)
 	if err := service.stopNats(); err != nil {
 		log.Warn().Err(err).Msg("could not stop nats")
 	}
 	globs := [...]string{
+		"queue.db",
 		"*/msgs.*.dat",
 		"*/msgs.*.idx",
 		"*/subs.dat",
@@ -580,6 +745,13 @@ func (service *AgentService) resetNats() error {
 			}
 		}
 	}
+	for _, dir := range [...]string{"jetstream", "stan-migrating"} {
+		dir = filepath.Join(service.Connector.NatsStoreDir, dir)
+		log.Debug().Msgf("removing: %s", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warn().Msgf("could not remove: %s", dir)
+		}
+	}
 	if st0.Nats == StatusRunning {
 		if err := service.startNats(); err != nil {
 			log.Warn().Err(err).Msg("could not start nats")
@@ -612,9 +784,8 @@ func (service *AgentService) startNats() error {
 		MaxInflight:         service.Connector.NatsMaxInflight,
 		MaxPubAcksInflight:  service.Connector.NatsMaxPubAcksInflight,
 		MaxPayload:          service.Connector.NatsMaxPayload,
-		MaxPendingBytes:     service.Connector.NatsMaxPendingBytes,
-		MaxPendingMsgs:      service.Connector.NatsMaxPendingMsgs,
 		MonitorPort:         service.Connector.NatsMonitorPort,
+		Backend:             service.Connector.NatsBackend,
 		StoreDir:            service.Connector.NatsStoreDir,
 		StoreType:           service.Connector.NatsStoreType,
 		StoreMaxAge:         service.Connector.NatsStoreMaxAge,
@@ -622,6 +793,7 @@ func (service *AgentService) startNats() error {
 		StoreMaxMsgs:        service.Connector.NatsStoreMaxMsgs,
 		StoreBufferSize:     service.Connector.NatsStoreBufferSize,
 		StoreReadBufferSize: service.Connector.NatsStoreReadBufferSize,
+		Retry:               service.Connector.NatsRetry,
 	})
 	if err == nil {
 		service.agentStatus.Nats = StatusRunning
@@ -728,6 +900,41 @@ func (service AgentService) hookInterrupt() {
 	}()
 }
 
+// hookReload reloads config on SIGHUP
+func (service *AgentService) hookReload() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for s := range c {
+			log.Info().Msgf("signal %s received, reloading config", s)
+			_, _ = service.ReloadConfigAsync()
+		}
+	}()
+}
+
+// watchConfig polls the config file and reloads it on change
+func (service *AgentService) watchConfig(interval time.Duration) {
+	configPath := config.GetConfig().ConfigPath()
+	fi0, _ := os.Stat(configPath)
+	for range time.Tick(interval) {
+		fi, err := os.Stat(configPath)
+		if err != nil {
+			fi0 = nil
+			continue
+		}
+		if fi0 != nil && fi.ModTime().Equal(fi0.ModTime()) && fi.Size() == fi0.Size() {
+			continue
+		}
+		fi0 = fi
+		if data, err := os.ReadFile(configPath); err == nil && config.IsWritten(data) {
+			log.Debug().Str("configPath", configPath).Msg("config file written by agent, skip reloading")
+			continue
+		}
+		log.Info().Str("configPath", configPath).Msg("config file changed, reloading config")
+		_, _ = service.ReloadConfigAsync()
+	}
+}
+
 func (service *AgentService) initTracerToken() {
 	/* prepare random tracerToken */
 	tracerToken := []byte("aaaabbbbccccdddd")
@@ -11,6 +11,7 @@ import (
 
 func init() {
 	config.GetConfig().Connector.ControllerAddr = ":11099"
+	config.GetConfig().Connector.NatsBackend = "LOCAL"
 	config.GetConfig().Connector.NatsStoreType = "MEMORY"
 	config.GetConfig().GWConnections = []*config.GWConnection{
 		{
@@ -54,6 +55,8 @@ func TestAgentService_DemandConfig(t *testing.T) {
 	_ = os.Setenv(config.ConfigEnv, tmpfile.Name())
 	defer os.Unsetenv(config.ConfigEnv)
 
+	_ = os.Setenv("TCG_CONNECTOR_NATSBACKEND", "LOCAL")
+	defer os.Unsetenv("TCG_CONNECTOR_NATSBACKEND")
 	_ = os.Setenv("TCG_CONNECTOR_NATSSTORETYPE", "MEMORY")
 	defer os.Unsetenv("TCG_CONNECTOR_NATSSTORETYPE")
 
@@ -73,6 +76,13 @@ func TestAgentService_DemandConfig(t *testing.T) {
     "hostName": "gw-host-xx",
     "userName": "-xx-",
     "password": "xx"
+  }],
+  "tcgConnections": [{
+	"enabled": true,
+	"localConnection": false,
+    "hostName": "tcg-host-xx",
+    "userName": "-xx-",
+    "password": "xx"
   }]
 }`)
 
@@ -80,8 +90,7 @@ func TestAgentService_DemandConfig(t *testing.T) {
 	assert.Equal(t, "", agentService.Connector.AgentID)
 	assert.NoError(t, agentService.config(dto))
 	assert.Equal(t, "99998888-7777-6666-a3b0-b14622f7dd39", agentService.Connector.AgentID)
-	assert.Equal(t, "gw-host-xxx", agentService.dsClient.HostName)
 	assert.NoError(t, agentService.startNats())
 	assert.NoError(t, agentService.startTransport())
-	assert.Equal(t, "gw-host-xx", agentService.gwClients[0].HostName)
+	assert.Equal(t, "tcg-host-xx", agentService.tcgClients[0].HostName)
 }
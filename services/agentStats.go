@@ -0,0 +1,279 @@
+package services
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gwos/tcg/batcher/events"
+	"github.com/gwos/tcg/sdk/transit"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	statsFileName         = "agent_stats.json"
+	statsSnapshotInterval = time.Minute
+	statsMinuteSlots      = 60
+	statsHourSlots        = 24
+)
+
+// statsBucket keeps the counts of time slot
+// Slot is the unix time divided by slot duration
+type statsBucket struct {
+	Slot int64 `json:"slot"`
+	StatsWindow
+}
+
+// statsRing keeps the buckets of rolling window
+type statsRing []statsBucket
+
+func (r statsRing) add(slot int64, c statsCounter) {
+	b := &r[slot%int64(len(r))]
+	if b.Slot > slot {
+		/* the slot is out of window already */
+		return
+	}
+	if b.Slot != slot {
+		*b = statsBucket{Slot: slot}
+	}
+	b.add(c)
+}
+
+func (r statsRing) sum(slot int64) StatsWindow {
+	var w StatsWindow
+	for _, b := range r {
+		if b.Slot > slot-int64(len(r)) && b.Slot <= slot {
+			w.MessagesSent += b.MessagesSent
+			w.MessagesFailed += b.MessagesFailed
+			w.BytesSent += b.BytesSent
+		}
+	}
+	return w
+}
+
+func (w *StatsWindow) add(c statsCounter) {
+	if c.failed {
+		w.MessagesFailed++
+		return
+	}
+	w.MessagesSent++
+	w.BytesSent += c.bytesSent
+}
+
+// agentStats guards AgentStats updated by dispatcher
+// and keeps the buckets of rolling windows
+// the 1h window has minute granularity, the 24h window has hour granularity
+type agentStats struct {
+	sync.Mutex
+	AgentStats
+	minutes statsRing
+	hours   statsRing
+}
+
+// statsSnapshot defines the content of stats file
+type statsSnapshot struct {
+	AgentStats
+	Minutes statsRing `json:"minutes"`
+	Hours   statsRing `json:"hours"`
+}
+
+func newAgentStats() *agentStats {
+	now := transit.NewTimestamp()
+	return &agentStats{
+		AgentStats: AgentStats{
+			UpSince:       now,
+			CountingSince: now,
+		},
+		minutes: make(statsRing, statsMinuteSlots),
+		hours:   make(statsRing, statsHourSlots),
+	}
+}
+
+func (s *agentStats) add(c statsCounter) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.minutes.add(c.timestamp.Unix()/60, c)
+	s.hours.add(c.timestamp.Unix()/3600, c)
+
+	if c.connection != "" {
+		s.addConnection(c)
+	}
+	if c.failed {
+		return
+	}
+
+	s.BytesSent += c.bytesSent
+	s.MessagesSent++
+	if s.PayloadTypes == nil {
+		s.PayloadTypes = make(map[string]int)
+	}
+	s.PayloadTypes[c.payloadType.String()]++
+	switch c.payloadType {
+	case typeInventory:
+		s.LastInventoryRun = &c.timestamp
+	case typeMetrics:
+		s.LastMetricsRun = &c.timestamp
+		s.MetricsSent++
+	case typeEvents:
+		s.LastAlertRun = &c.timestamp
+	case typeEventsAck, typeEventsUnack:
+		s.LastAlertActionRun = &c.timestamp
+	}
+}
+
+func (s *agentStats) addConnection(c statsCounter) {
+	if s.Connections == nil {
+		s.Connections = make(map[string]*ConnectionStats)
+	}
+	con, ok := s.Connections[c.connection]
+	if !ok {
+		con = &ConnectionStats{}
+		s.Connections[c.connection] = con
+	}
+	if c.failed {
+		con.MessagesFailed++
+		con.LastFailed = &c.timestamp
+		if con.FailingSince == nil {
+			con.FailingSince = &c.timestamp
+		}
+		return
+	}
+	con.MessagesSent++
+	con.LastSent = &c.timestamp
+	con.FailingSince = nil
+}
+
+// addDropped counts the event dropped by batching
+func (s *agentStats) addDropped(host, reason string) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch reason {
+	case events.DropSuppressed:
+		s.EventsDropped.Suppressed++
+	case events.DropRateLimited:
+		s.EventsDropped.RateLimited++
+	}
+	if s.EventsDropped.Hosts == nil {
+		s.EventsDropped.Hosts = make(map[string]int)
+	}
+	s.EventsDropped.Hosts[host]++
+	s.EventsDropped.LastDropped = transit.NewTimestamp()
+}
+
+// stats returns a copy of stats with the rolling windows computed
+func (s *agentStats) stats() AgentStats {
+	s.Lock()
+	defer s.Unlock()
+
+	res := s.AgentStats
+	res.PayloadTypes = make(map[string]int, len(s.PayloadTypes))
+	for k, v := range s.PayloadTypes {
+		res.PayloadTypes[k] = v
+	}
+	res.Connections = make(map[string]*ConnectionStats, len(s.Connections))
+	for k, v := range s.Connections {
+		con := *v
+		res.Connections[k] = &con
+	}
+	res.EventsDropped.Hosts = make(map[string]int, len(s.EventsDropped.Hosts))
+	for k, v := range s.EventsDropped.Hosts {
+		res.EventsDropped.Hosts[k] = v
+	}
+	now := time.Now().Unix()
+	res.Last1h = s.minutes.sum(now / 60)
+	res.Last24h = s.hours.sum(now / 3600)
+	return res
+}
+
+// save writes the stats file, the file is replaced atomically
+func (s *agentStats) save(dir string) error {
+	s.Lock()
+	data, err := json.Marshal(statsSnapshot{
+		AgentStats: s.AgentStats,
+		Minutes:    s.minutes,
+		Hours:      s.hours,
+	})
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, statsFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// load restores the stats saved by previous run
+// the UpSince is kept for the current run
+func (s *agentStats) load(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, statsFileName))
+	if err != nil {
+		return err
+	}
+	var snapshot statsSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	upSince := s.UpSince
+	s.AgentStats = snapshot.AgentStats
+	s.UpSince = upSince
+	if s.CountingSince == nil {
+		s.CountingSince = upSince
+	}
+	if len(snapshot.Minutes) == statsMinuteSlots {
+		s.minutes = snapshot.Minutes
+	}
+	if len(snapshot.Hours) == statsHourSlots {
+		s.hours = snapshot.Hours
+	}
+	return nil
+}
+
+// statsPersisted returns true if stats should be kept across restarts
+// the "MEMORY" NATS store is not persisted, so do the stats
+func (service *AgentService) statsPersisted() bool {
+	return service.Connector.NatsStoreType != "MEMORY"
+}
+
+func (service *AgentService) restoreStats() {
+	if !service.statsPersisted() {
+		return
+	}
+	if err := service.agentStats.load(service.Connector.NatsStoreDir); err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Msg("could not restore agent stats")
+		}
+		return
+	}
+	log.Debug().Msg("restored agent stats")
+}
+
+func (service *AgentService) saveStats() {
+	if !service.statsPersisted() {
+		return
+	}
+	if err := service.agentStats.save(service.Connector.NatsStoreDir); err != nil {
+		log.Warn().Err(err).Msg("could not save agent stats")
+	}
+}
+
+// snapshotStats saves stats periodically
+func (service *AgentService) snapshotStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		service.saveStats()
+	}
+}
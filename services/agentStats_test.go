@@ -0,0 +1,62 @@
+package services
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gwos/tcg/batcher/events"
+	"github.com/gwos/tcg/sdk/transit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentStats(t *testing.T) {
+	now := transit.Timestamp{Time: time.Now()}
+	hourAgo := transit.Timestamp{Time: time.Now().Add(-time.Hour * 2)}
+	dayAgo := transit.Timestamp{Time: time.Now().Add(-time.Hour * 25)}
+
+	stats := newAgentStats()
+	stats.add(statsCounter{bytesSent: 10, payloadType: typeMetrics, timestamp: now, connection: "tcg-1"})
+	stats.add(statsCounter{bytesSent: 20, payloadType: typeEventsAck, timestamp: now, connection: "tcg-1"})
+	stats.add(statsCounter{bytesSent: 30, payloadType: typeEvents, timestamp: now, connection: "tcg-2", failed: true})
+	stats.add(statsCounter{bytesSent: 40, payloadType: typeInventory, timestamp: hourAgo, connection: "tcg-2"})
+	stats.add(statsCounter{bytesSent: 50, payloadType: typeMetrics, timestamp: dayAgo, connection: "tcg-2"})
+	stats.addDropped("host-1", events.DropSuppressed)
+	stats.addDropped("host-1", events.DropRateLimited)
+	stats.addDropped("host-2", events.DropSuppressed)
+
+	res := stats.stats()
+	assert.Equal(t, 120, res.BytesSent)
+	assert.Equal(t, 4, res.MessagesSent)
+	assert.Equal(t, 2, res.MetricsSent)
+	assert.Equal(t, map[string]int{"eventsAck": 1, "inventory": 1, "metrics": 2}, res.PayloadTypes)
+	assert.NotNil(t, res.LastAlertActionRun)
+	assert.Nil(t, res.LastAlertRun)
+	assert.Equal(t, StatsWindow{BytesSent: 30, MessagesSent: 2, MessagesFailed: 1}, res.Last1h)
+	assert.Equal(t, StatsWindow{BytesSent: 70, MessagesSent: 3, MessagesFailed: 1}, res.Last24h)
+	assert.Equal(t, 2, res.Connections["tcg-1"].MessagesSent)
+	assert.Equal(t, 0, res.Connections["tcg-1"].MessagesFailed)
+	assert.Equal(t, 2, res.Connections["tcg-2"].MessagesSent)
+	assert.Equal(t, 1, res.Connections["tcg-2"].MessagesFailed)
+	assert.NotNil(t, res.Connections["tcg-2"].LastFailed)
+	assert.Equal(t, 2, res.EventsDropped.Suppressed)
+	assert.Equal(t, 1, res.EventsDropped.RateLimited)
+	assert.Equal(t, map[string]int{"host-1": 2, "host-2": 1}, res.EventsDropped.Hosts)
+
+	dir, err := os.MkdirTemp("", "stats")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, stats.save(dir))
+
+	restored := newAgentStats()
+	assert.NoError(t, restored.load(dir))
+	res2 := restored.stats()
+	assert.Equal(t, res.BytesSent, res2.BytesSent)
+	assert.Equal(t, res.PayloadTypes, res2.PayloadTypes)
+	assert.Equal(t, res.Connections["tcg-2"].MessagesFailed, res2.Connections["tcg-2"].MessagesFailed)
+	assert.Equal(t, res.Last1h, res2.Last1h)
+	assert.Equal(t, res.Last24h, res2.Last24h)
+	assert.Equal(t, res.EventsDropped.Hosts, res2.EventsDropped.Hosts)
+	assert.Equal(t, res.CountingSince.Unix(), res2.CountingSince.Unix())
+	assert.NotEqual(t, res.UpSince, res2.UpSince)
+}
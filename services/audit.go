@@ -0,0 +1,201 @@
+package services
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gwos/tcg/logzer"
+	"github.com/gwos/tcg/taskQueue"
+	"github.com/rs/zerolog/log"
+)
+
+// Define gin context keys
+// ctxKeyAccess keeps accessInfo set by checkAccess
+// ctxKeyTask keeps taskQueue.Task pushed by handler
+const (
+	ctxKeyAccess = "tcg-access"
+	ctxKeyTask   = "tcg-task"
+)
+
+// Define audit outcomes
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+	auditDenied  = "denied"
+)
+
+// auditLog appends records as json lines to the rotating file
+type auditLog struct {
+	file *logzer.LogFile
+}
+
+// newAuditLog returns nil for empty filePath that turns off auditing
+func newAuditLog(filePath string, maxSize int64, rotate int) *auditLog {
+	if filePath == "" {
+		return nil
+	}
+	return &auditLog{file: &logzer.LogFile{
+		FilePath: filePath,
+		MaxSize:  maxSize,
+		Rotate:   rotate,
+	}}
+}
+
+func (a *auditLog) write(rec AuditRecord) {
+	if a == nil {
+		return
+	}
+	buf, err := json.Marshal(rec)
+	if err == nil {
+		_, err = a.file.Write(append(buf, '\n'))
+	}
+	if err != nil {
+		log.Err(err).Interface("record", rec).Msg("could not write audit record")
+	}
+}
+
+// auditFilter selects records, empty fields match any
+// Route accepts glob pattern
+type auditFilter struct {
+	From  time.Time
+	To    time.Time
+	Route string
+	Limit int
+}
+
+func (f auditFilter) match(rec AuditRecord) bool {
+	if !f.From.IsZero() && rec.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && rec.Time.After(f.To) {
+		return false
+	}
+	if f.Route != "" {
+		if matched, _ := path.Match(f.Route, rec.Route); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// query returns up to Limit latest records in order of writing
+// reads the rotated files from the oldest one
+func (a *auditLog) query(filter auditFilter) ([]AuditRecord, error) {
+	if a == nil {
+		return nil, fmt.Errorf("audit is turned off")
+	}
+	files := make([]string, 0, a.file.Rotate+1)
+	for i := a.file.Rotate; i > 0; i-- {
+		files = append(files, fmt.Sprintf("%s.%d", a.file.FilePath, i))
+	}
+	files = append(files, a.file.FilePath)
+
+	records := make([]AuditRecord, 0)
+	for _, fn := range files {
+		file, err := os.Open(fn)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var rec AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				/* skip the partially written line */
+				continue
+			}
+			if !filter.match(rec) {
+				continue
+			}
+			records = append(records, rec)
+			if filter.Limit > 0 && len(records) > filter.Limit {
+				records = records[1:]
+			}
+		}
+		err = scanner.Err()
+		_ = file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// digestBody hashes the read data
+type digestBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	size int
+}
+
+func (b *digestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	b.size += n
+	return n, err
+}
+
+// auditAccess is middleware recording the state-changing calls
+// the record of call pushed task is written on the task done
+func (controller *Controller) auditAccess(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return
+	}
+
+	rec := AuditRecord{
+		Time:       time.Now(),
+		RemoteAddr: c.ClientIP(),
+		Method:     c.Request.Method,
+		Route:      c.FullPath(),
+	}
+	/* digest the payload read by handler, the denied one is not read */
+	body := &digestBody{ReadCloser: c.Request.Body, hash: sha256.New()}
+	c.Request.Body = body
+
+	c.Next()
+
+	if body.size > 0 {
+		rec.PayloadSize = body.size
+		rec.PayloadDigest = "sha256:" + hex.EncodeToString(body.hash.Sum(nil))
+	}
+	rec.Status = c.Writer.Status()
+	if v, ok := c.Get(ctxKeyAccess); ok {
+		access := v.(accessInfo)
+		rec.AuthMethod, rec.Identity, rec.Role = access.Method, access.Identity, access.Role
+	}
+	switch {
+	case rec.Status == http.StatusUnauthorized || rec.Status == http.StatusForbidden:
+		rec.Outcome = auditDenied
+	case rec.Status >= http.StatusBadRequest:
+		rec.Outcome = auditFailure
+	default:
+		rec.Outcome = auditSuccess
+	}
+
+	v, ok := c.Get(ctxKeyTask)
+	if !ok {
+		controller.audit.write(rec)
+		return
+	}
+	task := v.(*taskQueue.Task)
+	rec.TaskIdx = task.Idx
+	go func() {
+		if err := <-task.Done(); err != nil {
+			rec.Outcome, rec.Error = auditFailure, err.Error()
+		}
+		controller.audit.write(rec)
+	}()
+}
@@ -2,9 +2,18 @@ package services
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"os"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,13 +21,20 @@ import (
 	"github.com/gin-gonic/contrib/cors"
 	"github.com/gin-gonic/contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/gwos/tcg/clients"
 	"github.com/gwos/tcg/config"
+	"github.com/gwos/tcg/nats"
+	"github.com/gwos/tcg/taskQueue"
+	sdkclients "github.com/gwos/tcg/sdk/clients"
+	"github.com/gwos/tcg/secrets"
 	tcgerr "github.com/gwos/tcg/sdk/errors"
 	"github.com/gwos/tcg/tracing"
 	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 	ginSwagger "github.com/swaggo/gin-swagger"
 	"github.com/swaggo/gin-swagger/swaggerFiles"
+	"golang.org/x/crypto/blake2b"
 )
 
 // Controller implements AgentServices, Controllers interface
@@ -27,6 +43,7 @@ type Controller struct {
 	muBASIC     sync.Mutex
 	muGWOS      sync.Mutex
 	authCache   *cache.Cache
+	audit       *auditLog
 	entrypoints []Entrypoint
 	srv         *http.Server
 }
@@ -55,6 +72,10 @@ func GetController() *Controller {
 		controller = &Controller{
 			TransitService: GetTransitService(),
 			authCache:      cache.New(8*time.Hour, time.Hour),
+			audit: newAuditLog(
+				config.GetConfig().Connector.AuditFile,
+				config.GetConfig().Connector.AuditFileMaxSize,
+				config.GetConfig().Connector.AuditFileRotate),
 			entrypoints:    []Entrypoint{},
 		}
 	})
@@ -87,12 +108,18 @@ func (controller *Controller) startController() error {
 	}
 	certFile := controller.Connector.ControllerCertFile
 	keyFile := controller.Connector.ControllerKeyFile
+	tlsConfig, err := controller.makeTLSConfig()
+	if err != nil {
+		log.Err(err).Msg("controller could not configure client certificates")
+		return err
+	}
 
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 	router.Use(gin.Recovery())
+	router.Use(selfMetrics.observeRequest)
 	corsConfig := cors.DefaultConfig()
-	corsConfig.AllowedHeaders = []string{"GWOS-APP-NAME", "GWOS-API-TOKEN", "Content-Type"}
+	corsConfig.AllowedHeaders = []string{"GWOS-APP-NAME", "GWOS-API-TOKEN", "Authorization", "X-PIN", "Content-Type"}
 	router.Use(cors.New(corsConfig))
 	router.Use(sessions.Sessions("tcg-session", sessions.NewCookieStore([]byte("secret"))))
 	controller.registerAPI1(router, addr, controller.entrypoints)
@@ -108,6 +135,7 @@ func (controller *Controller) startController() error {
 				Handler:      router,
 				ReadTimeout:  controller.Connector.ControllerReadTimeout,
 				WriteTimeout: controller.Connector.ControllerWriteTimeout,
+				TLSConfig:    tlsConfig,
 			}
 			var err error
 			if certFile != "" && keyFile != "" {
@@ -161,12 +189,16 @@ func (controller *Controller) stopController() error {
 
 //
 // @Description The following API endpoint can be used to Agent configure.
+// @Description With dryRun set it validates the payload merged with config file and environment without applying.
 // @Tags    agent, connector
 // @Accept  json
 // @Produce json
 // @Success 200
+// @Success 200 {object} services.ConfigValidationDTO "On dryRun"
+// @Failure 400 {object} services.ConfigValidationDTO
 // @Failure 401 {string} string "Unauthorized"
 // @Router  /config [post]
+// @Param   dryRun           query     bool       false       "Validate only"
 // @Param   GWOS-APP-NAME    header    string     true        "Auth header"
 // @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
 func (controller *Controller) config(c *gin.Context) {
@@ -182,15 +214,113 @@ func (controller *Controller) config(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, "could not unmarshal connector dto")
 		return
 	}
+	validation := dto.ValidateRemote()
+	if dryRun, _ := strconv.ParseBool(c.Query("dryRun")); dryRun {
+		/* validate the effective config, the connection issues are reported once by config keys */
+		if validation.Valid() {
+			newCfg, _, err := config.GetConfig().PreviewConnectorDTO(payload)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, err.Error())
+				return
+			}
+			validation = newCfg.Validate()
+		}
+		c.JSON(http.StatusOK, ConfigValidationDTO{validation.Valid(), validation})
+		return
+	}
+	/* only the issues rejected on apply are refused, the other ones are logged */
+	if !validation.Valid() {
+		log.Warn().Interface("errors", validation.Errors).Msg("invalid connector dto")
+		c.JSON(http.StatusBadRequest, ConfigValidationDTO{false, validation})
+		return
+	}
+	if validation := dto.Validate(); !validation.Valid() {
+		log.Warn().Interface("errors", validation.Errors).Msg("connector dto has issues")
+	}
 	/* process payload */
 	task, err := controller.taskQueue.PushAsync(taskConfig, payload)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, err.Error())
 		return
 	}
+	c.Set(ctxKeyTask, task)
 	c.JSON(http.StatusOK, ConnectorStatusDTO{StatusProcessing, task.Idx})
 }
 
+//
+// @Description The following API endpoint can be used to clear hosts and services in downtime.
+// @Tags    downtime
+// @Accept  json
+// @Produce json
+// @Success 200
+// @Failure 401 {string} string "Unauthorized"
+// @Router  /clear-in-downtime [post]
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) clearInDowntime(c *gin.Context) {
+	var (
+		err     error
+		payload []byte
+	)
+	ctx, span := tracing.StartTraceSpan(context.Background(), "services", "clearInDowntime")
+	defer func() {
+		tracing.EndTraceSpan(span,
+			tracing.TraceAttrError(err),
+			tracing.TraceAttrPayloadLen(payload),
+			tracing.TraceAttrEntrypoint(c.FullPath()),
+		)
+	}()
+
+	payload, err = c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	err = controller.ClearInDowntime(ctx, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, nil)
+}
+
+//
+// @Description The following API endpoint can be used to set hosts and services in downtime.
+// @Tags    downtime
+// @Accept  json
+// @Produce json
+// @Success 200
+// @Failure 401 {string} string "Unauthorized"
+// @Router  /set-in-downtime [post]
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) setInDowntime(c *gin.Context) {
+	var (
+		err     error
+		payload []byte
+	)
+	ctx, span := tracing.StartTraceSpan(context.Background(), "services", "setInDowntime")
+	defer func() {
+		tracing.EndTraceSpan(span,
+			tracing.TraceAttrError(err),
+			tracing.TraceAttrPayloadLen(payload),
+			tracing.TraceAttrEntrypoint(c.FullPath()),
+		)
+	}()
+
+	payload, err = c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	err = controller.SetInDowntime(ctx, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, nil)
+}
+
 //
 // @Description The following API endpoint can be used to send Alerts to Foundation.
 // @Tags    alert, event
@@ -302,6 +432,80 @@ func (controller *Controller) eventsUnack(c *gin.Context) {
 	c.JSON(http.StatusOK, nil)
 }
 
+//
+// @Description The following API endpoint can be used to send resources with metrics to Foundation.
+// @Tags    metric
+// @Accept  json
+// @Produce json
+// @Success 200
+// @Failure 401 {string} string "Unauthorized"
+// @Router  /metrics [post]
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) resourcesWithMetrics(c *gin.Context) {
+	var (
+		err     error
+		payload []byte
+	)
+	ctx, span := tracing.StartTraceSpan(context.Background(), "services", "resourcesWithMetrics")
+	defer func() {
+		tracing.EndTraceSpan(span,
+			tracing.TraceAttrError(err),
+			tracing.TraceAttrPayloadLen(payload),
+			tracing.TraceAttrEntrypoint(c.FullPath()),
+		)
+	}()
+
+	payload, err = c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	err = controller.SendResourceWithMetrics(ctx, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, nil)
+}
+
+//
+// @Description The following API endpoint can be used to synchronize inventory with Foundation.
+// @Tags    inventory
+// @Accept  json
+// @Produce json
+// @Success 200
+// @Failure 401 {string} string "Unauthorized"
+// @Router  /inventory [post]
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) inventory(c *gin.Context) {
+	var (
+		err     error
+		payload []byte
+	)
+	ctx, span := tracing.StartTraceSpan(context.Background(), "services", "inventory")
+	defer func() {
+		tracing.EndTraceSpan(span,
+			tracing.TraceAttrError(err),
+			tracing.TraceAttrPayloadLen(payload),
+			tracing.TraceAttrEntrypoint(c.FullPath()),
+		)
+	}()
+
+	payload, err = c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	err = controller.SynchronizeInventory(ctx, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, nil)
+}
+
 //
 // @Description The following API endpoint can be used to get list of metrics from the server.
 // @Tags    metric
@@ -339,9 +543,332 @@ func (controller *Controller) resetNats(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, err.Error())
 		return
 	}
+	c.Set(ctxKeyTask, task)
 	c.JSON(http.StatusOK, ConnectorStatusDTO{StatusProcessing, task.Idx})
 }
 
+//
+// @Description The following API endpoint can be used to list messages undelivered by NATS dispatcher.
+// @Tags    agent, connector
+// @Accept  json
+// @Produce json
+// @Success 200 {array} nats.DeadLetter
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal server error"
+// @Router  /dead-letters [get]
+// @Param   durableName      query     string     false       "Durable name glob pattern"
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) listDeadLetters(c *gin.Context) {
+	letters, err := nats.ListDeadLetters(nats.DeadLetterFilter{DurableName: c.Query("durableName")})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	/* omit payloads in list */
+	for i := range letters {
+		letters[i].Payload = nil
+	}
+	c.JSON(http.StatusOK, letters)
+}
+
+//
+// @Description The following API endpoint can be used to inspect the message undelivered by NATS dispatcher.
+// @Tags    agent, connector
+// @Accept  json
+// @Produce json
+// @Success 200 {object} nats.DeadLetter
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 404 {string} string "Not found"
+// @Failure 500 {string} string "Internal server error"
+// @Router  /dead-letters/{id} [get]
+// @Param   id               path      string     true        "Dead letter id"
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) getDeadLetter(c *gin.Context) {
+	letter, err := nats.GetDeadLetter(c.Param("id"))
+	if errors.Is(err, nats.ErrDeadLetter) {
+		c.JSON(http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, letter)
+}
+
+//
+// @Description The following API endpoint can be used to replay messages undelivered by NATS dispatcher.
+// @Description The empty filter selects all messages. The replayed messages are removed from dead letters.
+// @Tags    agent, connector
+// @Accept  json
+// @Produce json
+// @Success 200 {object} nats.DeadLetterResult
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal server error"
+// @Router  /dead-letters/replay [post]
+// @Param   filter           body      nats.DeadLetterFilter     false       "Filter"
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) replayDeadLetters(c *gin.Context) {
+	filter, err := bindDeadLetterFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	result, err := nats.ReplayDeadLetters(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+//
+// @Description The following API endpoint can be used to purge messages undelivered by NATS dispatcher.
+// @Description The empty filter selects all messages.
+// @Tags    agent, connector
+// @Accept  json
+// @Produce json
+// @Success 200 {object} nats.DeadLetterResult
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal server error"
+// @Router  /dead-letters/purge [post]
+// @Param   filter           body      nats.DeadLetterFilter     false       "Filter"
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) purgeDeadLetters(c *gin.Context) {
+	filter, err := bindDeadLetterFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	result, err := nats.PurgeDeadLetters(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func bindDeadLetterFilter(c *gin.Context) (nats.DeadLetterFilter, error) {
+	filter := nats.DeadLetterFilter{}
+	payload, err := c.GetRawData()
+	if err != nil || len(payload) == 0 {
+		return filter, err
+	}
+	err = json.Unmarshal(payload, &filter)
+	return filter, err
+}
+
+//
+// @Description The following API endpoint can be used to inspect the queue.
+// @Description It returns the messages kept per subject and the delivery state of durables with retry state of dispatcher.
+// @Tags    agent, connector
+// @Accept  json
+// @Produce json
+// @Success 200 {object} services.QueueDTO
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal server error"
+// @Router  /queue [get]
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) queue(c *gin.Context) {
+	stats, err := nats.Stats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	breakers := make(map[string]nats.BreakerState)
+	for _, state := range nats.BreakerStates() {
+		breakers[state.DurableName] = state
+	}
+
+	now := time.Now()
+	queueDTO := QueueDTO{
+		Subjects: make([]QueueSubjectDTO, 0, len(stats.Subjects)),
+		Durables: make([]QueueDurableDTO, 0, len(stats.Durables)),
+	}
+	for _, st := range stats.Subjects {
+		subjectDTO := QueueSubjectDTO{SubjectStats: st}
+		if st.Msgs > 0 && !st.FirstTime.IsZero() {
+			subjectDTO.OldestAgeSeconds = now.Sub(st.FirstTime).Seconds()
+		}
+		queueDTO.Subjects = append(queueDTO.Subjects, subjectDTO)
+	}
+	for _, dur := range stats.Durables {
+		durableDTO := QueueDurableDTO{DurableStats: dur}
+		if state, ok := breakers[dur.DurableName]; ok {
+			durableDTO.Retry = &state
+		}
+		queueDTO.Durables = append(queueDTO.Durables, durableDTO)
+	}
+	c.JSON(http.StatusOK, queueDTO)
+}
+
+//
+// @Description The following API endpoint can be used to peek at the first messages of subject.
+// @Description The messages are decoded to show type, trace IDs and payload size.
+// @Tags    agent, connector
+// @Accept  json
+// @Produce json
+// @Success 200 {array} services.QueueMessageDTO
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal server error"
+// @Router  /queue/{subject}/messages [get]
+// @Param   subject          path      string     true        "Subject"
+// @Param   limit            query     int        false       "Number of messages, 10 by default, 100 at most"
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) peekQueue(c *gin.Context) {
+	limit := 10
+	if v := c.Query("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 100 {
+			c.JSON(http.StatusBadRequest, "limit should be in range 1..100")
+			return
+		}
+	}
+	msgs, err := nats.PeekMsgs(c.Param("subject"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	messages := make([]QueueMessageDTO, 0, len(msgs))
+	for _, msg := range msgs {
+		messages = append(messages, makeQueueMessageDTO(msg))
+	}
+	c.JSON(http.StatusOK, messages)
+}
+
+//
+// @Description The following API endpoint can be used to purge queued messages while the agent keeps running.
+// @Description The messages can be selected by subject, age and payload type.
+// @Tags    agent, connector
+// @Accept  json
+// @Produce json
+// @Success 200 {object} services.QueueResultDTO
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal server error"
+// @Router  /queue/purge [post]
+// @Param   filter           body      services.QueuePurgeDTO     true        "Filter"
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) purgeQueue(c *gin.Context) {
+	var purgeDTO QueuePurgeDTO
+	if err := c.ShouldBindJSON(&purgeDTO); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if purgeDTO == (QueuePurgeDTO{}) {
+		c.JSON(http.StatusBadRequest, "empty filter")
+		return
+	}
+
+	filter := nats.PurgeFilter{}
+	if purgeDTO.OlderThan != "" {
+		olderThan, err := time.ParseDuration(purgeDTO.OlderThan)
+		if err != nil || olderThan <= 0 {
+			c.JSON(http.StatusBadRequest, "olderThan should be positive duration")
+			return
+		}
+		filter.Before = time.Now().Add(-olderThan)
+	}
+	if purgeDTO.PayloadType != "" {
+		var pt payloadType
+		if err := pt.FromString(purgeDTO.PayloadType); err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		filter.Match = func(msg *nats.Msg) bool {
+			p := natsPayload{}
+			return p.Unmarshal(msg.Data) == nil && p.Type == pt
+		}
+	}
+	subjects := []string{subjDowntime, subjEvents, subjInventoryMetrics}
+	if purgeDTO.Subject != "" {
+		subjects = []string{purgeDTO.Subject}
+	}
+
+	result := QueueResultDTO{}
+	for _, subject := range subjects {
+		removed, err := nats.PurgeMsgs(subject, filter)
+		result.Removed += removed
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	log.Info().Interface("filter", purgeDTO).
+		Uint64("removed", result.Removed).
+		Msg("purged queue")
+	c.JSON(http.StatusOK, result)
+}
+
+//
+// @Description The following API endpoint can be used to reset the position of durable while the agent keeps running.
+// @Description The durable moves to new messages or to the start sequence.
+// @Tags    agent, connector
+// @Accept  json
+// @Produce json
+// @Success 200 {object} services.QueueResultDTO
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 404 {string} string "Not found"
+// @Failure 500 {string} string "Internal server error"
+// @Router  /queue/reset-durable [post]
+// @Param   durable          body      services.QueueResetDTO     true        "Durable"
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) resetDurable(c *gin.Context) {
+	var resetDTO QueueResetDTO
+	if err := c.ShouldBindJSON(&resetDTO); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if resetDTO.DurableName == "" {
+		c.JSON(http.StatusBadRequest, "durableName is required")
+		return
+	}
+	skipped, err := nats.ResetDurable(resetDTO.DurableName, resetDTO.StartSeq)
+	if errors.Is(err, nats.ErrDispatcher) {
+		c.JSON(http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, QueueResultDTO{Removed: skipped})
+}
+
+func makeQueueMessageDTO(msg *nats.Msg) QueueMessageDTO {
+	messageDTO := QueueMessageDTO{
+		Sequence:  msg.Sequence,
+		Timestamp: msg.Timestamp,
+	}
+	p := natsPayload{}
+	if err := p.Unmarshal(msg.Data); err != nil {
+		messageDTO.Error = err.Error()
+		messageDTO.PayloadSize = len(msg.Data)
+		return messageDTO
+	}
+	messageDTO.Type = p.Type.String()
+	messageDTO.PayloadSize = len(p.Payload)
+	if p.SpanContext.HasTraceID() {
+		messageDTO.TraceID = p.SpanContext.TraceID().String()
+	}
+	if p.SpanContext.HasSpanID() {
+		messageDTO.SpanID = p.SpanContext.SpanID().String()
+	}
+	return messageDTO
+}
+
 //
 // @Description The following API endpoint can be used to start NATS dispatcher.
 // @Tags    agent, connector
@@ -364,6 +891,7 @@ func (controller *Controller) start(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, err.Error())
 		return
 	}
+	c.Set(ctxKeyTask, task)
 	c.JSON(http.StatusOK, ConnectorStatusDTO{StatusProcessing, task.Idx})
 }
 
@@ -389,6 +917,7 @@ func (controller *Controller) stop(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, err.Error())
 		return
 	}
+	c.Set(ctxKeyTask, task)
 	c.JSON(http.StatusOK, ConnectorStatusDTO{StatusProcessing, task.Idx})
 }
 
@@ -406,6 +935,39 @@ func (controller *Controller) stats(c *gin.Context) {
 	c.JSON(http.StatusOK, controller.Stats())
 }
 
+//
+// @Description The following API endpoint can be used as liveness probe.
+// @Description The agent is alive while the task queue is not stuck.
+// @Tags    agent, connector
+// @Produce json
+// @Success 200 {object} services.ProbeDTO
+// @Failure 503 {object} services.ProbeDTO
+// @Router  /healthz [get]
+func (controller *Controller) healthz(c *gin.Context) {
+	probe := controller.Health()
+	c.JSON(probeCode(probe), probe)
+}
+
+//
+// @Description The following API endpoint can be used as readiness probe.
+// @Description The agent is ready when configured, with NATS and transport running, and upstream delivery not failing.
+// @Tags    agent, connector
+// @Produce json
+// @Success 200 {object} services.ProbeDTO
+// @Failure 503 {object} services.ProbeDTO
+// @Router  /readyz [get]
+func (controller *Controller) readyz(c *gin.Context) {
+	probe := controller.Readiness()
+	c.JSON(probeCode(probe), probe)
+}
+
+func probeCode(probe ProbeDTO) int {
+	if probe.Status != probeOK {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
 //
 // @Description The following API endpoint can be used to get a TCG agent id
 // @Tags    agent, connector
@@ -422,16 +984,16 @@ func (controller *Controller) agentIdentity(c *gin.Context) {
 // @Tags    agent, connector
 // @Accept  json
 // @Produce json
-// @Success 200 {object} services.ConnectorStatusDTO
+// @Success 200 {object} services.StatusDTO
 // @Failure 401 {string} string "Unauthorized"
 // @Router  /status [get]
 // @Param   GWOS-APP-NAME    header    string     true        "Auth header"
 // @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
 func (controller *Controller) status(c *gin.Context) {
 	status := controller.Status()
-	statusDTO := ConnectorStatusDTO{status.Transport, 0}
+	statusDTO := StatusDTO{ConnectorStatusDTO{status.Transport, 0}, nats.BreakerStates()}
 	if status.task != nil {
-		statusDTO = ConnectorStatusDTO{StatusProcessing, status.task.Idx}
+		statusDTO.ConnectorStatusDTO = ConnectorStatusDTO{StatusProcessing, status.task.Idx}
 	}
 	c.JSON(http.StatusOK, statusDTO)
 }
@@ -450,113 +1012,407 @@ func (controller *Controller) version(c *gin.Context) {
 	c.JSON(http.StatusOK, config.GetBuildInfo())
 }
 
-//func (controller *Controller) checkAccess(c *gin.Context) {
-//	if config.GetConfig().IsConfiguringPMC() {
-//		log.Info().Str("url", c.Request.URL.Redacted()).
-//			Msg("omit access check on configuring PARENT_MANAGED_CHILD")
-//		return
-//	}
-//if len(controller.dsClient.HostName) == 0 && len(controller.gwClients) == 0 {
-//	log.Info().Str("url", c.Request.URL.Redacted()).
-//		Msg("omit access check on empty config")
-//	return
-//}
-//
-//	/* check local pin */
-//	pin := controller.Connector.ControllerPin
-//	if len(pin) > 0 && pin == c.Request.Header.Get("X-PIN") {
-//		log.Debug().Str("url", c.Request.URL.Redacted()).
-//			Msg("access allowed with X-PIN")
-//		return
-//	}
-//
-//	hashFn := func(args ...string) (string, error) {
-//		h, err := blake2b.New512(nil)
-//		if err != nil {
-//			return "", err
-//		}
-//		for _, s := range args {
-//			if _, err := io.WriteString(h, s); err != nil {
-//				return "", err
-//			}
-//		}
-//		sum := h.Sum(nil)
-//		return hex.EncodeToString(sum[:]), nil
-//	}
-//
-//	/* check basic auth */
-//	if username, password, hasAuth := c.Request.BasicAuth(); hasAuth {
-//		var err error
-//		defer func() {
-//			if err == nil {
-//				log.Debug().Str("url", c.Request.URL.Redacted()).
-//					Str("username", username).
-//					Msg("access allowed with BASIC")
-//				return
-//			}
-//			log.Warn().Err(err).Str("url", c.Request.URL.Redacted()).
-//				Str("username", username).
-//				Msg("access disallowed with BASIC")
-//			c.AbortWithStatusJSON(http.StatusUnauthorized,
-//				gin.H{"error": err.Error()})
-//		}()
 //
-//if !(len(username) > 0 && len(password) > 0 && len(controller.gwClients) > 0) {
-//	err = fmt.Errorf("misconfigured BASIC auth")
-//	return
-//}
-//ck, err := hashFn(username, password)
-//if err == nil {
-//	if _, isCached := controller.authCache.Get(ck); !isCached {
-//		/* restrict by mutex for one-thread at one-time */
-//		controller.muBASIC.Lock()
-//		if _, isCached := controller.authCache.Get(ck); !isCached {
-//			if _, err = controller.gwClients[0].AuthenticatePassword(username, password); err == nil {
-//				err = controller.authCache.Add(ck, true, time.Hour)
-//			}
-//		}
-//		controller.muBASIC.Unlock()
-//	}
-//}
-//		return
-//	}
+// @Description The following API endpoint can be used to get the state of asynchronous task by jobId.
+// @Description The wait parameter holds the request until the task is done, limited by the controller write timeout.
+// @Tags    agent, connector
+// @Produce json
+// @Param   id        path      int        true        "Task id returned as jobId"
+// @Param   wait      query     string     false       "Duration to wait for the task done like 10s"
+// @Success 200 {object} services.TaskDTO
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 404 {string} string "Task not found"
+// @Router  /tasks/{id} [get]
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) getTask(c *gin.Context) {
+	idx, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, "could not parse task id")
+		return
+	}
+	var wait time.Duration
+	if v := c.Query("wait"); v != "" {
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 {
+			c.JSON(http.StatusBadRequest, "could not parse wait duration")
+			return
+		}
+		/* respond before the server drops the connection */
+		if limit := controller.Connector.ControllerWriteTimeout - time.Second; limit > 0 && wait > limit {
+			wait = limit
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), wait)
+	defer cancel()
+	st, err := controller.taskQueue.WaitTask(ctx, idx)
+	if errors.Is(err, taskQueue.ErrTaskQueueNotFound) {
+		c.JSON(http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, makeTaskDTO(st))
+}
+
+func makeTaskDTO(st taskQueue.TaskState) TaskDTO {
+	dto := TaskDTO{
+		ID:        st.Idx,
+		Subject:   fmt.Sprint(st.Subject),
+		Status:    "waiting",
+		Submitted: st.Submitted,
+	}
+	if !st.Started.IsZero() {
+		dto.Started = &st.Started
+		dto.Status = "processing"
+	}
+	if st.IsDone() {
+		dto.Finished = &st.Finished
+		dto.Status = "success"
+		if st.Err != nil {
+			dto.Status, dto.Error = "failure", st.Err.Error()
+		}
+	}
+	return dto
+}
+
 //
-//	/* check gwos auth */
-//	gwosAppName := c.Request.Header.Get("GWOS-APP-NAME")
-//	gwosAPIToken := c.Request.Header.Get("GWOS-API-TOKEN")
-//	var err error
-//	defer func() {
-//		if err == nil {
-//			log.Debug().Str("url", c.Request.URL.Redacted()).
-//				Str("gwosAppName", gwosAppName).
-//				Msg("access allowed with GWOS")
-//			return
-//		}
-//		log.Warn().Err(err).Str("url", c.Request.URL.Redacted()).
-//			Str("gwosAppName", gwosAppName).
-//			Msg("access disallowed with GWOS")
-//		c.AbortWithStatusJSON(http.StatusUnauthorized,
-//			gin.H{"error": err.Error()})
-//	}()
-
-//if !(len(gwosAppName) > 0 && len(gwosAPIToken) > 0 && len(controller.dsClient.HostName) > 0) {
-//	err = fmt.Errorf("misconfigured GWOS auth")
-//	return
-//}
-//ck, err := hashFn(gwosAppName, gwosAPIToken)
-//if err == nil {
-//	if _, isCached := controller.authCache.Get(ck); !isCached {
-//		/* restrict by mutex for one-thread at one-time */
-//		controller.muGWOS.Lock()
-//		if _, isCached := controller.authCache.Get(ck); !isCached {
-//			if err = controller.dsClient.ValidateToken(gwosAppName, gwosAPIToken); err == nil {
-//				err = controller.authCache.Add(ck, true, time.Hour)
-//			}
-//		}
-//		controller.muGWOS.Unlock()
-//	}
-//}
-//}
+// @Description The following API endpoint can be used to query audit records of state-changing calls.
+// @Tags    agent, connector
+// @Produce json
+// @Param   from      query     string     false       "RFC3339 time of the earliest record"
+// @Param   to        query     string     false       "RFC3339 time of the latest record"
+// @Param   route     query     string     false       "Route glob pattern like /api/v1/queue/*"
+// @Param   limit     query     int        false       "Max number of latest records, 1..1000, default 100"
+// @Success 200 {array} services.AuditRecord
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 404 {string} string "Audit is turned off"
+// @Router  /audit [get]
+// @Param   GWOS-APP-NAME    header    string     true        "Auth header"
+// @Param   GWOS-API-TOKEN   header    string     true        "Auth header"
+func (controller *Controller) listAudit(c *gin.Context) {
+	filter := auditFilter{Route: c.Query("route"), Limit: 100}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > 1000 {
+			c.JSON(http.StatusBadRequest, "limit should be in range 1..1000")
+			return
+		}
+		filter.Limit = limit
+	}
+	for _, p := range []struct {
+		key string
+		t   *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if v := c.Query(p.key); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, fmt.Sprintf("could not parse %s: %s", p.key, err))
+				return
+			}
+			*p.t = t
+		}
+	}
+	if controller.audit == nil {
+		c.JSON(http.StatusNotFound, "audit is turned off")
+		return
+	}
+	records, err := controller.audit.query(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+// checkAccess returns middleware allowing requests granted with the role
+// the "control" role includes the "monitor" one
+func (controller *Controller) checkAccess(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.GetConfig().IsConfiguringPMC() {
+			log.Info().Str("url", c.Request.URL.Redacted()).
+				Msg("omit access check on configuring PARENT_MANAGED_CHILD")
+			return
+		}
+		if controller.isUnconfigured() {
+			log.Info().Str("url", c.Request.URL.Redacted()).
+				Msg("omit access check on empty config")
+			return
+		}
+
+		access, err := controller.authenticate(c.Request)
+		if err != nil {
+			log.Warn().Err(err).Str("url", c.Request.URL.Redacted()).
+				Str("method", access.Method).
+				Msg("access disallowed")
+			c.AbortWithStatusJSON(http.StatusUnauthorized,
+				gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(ctxKeyAccess, access)
+		if !(access.Role == role || access.Role == config.ControllerRoleControl) {
+			log.Warn().Str("url", c.Request.URL.Redacted()).
+				Str("method", access.Method).Str("identity", access.Identity).
+				Str("role", access.Role).
+				Msg("access disallowed for role")
+			c.AbortWithStatusJSON(http.StatusForbidden,
+				gin.H{"error": fmt.Sprintf("%s role required", role)})
+			return
+		}
+		log.Debug().Str("url", c.Request.URL.Redacted()).
+			Str("method", access.Method).Str("identity", access.Identity).
+			Str("role", access.Role).
+			Msg("access allowed")
+	}
+}
+
+// rejectDraining refuses the state-changing calls while draining on exit
+func (controller *Controller) rejectDraining(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return
+	}
+	if controller.isDraining() {
+		log.Info().Str("url", c.Request.URL.Redacted()).
+			Msg("call refused while draining on exit")
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable,
+			gin.H{"error": "agent is exiting"})
+	}
+}
+
+// accessInfo describes the authenticated caller
+type accessInfo struct {
+	Method   string
+	Identity string
+	Role     string
+}
+
+// isUnconfigured checks there is no way to authenticate callers
+// so the fresh agent accepts the initial config
+func (controller *Controller) isUnconfigured() bool {
+	con := controller.Connector
+	return len(con.ControllerPin) == 0 && len(con.ControllerTokens) == 0 &&
+		(len(con.ControllerClientCerts) == 0 || con.ControllerClientCAFile == "") &&
+		controller.upstreamAuthenticator() == nil && controller.upstreamTokenValidator() == nil
+}
+
+// authenticate returns the role granted for request with the auth method and caller identity
+// the methods are checked in order: X-PIN, client certificate, API token, BASIC
+// the GWOS app tokens not matching static ones are verified by upstream
+func (controller *Controller) authenticate(r *http.Request) (accessInfo, error) {
+	/* check local pin */
+	if pin := controller.Connector.ControllerPin; len(pin) > 0 && r.Header.Get("X-PIN") != "" {
+		access := accessInfo{Method: "X-PIN", Identity: "pin"}
+		pin = resolveSecret("ControllerPin", pin)
+		if len(pin) > 0 && subtle.ConstantTimeCompare([]byte(pin), []byte(r.Header.Get("X-PIN"))) == 1 {
+			access.Role = config.ControllerRoleControl
+			return access, nil
+		}
+		return access, fmt.Errorf("invalid X-PIN")
+	}
+
+	/* check client certificate verified on TLS handshake */
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, cc := range controller.Connector.ControllerClientCerts {
+			if matched, _ := path.Match(cc.CommonName, cn); matched || cc.CommonName == "*" {
+				return accessInfo{Method: "mTLS", Identity: cn, Role: cc.Role}, nil
+			}
+		}
+	}
+
+	/* check static api tokens */
+	gwosAppName, gwosAPIToken := r.Header.Get("GWOS-APP-NAME"), r.Header.Get("GWOS-API-TOKEN")
+	token := gwosAPIToken
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token != "" {
+		for _, t := range controller.Connector.ControllerTokens {
+			if v := resolveSecret("ControllerTokens."+t.Name, t.Token); len(v) > 0 &&
+				subtle.ConstantTimeCompare([]byte(v), []byte(token)) == 1 {
+				return accessInfo{Method: "token", Identity: t.Name, Role: t.Role}, nil
+			}
+		}
+		/* check gwos auth */
+		if len(gwosAppName) > 0 && token == gwosAPIToken {
+			access := accessInfo{Method: "GWOS", Identity: gwosAppName}
+			if err := controller.authenticateToken(gwosAppName, gwosAPIToken); err != nil {
+				return access, err
+			}
+			access.Role = controller.Connector.ControllerBasicRole
+			return access, nil
+		}
+		return accessInfo{Method: "token"}, fmt.Errorf("invalid API token")
+	}
+
+	/* check basic auth */
+	if username, password, hasAuth := r.BasicAuth(); hasAuth {
+		access := accessInfo{Method: "BASIC", Identity: username}
+		if err := controller.authenticateBasic(username, password); err != nil {
+			return access, err
+		}
+		access.Role = controller.Connector.ControllerBasicRole
+		return access, nil
+	}
+
+	return accessInfo{}, fmt.Errorf("missing credentials")
+}
+
+// resolveSecret returns the value of secret reference
+// returns empty value on failure to deny the access
+func resolveSecret(field, value string) string {
+	v, err := secrets.Resolve(value)
+	if err != nil {
+		log.Warn().Err(err).Str("field", field).Msg("could not resolve secret")
+		return ""
+	}
+	return v
+}
+
+// authenticateBasic verifies credentials by upstream
+// the successful result is cached
+func (controller *Controller) authenticateBasic(username, password string) error {
+	if !(len(username) > 0 && len(password) > 0) {
+		return fmt.Errorf("misconfigured BASIC auth")
+	}
+	ck, err := hashsum("BASIC", username, password)
+	if err != nil {
+		return err
+	}
+	if _, isCached := controller.authCache.Get(ck); isCached {
+		return nil
+	}
+	/* restrict by mutex for one-thread at one-time */
+	controller.muBASIC.Lock()
+	defer controller.muBASIC.Unlock()
+	if _, isCached := controller.authCache.Get(ck); isCached {
+		return nil
+	}
+	authFn := controller.upstreamAuthenticator()
+	if authFn == nil {
+		return fmt.Errorf("misconfigured BASIC auth: no upstream")
+	}
+	if err := authFn(username, password); err != nil {
+		return err
+	}
+	controller.authCache.Set(ck, true, time.Hour)
+	return nil
+}
+
+// authenticateToken verifies GWOS app token by upstream
+// the successful result is cached
+func (controller *Controller) authenticateToken(appName, apiToken string) error {
+	ck, err := hashsum("GWOS", appName, apiToken)
+	if err != nil {
+		return err
+	}
+	if _, isCached := controller.authCache.Get(ck); isCached {
+		return nil
+	}
+	/* restrict by mutex for one-thread at one-time */
+	controller.muGWOS.Lock()
+	defer controller.muGWOS.Unlock()
+	if _, isCached := controller.authCache.Get(ck); isCached {
+		return nil
+	}
+	validateFn := controller.upstreamTokenValidator()
+	if validateFn == nil {
+		return fmt.Errorf("misconfigured GWOS auth: no upstream")
+	}
+	if err := validateFn(appName, apiToken); err != nil {
+		return err
+	}
+	controller.authCache.Set(ck, true, time.Hour)
+	return nil
+}
+
+// upstreamTokenValidator returns token verifier of the first enabled GW connection
+// returns nil if there is no suitable connection
+func (controller *Controller) upstreamTokenValidator() func(appName, apiToken string) error {
+	for _, con := range config.GetConfig().GWConnections {
+		if con.Enabled && con.HostName != "" {
+			client := &sdkclients.GWClient{
+				AppName:      controller.AppName,
+				AppType:      controller.AppType,
+				GWConnection: (*sdkclients.GWConnection)(con),
+			}
+			return client.ValidateToken
+		}
+	}
+	return nil
+}
+
+// upstreamAuthenticator returns password verifier of the first enabled GW or TCG connection
+// returns nil if there is no suitable connection
+func (controller *Controller) upstreamAuthenticator() func(username, password string) error {
+	for _, con := range config.GetConfig().GWConnections {
+		if con.Enabled && con.HostName != "" {
+			client := &sdkclients.GWClient{
+				AppName:      controller.AppName,
+				AppType:      controller.AppType,
+				GWConnection: (*sdkclients.GWConnection)(con),
+			}
+			return func(username, password string) error {
+				_, err := client.AuthenticatePassword(username, password)
+				return err
+			}
+		}
+	}
+	for _, con := range config.GetConfig().TCGConnections {
+		if con.Enabled && con.HostName != "" && !con.LocalConnection {
+			client := &clients.TCGClient{
+				AppName:       controller.AppName,
+				AppType:       controller.AppType,
+				TCGConnection: (*clients.TCGConnection)(con),
+			}
+			return client.AuthenticatePassword
+		}
+	}
+	return nil
+}
+
+// hashsum returns the hex encoded hash of args
+// used for cache keys to not keep credentials in memory
+// the args are length-prefixed so the different splits don't collide
+func hashsum(args ...string) (string, error) {
+	h, err := blake2b.New512(nil)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range args {
+		if _, err := fmt.Fprintf(h, "%d:%s", len(s), s); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// makeTLSConfig returns the TLS configuration verifying client certificates if any
+// returns nil if ControllerClientCAFile is not set
+func (controller *Controller) makeTLSConfig() (*tls.Config, error) {
+	caFile := controller.Connector.ControllerClientCAFile
+	if caFile == "" {
+		return nil, nil
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("could not parse client CA file: %s", caFile)
+	}
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
 
 func (controller *Controller) registerAPI1(router *gin.Engine, addr string, entrypoints []Entrypoint) {
 	swaggerURL := ginSwagger.URL("http://" + addr + "/swagger/doc.json")
@@ -566,26 +1422,53 @@ func (controller *Controller) registerAPI1(router *gin.Engine, addr string, entr
 	apiV1Identity := router.Group("/api/v1/identity")
 	apiV1Identity.GET("", controller.agentIdentity)
 
+	/* probes for orchestrators */
+	router.GET("/healthz", controller.healthz)
+	router.GET("/readyz", controller.readyz)
+
+	/* self-metrics in Prometheus format, the "/api/v1/metrics" is taken by connector */
+	router.GET("/metrics", controller.checkAccess(config.ControllerRoleMonitor),
+		gin.WrapH(promhttp.HandlerFor(selfMetrics.registry, promhttp.HandlerOpts{})))
+
 	/* private entrypoints */
+	/* read-only monitoring is allowed for "monitor" role, other ones require "control" role */
+	apiV1Monitor := router.Group("/api/v1")
+	apiV1Monitor.Use(controller.checkAccess(config.ControllerRoleMonitor))
 	apiV1Group := router.Group("/api/v1")
-	//apiV1Group.Use(controller.checkAccess)
+	apiV1Group.Use(controller.auditAccess, controller.checkAccess(config.ControllerRoleControl),
+		controller.rejectDraining)
 
 	apiV1Group.POST("/config", controller.config)
+	apiV1Group.POST("/clear-in-downtime", controller.clearInDowntime)
+	apiV1Group.POST("/set-in-downtime", controller.setInDowntime)
 	apiV1Group.POST("/events", controller.events)
 	apiV1Group.POST("/events-ack", controller.eventsAck)
 	apiV1Group.POST("/events-unack", controller.eventsUnack)
-	apiV1Group.GET("/metrics", controller.listMetrics)
+	apiV1Monitor.GET("/metrics", controller.listMetrics)
+	apiV1Group.POST("/metrics", controller.resourcesWithMetrics)
+	apiV1Group.POST("/inventory", controller.inventory)
 	apiV1Group.POST("/reset-nats", controller.resetNats)
+	apiV1Monitor.GET("/dead-letters", controller.listDeadLetters)
+	apiV1Monitor.GET("/dead-letters/:id", controller.getDeadLetter)
+	apiV1Group.POST("/dead-letters/replay", controller.replayDeadLetters)
+	apiV1Group.POST("/dead-letters/purge", controller.purgeDeadLetters)
+	apiV1Monitor.GET("/queue", controller.queue)
+	apiV1Monitor.GET("/queue/:subject/messages", controller.peekQueue)
+	apiV1Group.POST("/queue/purge", controller.purgeQueue)
+	apiV1Group.POST("/queue/reset-durable", controller.resetDurable)
 	apiV1Group.POST("/start", controller.start)
 	apiV1Group.POST("/stop", controller.stop)
-	apiV1Group.GET("/stats", controller.stats)
-	apiV1Group.GET("/status", controller.status)
-	apiV1Group.GET("/version", controller.version)
+	apiV1Monitor.GET("/stats", controller.stats)
+	apiV1Monitor.GET("/status", controller.status)
+	apiV1Monitor.GET("/version", controller.version)
+	apiV1Group.GET("/audit", controller.listAudit)
+	apiV1Monitor.GET("/tasks/:id", controller.getTask)
 
+	/* custom entrypoints are allowed for "monitor" role on GET */
 	for _, entrypoint := range entrypoints {
 		switch entrypoint.Method {
 		case http.MethodGet:
-			apiV1Group.GET(entrypoint.URL, entrypoint.Handler)
+			apiV1Monitor.GET(entrypoint.URL, entrypoint.Handler)
 		case http.MethodPost:
 			apiV1Group.POST(entrypoint.URL, entrypoint.Handler)
 		case http.MethodPut:
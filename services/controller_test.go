@@ -1,16 +1,28 @@
 package services
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/gwos/tcg/config"
+	"github.com/gwos/tcg/nats"
+	"github.com/gwos/tcg/sdk/transit"
 	"github.com/stretchr/testify/assert"
 )
 
 func init() {
 	config.GetConfig().Connector.AppName = "test"
+	config.GetConfig().Connector.AuditFile = ""
+	config.GetConfig().Connector.NatsBackend = "LOCAL"
 	config.GetConfig().Connector.NatsStoreType = "MEMORY"
 	config.GetConfig().GWConnections = []*config.GWConnection{
 		{
@@ -86,3 +98,441 @@ func TestController_StartStopTransport(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, res.StatusCode, "status code should match the expected response")
 }
+
+func TestController_queue(t *testing.T) {
+	controller := GetController()
+	assert.NoError(t, controller.StartNats())
+	defer func() { assert.NoError(t, controller.StopNats()) }()
+
+	b, err := natsPayload{Payload: []byte(`{"events":[]}`), Type: typeEvents}.Marshal()
+	assert.NoError(t, err)
+	assert.NoError(t, nats.Publish(subjEvents, b))
+	assert.NoError(t, nats.Publish(subjEvents, []byte("bad")))
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	controller.queue(c)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	queueDTO := QueueDTO{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queueDTO))
+	var subjectDTO QueueSubjectDTO
+	for _, st := range queueDTO.Subjects {
+		if st.Subject == subjEvents {
+			subjectDTO = st
+		}
+	}
+	assert.Equal(t, uint64(2), subjectDTO.Msgs)
+	assert.Greater(t, subjectDTO.OldestAgeSeconds, float64(0))
+
+	rec = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(rec)
+	c.Params = gin.Params{{Key: "subject", Value: subjEvents}}
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/queue/events/messages?limit=5", nil)
+	controller.peekQueue(c)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	messages := []QueueMessageDTO{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &messages))
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "events", messages[0].Type)
+	assert.Equal(t, 13, messages[0].PayloadSize)
+	assert.Empty(t, messages[0].Error)
+	assert.NotEmpty(t, messages[1].Error)
+}
+
+func TestController_purgeQueue(t *testing.T) {
+	controller := GetController()
+	assert.NoError(t, controller.StartNats())
+	defer func() { assert.NoError(t, controller.StopNats()) }()
+
+	for _, pt := range []payloadType{typeEvents, typeEventsAck, typeEvents} {
+		b, err := natsPayload{Payload: []byte(`{}`), Type: pt}.Marshal()
+		assert.NoError(t, err)
+		assert.NoError(t, nats.Publish(subjEvents, b))
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, tc := range []struct {
+		body     string
+		code     int
+		expected string
+	}{
+		{`{}`, http.StatusBadRequest, `"empty filter"`},
+		{`{"payloadType":"unknown"}`, http.StatusBadRequest, `"unknown payload type"`},
+		{`{"olderThan":"1h"}`, http.StatusOK, `{"removed":0}`},
+		{`{"payloadType":"events"}`, http.StatusOK, `{"removed":2}`},
+		{`{"subject":"events"}`, http.StatusOK, `{"removed":1}`},
+	} {
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/queue/purge", strings.NewReader(tc.body))
+		controller.purgeQueue(c)
+		assert.Equal(t, tc.code, rec.Code, tc.body)
+		assert.Equal(t, tc.expected, rec.Body.String(), tc.body)
+	}
+}
+
+func TestController_checkAccess(t *testing.T) {
+	var logins int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logins++
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := config.GetConfig()
+	connector := *cfg.Connector
+	gwConnections, tcgConnections := cfg.GWConnections, cfg.TCGConnections
+	defer func() {
+		*cfg.Connector = connector
+		cfg.GWConnections, cfg.TCGConnections = gwConnections, tcgConnections
+	}()
+	cfg.Connector.ControllerPin = "pin"
+	cfg.Connector.ControllerTokens = config.ControllerTokens{
+		{Name: "grafana", Token: "monitor-token", Role: config.ControllerRoleMonitor},
+		{Name: "ops", Token: "control-token", Role: config.ControllerRoleControl},
+	}
+	cfg.GWConnections = nil
+	cfg.TCGConnections = config.TCGConnections{{Enabled: true, HostName: upstream.URL}}
+
+	controller := GetController()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	controller.registerAPI1(router, "localhost", nil)
+
+	do := func(method, url string, header http.Header) int {
+		req := httptest.NewRequest(method, url, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	basic := func(user, pass string) http.Header {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth(user, pass)
+		return r.Header
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/identity", nil))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/v1/stats", nil))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/v1/debug/pprof/cmdline", nil))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/v1/stats",
+		http.Header{"X-Pin": {"wrong"}}))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/stats",
+		http.Header{"X-Pin": {"pin"}}))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/debug/pprof/cmdline",
+		http.Header{"X-Pin": {"pin"}}))
+
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/v1/status",
+		http.Header{"Authorization": {"Bearer wrong"}}))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/status",
+		http.Header{"Authorization": {"Bearer monitor-token"}}))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/api/v1/stop",
+		http.Header{"Authorization": {"Bearer monitor-token"}}))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/api/v1/debug/pprof/cmdline",
+		http.Header{"Gwos-Api-Token": {"monitor-token"}}))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/debug/pprof/cmdline",
+		http.Header{"Gwos-Api-Token": {"control-token"}}))
+
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/v1/stats", basic("user", "wrong")))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/stats", basic("user", "pass")))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/stats", basic("user", "pass")))
+	assert.Equal(t, 2, logins, "successful BASIC auth should be cached")
+}
+
+func TestController_checkAccessGWOS(t *testing.T) {
+	var validations int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validations++
+		_ = r.ParseForm()
+		valid := r.Form.Get("gwos-app-name") == "app" && r.Form.Get("gwos-api-token") == "gw-token"
+		_, _ = w.Write([]byte(strconv.FormatBool(valid)))
+	}))
+	defer upstream.Close()
+
+	cfg := config.GetConfig()
+	connector := *cfg.Connector
+	gwConnections, tcgConnections := cfg.GWConnections, cfg.TCGConnections
+	defer func() {
+		*cfg.Connector = connector
+		cfg.GWConnections, cfg.TCGConnections = gwConnections, tcgConnections
+	}()
+	cfg.Connector.ControllerPin = ""
+	cfg.Connector.ControllerTokens = nil
+	cfg.GWConnections, cfg.TCGConnections = nil, nil
+
+	controller := GetController()
+	controller.authCache.Flush()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	controller.registerAPI1(router, "localhost", nil)
+
+	do := func(method, url string, header http.Header) int {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header = header
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	gwos := func(appName, apiToken string) http.Header {
+		return http.Header{"Gwos-App-Name": {appName}, "Gwos-Api-Token": {apiToken}}
+	}
+
+	/* the fresh agent accepts the initial config */
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/stats", http.Header{}))
+
+	cfg.GWConnections = config.GWConnections{{Enabled: true, HostName: upstream.URL}}
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/v1/stats", http.Header{}))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/v1/stats", gwos("app", "wrong")))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/v1/stats",
+		http.Header{"Gwos-Api-Token": {"gw-token"}}))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/stats", gwos("app", "gw-token")))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/stats", gwos("app", "gw-token")))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/api/v1/stop", gwos("app", "gw-token")))
+	assert.Equal(t, 2, validations, "successful GWOS auth should be cached")
+}
+
+func TestHashsum(t *testing.T) {
+	h1, err := hashsum("BASIC", "ab", "c")
+	assert.NoError(t, err)
+	h2, err := hashsum("BASIC", "a", "bc")
+	assert.NoError(t, err)
+	assert.NotEqual(t, h1, h2)
+}
+
+func TestController_auditAccess(t *testing.T) {
+	cfg := config.GetConfig()
+	connector := *cfg.Connector
+	defer func() { *cfg.Connector = connector }()
+	cfg.Connector.ControllerPin = "pin"
+
+	controller := GetController()
+	audit := controller.audit
+	defer func() { controller.audit = audit }()
+	controller.audit = newAuditLog(filepath.Join(t.TempDir(), "audit.log"), 512, 2)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	controller.registerAPI1(router, "localhost", nil)
+
+	do := func(method, url, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	pin := http.Header{"X-Pin": {"pin"}}
+
+	t0 := time.Now()
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/api/v1/config", `{}`, nil).Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/api/v1/config", `{bad`, pin).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/stats", "", pin).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/api/v1/reset-nats", "", pin).Code)
+
+	var records []AuditRecord
+	assert.Eventually(t, func() bool {
+		w := do(http.MethodGet, "/api/v1/audit?from="+t0.Add(-time.Second).Format(time.RFC3339), "", pin)
+		assert.Equal(t, http.StatusOK, w.Code)
+		records = nil
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &records))
+		return len(records) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, auditDenied, records[0].Outcome)
+		assert.Equal(t, "", records[0].Identity)
+		assert.Equal(t, 0, records[0].PayloadSize, "denied payload should not be read")
+
+		assert.Equal(t, "/api/v1/config", records[1].Route)
+		assert.Equal(t, auditFailure, records[1].Outcome)
+		assert.Equal(t, "X-PIN", records[1].AuthMethod)
+		assert.Equal(t, 4, records[1].PayloadSize)
+		assert.True(t, strings.HasPrefix(records[1].PayloadDigest, "sha256:"))
+
+		assert.Equal(t, "/api/v1/reset-nats", records[2].Route)
+		assert.NotZero(t, records[2].TaskIdx)
+		assert.Equal(t, auditSuccess, records[2].Outcome)
+	}
+
+	w := do(http.MethodGet, "/api/v1/audit?route=/api/v1/config&limit=1", "", pin)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &records))
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, http.StatusBadRequest, records[0].Status)
+	}
+	w = do(http.MethodGet, "/api/v1/audit?to="+t0.Add(-time.Hour).Format(time.RFC3339), "", pin)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &records))
+	assert.Empty(t, records)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/api/v1/audit?from=yesterday", "", pin).Code)
+}
+
+func TestController_getTask(t *testing.T) {
+	controller := GetController()
+	task, err := controller.ResetNatsAsync()
+	assert.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Params = gin.Params{{Key: "id", Value: strconv.FormatUint(task.Idx, 10)}}
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/tasks/1?wait=5s", nil)
+	controller.getTask(c)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var dto TaskDTO
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &dto))
+	assert.Equal(t, task.Idx, dto.ID)
+	assert.Equal(t, "resetNats", dto.Subject)
+	assert.Equal(t, "success", dto.Status)
+	assert.NotNil(t, dto.Finished)
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Params = gin.Params{{Key: "id", Value: strconv.FormatUint(task.Idx+100, 10)}}
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/tasks/0", nil)
+	controller.getTask(c)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestController_configDryRun(t *testing.T) {
+	controller := GetController()
+	gin.SetMode(gin.TestMode)
+	do := func(target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		controller.config(c)
+		return w
+	}
+	dto := `{"appName":"dry-run-app","groundworkConnections":[{"id":1,"enabled":true,"hostName":"gw host"}]}`
+
+	w := do("/api/v1/config?dryRun=true", dto)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res ConfigValidationDTO
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.False(t, res.Valid)
+	assert.Equal(t, []config.FieldIssue{
+		{Field: "gwConnections[0].hostName", Message: "should not contain spaces"},
+	}, res.Errors)
+	assert.NotEqual(t, "dry-run-app", config.GetConfig().Connector.AppName)
+
+	secretDTO := `{"groundworkConnections":[{"id":1,"hostName":"gw-host","password":"env:GW_PASSWORD"}]}`
+	w = do("/api/v1/config?dryRun=true", secretDTO)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.False(t, res.Valid)
+	assert.Contains(t, res.Errors, config.FieldIssue{Field: "groundworkConnections[0].password",
+		Message: "env: and file: references are accepted in the local config only"})
+
+	w = do("/api/v1/config", secretDTO)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.False(t, res.Valid)
+
+	w = do("/api/v1/config?dryRun=1", `{"appName":"test","logLevel":2}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.True(t, res.Valid, res.Errors)
+}
+
+func TestController_selfMetrics(t *testing.T) {
+	cfg := config.GetConfig()
+	connector := *cfg.Connector
+	defer func() { *cfg.Connector = connector }()
+	cfg.Connector.ControllerTokens = config.ControllerTokens{
+		{Name: "prometheus", Token: "monitor-token", Role: config.ControllerRoleMonitor},
+	}
+
+	controller := GetController()
+	assert.NoError(t, controller.StartNats())
+	assert.NoError(t, controller.SendEventsAck(context.Background(), []byte(`{}`)))
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(selfMetrics.observeRequest)
+	controller.registerAPI1(router, "localhost", nil)
+
+	do := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header = header
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusUnauthorized, do(http.Header{}).Code)
+	w := do(http.Header{"Authorization": {"Bearer monitor-token"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `tcg_published_total{payload_type="eventsAck",result="success",subject="events"}`)
+	assert.Contains(t, body, `tcg_queue_messages{subject="events"}`)
+	assert.Contains(t, body, `tcg_batcher_flushes_total{batcher="metrics"}`)
+	assert.Contains(t, body, `tcg_controller_requests_total{code="401",method="GET",route="/metrics"} 1`)
+}
+
+func TestController_rejectDraining(t *testing.T) {
+	controller := GetController()
+	gin.SetMode(gin.TestMode)
+	do := func(method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(method, "/api/v1/events", nil)
+		controller.rejectDraining(c)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost).Code)
+	atomic.StoreInt32(&controller.draining, 1)
+	defer atomic.StoreInt32(&controller.draining, 0)
+	assert.Equal(t, http.StatusServiceUnavailable, do(http.MethodPost).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet).Code)
+}
+
+func TestController_probes(t *testing.T) {
+	controller := GetController()
+	cfg := config.GetConfig()
+	tcgConnections := cfg.TCGConnections
+	defer func() { cfg.TCGConnections = tcgConnections }()
+	cfg.TCGConnections = config.TCGConnections{{Enabled: true, HostName: "tcg-probe"}}
+
+	gin.SetMode(gin.TestMode)
+	do := func(handler gin.HandlerFunc) (int, ProbeDTO) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		handler(c)
+		var res ProbeDTO
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return w.Code, res
+	}
+	failed := func(probe ProbeDTO) []string {
+		var names []string
+		for _, check := range probe.Checks {
+			if !check.OK {
+				names = append(names, check.Name)
+			}
+		}
+		return names
+	}
+
+	code, res := do(controller.healthz)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, probeOK, res.Status)
+
+	assert.NoError(t, controller.StopNats())
+	code, res = do(controller.readyz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, probeFail, res.Status)
+	assert.Equal(t, []string{"nats", "transport"}, failed(res))
+
+	failingSince := transit.Timestamp{Time: time.Now().Add(-cfg.Connector.ReadyFailureThreshold * 2)}
+	controller.agentStats.add(statsCounter{timestamp: failingSince, connection: "tcg-probe", failed: true})
+	defer controller.agentStats.add(statsCounter{timestamp: *transit.NewTimestamp(), connection: "tcg-probe"})
+	_, res = do(controller.readyz)
+	assert.Equal(t, []string{"nats", "transport", "delivery"}, failed(res))
+}
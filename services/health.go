@@ -0,0 +1,104 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gwos/tcg/config"
+)
+
+// Define probe statuses
+const (
+	probeOK   = "ok"
+	probeFail = "fail"
+)
+
+func makeProbe(checks ...ProbeCheckDTO) ProbeDTO {
+	probe := ProbeDTO{Status: probeOK, Checks: checks}
+	for _, check := range checks {
+		if !check.OK {
+			probe.Status = probeFail
+		}
+	}
+	return probe
+}
+
+// Health returns the liveness of agent
+// the agent is alive while the task queue is not stuck past taskQueueAlarm
+func (service *AgentService) Health() ProbeDTO {
+	return makeProbe(
+		ProbeCheckDTO{
+			Name:    "process",
+			OK:      true,
+			Message: fmt.Sprintf("up since %s", service.agentStats.stats().UpSince.Format(time.RFC3339)),
+		},
+		service.checkTaskQueue(),
+	)
+}
+
+// Readiness returns the readiness of agent
+// the agent is ready when configured, with NATS and transport running,
+// and the upstream delivery is not failing longer than ReadyFailureThreshold
+func (service *AgentService) Readiness() ProbeDTO {
+	return makeProbe(
+		service.checkConfigured(),
+		checkStatus("nats", service.agentStatus.Nats),
+		checkStatus("transport", service.agentStatus.Transport),
+		service.checkDelivery(),
+	)
+}
+
+func (service *AgentService) checkTaskQueue() ProbeCheckDTO {
+	check := ProbeCheckDTO{Name: "taskQueue", OK: true}
+	state, ok := service.taskQueue.Current()
+	if !ok {
+		return check
+	}
+	if d := time.Since(state.Started); d > taskQueueAlarm {
+		check.OK = false
+		check.Message = fmt.Sprintf("task %v is processing for %s", state.Subject, d.Round(time.Second))
+	}
+	return check
+}
+
+func (service *AgentService) checkConfigured() ProbeCheckDTO {
+	check := ProbeCheckDTO{Name: "config", OK: true}
+	if config.GetConfig().IsConfiguringPMC() {
+		check.OK, check.Message = false, "configuring PARENT_MANAGED_CHILD"
+		return check
+	}
+	for _, con := range config.GetConfig().TCGConnections {
+		if con.Enabled {
+			return check
+		}
+	}
+	check.OK, check.Message = false, "no enabled TCG connections"
+	return check
+}
+
+func (service *AgentService) checkDelivery() ProbeCheckDTO {
+	check := ProbeCheckDTO{Name: "delivery", OK: true}
+	threshold := service.Connector.ReadyFailureThreshold
+	stats := service.agentStats.stats()
+	for _, con := range config.GetConfig().TCGConnections {
+		if !con.Enabled {
+			continue
+		}
+		if st, ok := stats.Connections[con.HostName]; ok && st.FailingSince != nil {
+			if d := time.Since(st.FailingSince.Time); d > threshold {
+				check.OK = false
+				check.Message = fmt.Sprintf("delivery to %s is failing for %s", con.HostName, d.Round(time.Second))
+				return check
+			}
+		}
+	}
+	return check
+}
+
+func checkStatus(name string, status Status) ProbeCheckDTO {
+	check := ProbeCheckDTO{Name: name, OK: status == StatusRunning}
+	if !check.OK {
+		check.Message = string(status)
+	}
+	return check
+}
@@ -0,0 +1,342 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sync"
+
+	"github.com/gwos/tcg/clients"
+	"github.com/gwos/tcg/sdk/transit"
+)
+
+// routingItem describes the payload item checked by routing rules
+// NoGroups marks the item with unknown groups: the payload carries no groups
+// and the host is not known from inventory, so it doesn't match HostGroup rules
+type routingItem struct {
+	AppType  string
+	Host     string
+	Groups   []string
+	Service  string
+	NoGroups bool
+}
+
+// routingRules wraps rules of TCG Connection
+type routingRules []clients.RoutingRule
+
+// routingHosts keeps the host groups from the last inventory
+// used to route the payload items which carry no groups
+type routingHosts struct {
+	mu    sync.RWMutex
+	hosts map[string][]string
+}
+
+// set replaces the known hosts with the inventory ones
+func (rh *routingHosts) set(r transit.InventoryRequest) {
+	hosts := makeHostGroups(r.Groups)
+	for _, res := range r.Resources {
+		if _, ok := hosts[res.Name]; !ok {
+			hosts[res.Name] = nil
+		}
+	}
+	rh.mu.Lock()
+	rh.hosts = hosts
+	rh.mu.Unlock()
+}
+
+// item returns the routing item of host with known groups
+func (rh *routingHosts) item(appType, host, service string) routingItem {
+	item := routingItem{AppType: appType, Host: host, Service: service, NoGroups: true}
+	if rh == nil {
+		return item
+	}
+	rh.mu.RLock()
+	defer rh.mu.RUnlock()
+	if groups, ok := rh.hosts[host]; ok {
+		item.Groups, item.NoGroups = groups, false
+	}
+	return item
+}
+
+// allow checks the payload item
+func (rules routingRules) allow(pt payloadType, item routingItem) bool {
+	hasIncludes, isIncluded := false, false
+	for _, rule := range rules {
+		if !ruleAppliesTo(rule, pt) {
+			continue
+		}
+		if rule.Exclude {
+			if ruleMatches(rule, item) {
+				return false
+			}
+			continue
+		}
+		hasIncludes = true
+		isIncluded = isIncluded || ruleMatches(rule, item)
+	}
+	return !hasIncludes || isIncluded
+}
+
+// filter applies rules to payload
+// the inventory updates the known hosts used for the items which carry no groups
+// returns errSkipPayload if there is nothing to deliver
+func (rules routingRules) filter(p natsPayload, appType string, hosts *routingHosts) ([]byte, error) {
+	if len(rules) == 0 {
+		return p.Payload, nil
+	}
+	var (
+		v       interface{}
+		isEmpty bool
+	)
+	switch p.Type {
+	case typeEvents:
+		r := transit.GroundworkEventsRequest{}
+		if err := json.Unmarshal(p.Payload, &r); err != nil {
+			return nil, err
+		}
+		events := make([]transit.GroundworkEvent, 0, len(r.Events))
+		for _, e := range r.Events {
+			if rules.allow(p.Type, hosts.item(e.AppType, e.Host, e.Service)) {
+				events = append(events, e)
+			}
+		}
+		r.Events = events
+		v, isEmpty = r, len(events) == 0
+
+	case typeEventsAck:
+		r := transit.GroundworkEventsAckRequest{}
+		if err := json.Unmarshal(p.Payload, &r); err != nil {
+			return nil, err
+		}
+		acks := make([]transit.GroundworkEventAck, 0, len(r.Acks))
+		for _, e := range r.Acks {
+			if rules.allow(p.Type, hosts.item(e.AppType, e.Host, e.Service)) {
+				acks = append(acks, e)
+			}
+		}
+		r.Acks = acks
+		v, isEmpty = r, len(acks) == 0
+
+	case typeEventsUnack:
+		r := transit.GroundworkEventsUnackRequest{}
+		if err := json.Unmarshal(p.Payload, &r); err != nil {
+			return nil, err
+		}
+		unacks := make([]transit.GroundworkEventUnack, 0, len(r.Unacks))
+		for _, e := range r.Unacks {
+			if rules.allow(p.Type, hosts.item(e.AppType, e.Host, e.Service)) {
+				unacks = append(unacks, e)
+			}
+		}
+		r.Unacks = unacks
+		v, isEmpty = r, len(unacks) == 0
+
+	case typeInventory:
+		r := transit.InventoryRequest{}
+		if err := json.Unmarshal(p.Payload, &r); err != nil {
+			return nil, err
+		}
+		if r.Context != nil {
+			appType = r.Context.AppType
+		}
+		if hosts != nil {
+			hosts.set(r)
+		}
+		hostGroups := makeHostGroups(r.Groups)
+		resources := make([]transit.InventoryResource, 0, len(r.Resources))
+		for _, res := range r.Resources {
+			item := routingItem{AppType: appType, Host: res.Name, Groups: hostGroups[res.Name]}
+			svcs := make([]transit.InventoryService, 0, len(res.Services))
+			for _, svc := range res.Services {
+				item.Service = svc.Name
+				if rules.allow(p.Type, item) {
+					svcs = append(svcs, svc)
+				}
+			}
+			item.Service = ""
+			if len(svcs) > 0 || rules.allow(p.Type, item) {
+				res.Services = svcs
+				resources = append(resources, res)
+			}
+		}
+		r.Resources, r.Groups = resources, filterGroups(r.Groups, resources)
+		v, isEmpty = r, len(resources) == 0
+
+	case typeMetrics:
+		r := transit.ResourcesWithServicesRequest{}
+		if err := json.Unmarshal(p.Payload, &r); err != nil {
+			return nil, err
+		}
+		if r.Context != nil {
+			appType = r.Context.AppType
+		}
+		hostGroups := makeHostGroups(r.Groups)
+		resources := make([]transit.MonitoredResource, 0, len(r.Resources))
+		for _, res := range r.Resources {
+			item := routingItem{AppType: appType, Host: res.Name, Groups: hostGroups[res.Name]}
+			if _, ok := hostGroups[res.Name]; !ok {
+				/* the payload carries no groups of host */
+				item = hosts.item(appType, res.Name, "")
+			}
+			svcs := make([]transit.MonitoredService, 0, len(res.Services))
+			for _, svc := range res.Services {
+				item.Service = svc.Name
+				if rules.allow(p.Type, item) {
+					svcs = append(svcs, svc)
+				}
+			}
+			item.Service = ""
+			if len(svcs) > 0 || rules.allow(p.Type, item) {
+				res.Services = svcs
+				resources = append(resources, res)
+			}
+		}
+		names := make([]transit.InventoryResource, len(resources))
+		for i := range resources {
+			names[i].Name = resources[i].Name
+		}
+		r.Resources, r.Groups = resources, filterGroups(r.Groups, names)
+		v, isEmpty = r, len(resources) == 0
+
+	case typeClearInDowntime:
+		r := transit.Downtimes{}
+		if err := json.Unmarshal(p.Payload, &r); err != nil {
+			return nil, err
+		}
+		downtimes := make([]transit.Downtime, 0, len(r.BizHostServiceInDowntimes))
+		for _, d := range r.BizHostServiceInDowntimes {
+			if rules.allow(p.Type, hosts.item(appType, d.HostName, d.ServiceDescription)) {
+				downtimes = append(downtimes, d)
+			}
+		}
+		r.BizHostServiceInDowntimes = downtimes
+		v, isEmpty = r, len(downtimes) == 0
+
+	case typeSetInDowntime:
+		/* the request addresses hosts and host groups separately
+		so, the host names checked without groups and vice versa */
+		r := transit.DowntimesRequest{}
+		if err := json.Unmarshal(p.Payload, &r); err != nil {
+			return nil, err
+		}
+		hosts := make([]string, 0, len(r.HostNames))
+		for _, h := range r.HostNames {
+			if rules.allow(p.Type, routingItem{AppType: appType, Host: h}) {
+				hosts = append(hosts, h)
+			}
+		}
+		groups := make([]string, 0, len(r.HostGroupNames))
+		for _, g := range r.HostGroupNames {
+			if rules.allow(p.Type, routingItem{AppType: appType, Groups: []string{g}}) {
+				groups = append(groups, g)
+			}
+		}
+		r.HostNames, r.HostGroupNames = hosts, groups
+		v, isEmpty = r, len(hosts)+len(groups) == 0
+
+	default:
+		return p.Payload, nil
+	}
+
+	if isEmpty {
+		return nil, errSkipPayload
+	}
+	return json.Marshal(v)
+}
+
+func ruleAppliesTo(rule clients.RoutingRule, pt payloadType) bool {
+	if len(rule.PayloadTypes) == 0 {
+		return true
+	}
+	for _, t := range rule.PayloadTypes {
+		if t == pt.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleMatches(rule clients.RoutingRule, item routingItem) bool {
+	if !globMatches(rule.HostName, item.Host) ||
+		!globMatches(rule.AppType, item.AppType) ||
+		!globMatches(rule.ServiceName, item.Service) {
+		return false
+	}
+	if rule.HostGroup == "" {
+		return true
+	}
+	if item.NoGroups {
+		/* the group is unknown, so it neither includes nor excludes */
+		return false
+	}
+	for _, g := range item.Groups {
+		if globMatches(rule.HostGroup, g) {
+			return true
+		}
+	}
+	return false
+}
+
+func globMatches(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+// makeHostGroups maps resource names to host group names
+func makeHostGroups(groups []transit.ResourceGroup) map[string][]string {
+	m := make(map[string][]string)
+	for _, g := range groups {
+		if g.Type != transit.HostGroup {
+			continue
+		}
+		for _, ref := range g.Resources {
+			m[ref.Name] = append(m[ref.Name], g.GroupName)
+		}
+	}
+	return m
+}
+
+// filterGroups keeps the refs to delivered resources only and omits empty groups
+func filterGroups(groups []transit.ResourceGroup, resources []transit.InventoryResource) []transit.ResourceGroup {
+	if len(groups) == 0 {
+		return groups
+	}
+	names := make(map[string]bool, len(resources))
+	for _, res := range resources {
+		names[res.Name] = true
+	}
+	result := make([]transit.ResourceGroup, 0, len(groups))
+	for _, g := range groups {
+		refs := make([]transit.ResourceRef, 0, len(g.Resources))
+		for _, ref := range g.Resources {
+			/* service refs have the host in owner field */
+			if names[ref.Name] || (ref.Owner != "" && names[ref.Owner]) {
+				refs = append(refs, ref)
+			}
+		}
+		if len(refs) > 0 {
+			g.Resources = refs
+			result = append(result, g)
+		}
+	}
+	return result
+}
+
+// wrap returns the handler which delivers the payload filtered by rules
+// the hosts are shared by handlers of TCG Connection to route by groups from inventory
+func (rules routingRules) wrap(appType string, hosts *routingHosts, handler func(context.Context, natsPayload) error) func(context.Context, natsPayload) error {
+	if len(rules) == 0 {
+		return handler
+	}
+	return func(ctx context.Context, p natsPayload) error {
+		payload, err := rules.filter(p, appType, hosts)
+		if err != nil {
+			return err
+		}
+		p.Payload = payload
+		return handler(ctx, p)
+	}
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gwos/tcg/clients"
+	"github.com/gwos/tcg/sdk/transit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutingRules_filterEvents(t *testing.T) {
+	payload, _ := json.Marshal(transit.GroundworkEventsRequest{
+		Events: []transit.GroundworkEvent{
+			{Host: "web-01", Service: "http", AppType: "VEMA"},
+			{Host: "db-01", Service: "mysql", AppType: "VEMA"},
+			{Host: "web-02", Service: "ssh", AppType: "VEMA"},
+		},
+	})
+	p := natsPayload{Payload: payload, Type: typeEvents}
+
+	rules := routingRules{
+		{HostName: "web-*"},
+		{Exclude: true, ServiceName: "ssh"},
+	}
+	b, err := rules.filter(p, "", nil)
+	assert.NoError(t, err)
+	r := transit.GroundworkEventsRequest{}
+	assert.NoError(t, json.Unmarshal(b, &r))
+	assert.Len(t, r.Events, 1)
+	assert.Equal(t, "web-01", r.Events[0].Host)
+
+	rules = routingRules{{HostName: "app-*"}}
+	_, err = rules.filter(p, "", nil)
+	assert.ErrorIs(t, err, errSkipPayload)
+
+	rules = routingRules{{PayloadTypes: []string{typeMetrics.String()}, HostName: "app-*"}}
+	b, err = rules.filter(p, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, b)
+}
+
+func TestRoutingRules_filterEventsByHostGroup(t *testing.T) {
+	payload, _ := json.Marshal(transit.GroundworkEventsRequest{
+		Events: []transit.GroundworkEvent{
+			{Host: "web-01", Service: "http", AppType: "VEMA"},
+			{Host: "db-01", Service: "mysql", AppType: "VEMA"},
+		},
+	})
+	p := natsPayload{Payload: payload, Type: typeEvents}
+
+	/* events carry no groups, the unknown hosts don't match HostGroup rules */
+	hosts := &routingHosts{}
+	rules := routingRules{{HostGroup: "web"}}
+	_, err := rules.filter(p, "", hosts)
+	assert.ErrorIs(t, err, errSkipPayload)
+
+	/* the groups of hosts are taken from inventory */
+	inventory, _ := json.Marshal(transit.InventoryRequest{
+		Resources: []transit.InventoryResource{
+			{BaseResource: transit.BaseResource{BaseInfo: transit.BaseInfo{Name: "web-01"}}},
+			{BaseResource: transit.BaseResource{BaseInfo: transit.BaseInfo{Name: "db-01"}}},
+		},
+		Groups: []transit.ResourceGroup{
+			{GroupName: "web", Type: transit.HostGroup, Resources: []transit.ResourceRef{{Name: "web-01"}}},
+			{GroupName: "db", Type: transit.HostGroup, Resources: []transit.ResourceRef{{Name: "db-01"}}},
+		},
+	})
+	_, err = rules.filter(natsPayload{Payload: inventory, Type: typeInventory}, "", hosts)
+	assert.NoError(t, err)
+
+	b, err := rules.filter(p, "", hosts)
+	assert.NoError(t, err)
+	r := transit.GroundworkEventsRequest{}
+	assert.NoError(t, json.Unmarshal(b, &r))
+	assert.Len(t, r.Events, 1)
+	assert.Equal(t, "web-01", r.Events[0].Host)
+
+	rules = routingRules{{Exclude: true, HostGroup: "db"}}
+	b, err = rules.filter(p, "", hosts)
+	assert.NoError(t, err)
+	r = transit.GroundworkEventsRequest{}
+	assert.NoError(t, json.Unmarshal(b, &r))
+	assert.Len(t, r.Events, 1)
+	assert.Equal(t, "web-01", r.Events[0].Host)
+}
+
+func TestRoutingRules_filterMetricsWithoutGroups(t *testing.T) {
+	payload, _ := json.Marshal(transit.ResourcesWithServicesRequest{
+		Resources: []transit.MonitoredResource{
+			{BaseResource: transit.BaseResource{BaseInfo: transit.BaseInfo{Name: "web-01"}}},
+			{BaseResource: transit.BaseResource{BaseInfo: transit.BaseInfo{Name: "db-01"}}},
+			{BaseResource: transit.BaseResource{BaseInfo: transit.BaseInfo{Name: "new-01"}}},
+		},
+	})
+	p := natsPayload{Payload: payload, Type: typeMetrics}
+
+	hosts := &routingHosts{}
+	hosts.set(transit.InventoryRequest{
+		Resources: []transit.InventoryResource{
+			{BaseResource: transit.BaseResource{BaseInfo: transit.BaseInfo{Name: "web-01"}}},
+			{BaseResource: transit.BaseResource{BaseInfo: transit.BaseInfo{Name: "db-01"}}},
+		},
+		Groups: []transit.ResourceGroup{
+			{GroupName: "web", Type: transit.HostGroup, Resources: []transit.ResourceRef{{Name: "web-01"}}},
+		},
+	})
+
+	rules := routingRules{{HostGroup: "web"}}
+	b, err := rules.filter(p, "", hosts)
+	assert.NoError(t, err)
+	r := transit.ResourcesWithServicesRequest{}
+	assert.NoError(t, json.Unmarshal(b, &r))
+	assert.Len(t, r.Resources, 1)
+	assert.Equal(t, "web-01", r.Resources[0].Name)
+}
+
+func TestRoutingRules_filterMetrics(t *testing.T) {
+	payload, _ := json.Marshal(transit.ResourcesWithServicesRequest{
+		Context: &transit.TracerContext{AppType: "VEMA"},
+		Resources: []transit.MonitoredResource{
+			{
+				BaseResource: transit.BaseResource{BaseInfo: transit.BaseInfo{Name: "web-01"}},
+				Services: []transit.MonitoredService{
+					{BaseInfo: transit.BaseInfo{Name: "http"}},
+					{BaseInfo: transit.BaseInfo{Name: "ssh"}},
+				},
+			},
+			{
+				BaseResource: transit.BaseResource{BaseInfo: transit.BaseInfo{Name: "db-01"}},
+			},
+		},
+		Groups: []transit.ResourceGroup{
+			{GroupName: "web", Type: transit.HostGroup, Resources: []transit.ResourceRef{{Name: "web-01"}}},
+			{GroupName: "db", Type: transit.HostGroup, Resources: []transit.ResourceRef{{Name: "db-01"}}},
+		},
+	})
+	p := natsPayload{Payload: payload, Type: typeMetrics}
+
+	rules := routingRules{
+		{HostGroup: "web", AppType: "VEMA"},
+		{Exclude: true, ServiceName: "ssh"},
+	}
+	b, err := rules.filter(p, "", nil)
+	assert.NoError(t, err)
+	r := transit.ResourcesWithServicesRequest{}
+	assert.NoError(t, json.Unmarshal(b, &r))
+	assert.Len(t, r.Resources, 1)
+	assert.Equal(t, "web-01", r.Resources[0].Name)
+	assert.Len(t, r.Resources[0].Services, 1)
+	assert.Equal(t, "http", r.Resources[0].Services[0].Name)
+	assert.Len(t, r.Groups, 1)
+	assert.Equal(t, "web", r.Groups[0].GroupName)
+}
+
+func TestRoutingRules_filterDowntimes(t *testing.T) {
+	payload, _ := json.Marshal(transit.DowntimesRequest{
+		HostNames:      []string{"web-01", "db-01"},
+		HostGroupNames: []string{"web", "db"},
+	})
+	p := natsPayload{Payload: payload, Type: typeSetInDowntime}
+
+	rules := routingRules{
+		{Exclude: true, HostName: "db-*"},
+		{Exclude: true, HostGroup: "db"},
+	}
+	b, err := rules.filter(p, "VEMA", nil)
+	assert.NoError(t, err)
+	r := transit.DowntimesRequest{}
+	assert.NoError(t, json.Unmarshal(b, &r))
+	assert.Equal(t, []string{"web-01"}, r.HostNames)
+	assert.Equal(t, []string{"web"}, r.HostGroupNames)
+
+	rules = routingRules{{AppType: "NAGIOS"}}
+	_, err = rules.filter(p, "VEMA", nil)
+	assert.ErrorIs(t, err, errSkipPayload)
+}
+
+func TestRoutingRules_allowWithoutRules(t *testing.T) {
+	assert.True(t, routingRules(nil).allow(typeEvents, routingItem{Host: "any"}))
+	assert.True(t, routingRules([]clients.RoutingRule{{Exclude: true, HostName: "other"}}).
+		allow(typeEvents, routingItem{Host: "any"}))
+}
@@ -0,0 +1,244 @@
+package services
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gwos/tcg/batcher"
+	"github.com/gwos/tcg/nats"
+	tcgerr "github.com/gwos/tcg/sdk/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/rs/zerolog/log"
+)
+
+// selfMetrics keeps the Prometheus metrics of agent itself
+// served by controller on the "/metrics" route
+var selfMetrics = newSelfMetrics()
+
+type agentMetrics struct {
+	registry *prometheus.Registry
+
+	published      *prometheus.CounterVec
+	dispatched     *prometheus.CounterVec
+	dispatchTime   *prometheus.HistogramVec
+	dispatchErrors *prometheus.CounterVec
+	tasks          *prometheus.CounterVec
+	taskAlarms     *prometheus.CounterVec
+	requests       *prometheus.CounterVec
+	requestTime    *prometheus.HistogramVec
+}
+
+func newSelfMetrics() *agentMetrics {
+	m := &agentMetrics{
+		registry: prometheus.NewRegistry(),
+
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcg_published_total",
+			Help: "Number of payloads published to queue.",
+		}, []string{"subject", "payload_type", "result"}),
+		dispatched: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcg_dispatched_total",
+			Help: "Number of payloads delivered to upstream by dispatcher.",
+		}, []string{"subject", "payload_type", "result"}),
+		dispatchTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tcg_dispatch_duration_seconds",
+			Help:    "Duration of payload delivery to upstream.",
+			Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"subject", "payload_type"}),
+		dispatchErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcg_dispatch_errors_total",
+			Help: "Number of failed deliveries by error class.",
+		}, []string{"class"}),
+		tasks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcg_tasks_total",
+			Help: "Number of processed tasks of agent.",
+		}, []string{"subject", "result"}),
+		taskAlarms: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcg_task_alarms_total",
+			Help: "Number of tasks of agent timed over.",
+		}, []string{"subject"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcg_controller_requests_total",
+			Help: "Number of requests handled by controller.",
+		}, []string{"method", "route", "code"}),
+		requestTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tcg_controller_request_duration_seconds",
+			Help:    "Duration of requests handled by controller.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.published,
+		m.dispatched,
+		m.dispatchTime,
+		m.dispatchErrors,
+		m.tasks,
+		m.taskAlarms,
+		m.requests,
+		m.requestTime,
+		newStateCollector(),
+	)
+	return m
+}
+
+func (m *agentMetrics) observePublish(subj string, pt payloadType, err error) {
+	m.published.WithLabelValues(subj, pt.String(), resultLabel(err)).Inc()
+}
+
+func (m *agentMetrics) observeDispatch(subj string, pt payloadType, d time.Duration, err error) {
+	m.dispatched.WithLabelValues(subj, pt.String(), resultLabel(err)).Inc()
+	m.dispatchTime.WithLabelValues(subj, pt.String()).Observe(d.Seconds())
+	if err != nil {
+		m.dispatchErrors.WithLabelValues(errorClass(err)).Inc()
+	}
+}
+
+func (m *agentMetrics) observeTask(subj taskSubject, err error) {
+	m.tasks.WithLabelValues(string(subj), resultLabel(err)).Inc()
+}
+
+func (m *agentMetrics) observeTaskAlarm(subj taskSubject) {
+	m.taskAlarms.WithLabelValues(string(subj)).Inc()
+}
+
+// observeRequest is middleware measuring the controller requests
+func (m *agentMetrics) observeRequest(c *gin.Context) {
+	t0 := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	m.requests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	m.requestTime.WithLabelValues(c.Request.Method, route).Observe(time.Since(t0).Seconds())
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// errorClass returns the label for sdk/errors class
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, tcgerr.ErrGateway):
+		return "gateway"
+	case errors.Is(err, tcgerr.ErrSynchronizer):
+		return "synchronizer"
+	case errors.Is(err, tcgerr.ErrTransient):
+		return "transient"
+	case errors.Is(err, tcgerr.ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, tcgerr.ErrUndecided):
+		return "undecided"
+	case errors.Is(err, tcgerr.ErrPermanent):
+		return "permanent"
+	default:
+		return "other"
+	}
+}
+
+// stateCollector collects the current state of queue, dispatcher and batchers on scrape
+type stateCollector struct {
+	descQueueMsgs       *prometheus.Desc
+	descQueueBytes      *prometheus.Desc
+	descQueuePending    *prometheus.Desc
+	descQueueAckPending *prometheus.Desc
+	descBreakerOpen     *prometheus.Desc
+	descRetryAttempts   *prometheus.Desc
+	descRetries         *prometheus.Desc
+	descDeadLetters     *prometheus.Desc
+	descBatcherLen      *prometheus.Desc
+	descBatcherSize     *prometheus.Desc
+	descBatcherFlushes  *prometheus.Desc
+}
+
+func newStateCollector() *stateCollector {
+	return &stateCollector{
+		descQueueMsgs: prometheus.NewDesc("tcg_queue_messages",
+			"Number of messages kept in queue.", []string{"subject"}, nil),
+		descQueueBytes: prometheus.NewDesc("tcg_queue_bytes",
+			"Size of messages kept in queue.", []string{"subject"}, nil),
+		descQueuePending: prometheus.NewDesc("tcg_queue_pending",
+			"Number of messages not delivered to durable yet.", []string{"durable"}, nil),
+		descQueueAckPending: prometheus.NewDesc("tcg_queue_ack_pending",
+			"Number of messages delivered to durable and not acknowledged.", []string{"durable"}, nil),
+		descBreakerOpen: prometheus.NewDesc("tcg_dispatch_breaker_open",
+			"Circuit breaker of durable is open or half-open.", []string{"durable"}, nil),
+		descRetryAttempts: prometheus.NewDesc("tcg_dispatch_retry_attempts",
+			"Number of retries of the current failed delivery.", []string{"durable"}, nil),
+		descRetries: prometheus.NewDesc("tcg_dispatch_retries_total",
+			"Number of planned retries of delivery.", []string{"durable"}, nil),
+		descDeadLetters: prometheus.NewDesc("tcg_dispatch_dead_letters_total",
+			"Number of messages moved to dead letters.", []string{"durable"}, nil),
+		descBatcherLen: prometheus.NewDesc("tcg_batcher_buffer_payloads",
+			"Number of payloads in batch buffer.", []string{"batcher"}, nil),
+		descBatcherSize: prometheus.NewDesc("tcg_batcher_buffer_bytes",
+			"Size of payloads in batch buffer.", []string{"batcher"}, nil),
+		descBatcherFlushes: prometheus.NewDesc("tcg_batcher_flushes_total",
+			"Number of flushed batches.", []string{"batcher"}, nil),
+	}
+}
+
+// Describe implements prometheus.Collector interface
+func (sc *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		sc.descQueueMsgs, sc.descQueueBytes, sc.descQueuePending, sc.descQueueAckPending,
+		sc.descBreakerOpen, sc.descRetryAttempts, sc.descRetries, sc.descDeadLetters,
+		sc.descBatcherLen, sc.descBatcherSize, sc.descBatcherFlushes,
+	} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector interface
+func (sc *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	/* queue is unavailable while nats stopped */
+	if stats, err := nats.Stats(); err == nil {
+		for _, st := range stats.Subjects {
+			ch <- prometheus.MustNewConstMetric(sc.descQueueMsgs, prometheus.GaugeValue, float64(st.Msgs), st.Subject)
+			ch <- prometheus.MustNewConstMetric(sc.descQueueBytes, prometheus.GaugeValue, float64(st.Bytes), st.Subject)
+		}
+		for _, dur := range stats.Durables {
+			ch <- prometheus.MustNewConstMetric(sc.descQueuePending, prometheus.GaugeValue, float64(dur.NumPending), dur.DurableName)
+			ch <- prometheus.MustNewConstMetric(sc.descQueueAckPending, prometheus.GaugeValue, float64(dur.NumAckPending), dur.DurableName)
+		}
+	} else {
+		log.Debug().Err(err).Msg("could not collect queue stats")
+	}
+
+	for _, st := range nats.BreakerStates() {
+		var open float64
+		if st.State != nats.BreakerClosed {
+			open = 1
+		}
+		ch <- prometheus.MustNewConstMetric(sc.descBreakerOpen, prometheus.GaugeValue, open, st.DurableName)
+		ch <- prometheus.MustNewConstMetric(sc.descRetryAttempts, prometheus.GaugeValue, float64(st.Attempts), st.DurableName)
+	}
+	for _, c := range nats.Counters() {
+		ch <- prometheus.MustNewConstMetric(sc.descRetries, prometheus.CounterValue, float64(c.Retries), c.DurableName)
+		ch <- prometheus.MustNewConstMetric(sc.descDeadLetters, prometheus.CounterValue, float64(c.DeadLetters), c.DurableName)
+	}
+
+	/* the agent without transit service has no batchers */
+	ts := createdTransitService()
+	if ts == nil {
+		return
+	}
+	for name, bt := range map[string]*batcher.Batcher{
+		"events":  ts.eventsBatcher,
+		"metrics": ts.metricsBatcher,
+	} {
+		st := bt.Stats()
+		ch <- prometheus.MustNewConstMetric(sc.descBatcherLen, prometheus.GaugeValue, float64(st.BufLen), name)
+		ch <- prometheus.MustNewConstMetric(sc.descBatcherSize, prometheus.GaugeValue, float64(st.BufSize), name)
+		ch <- prometheus.MustNewConstMetric(sc.descBatcherFlushes, prometheus.CounterValue, float64(st.Flushes), name)
+	}
+}
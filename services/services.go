@@ -9,7 +9,9 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/gwos/tcg/config"
 	"github.com/gwos/tcg/logzer"
+	"github.com/gwos/tcg/nats"
 	"github.com/gwos/tcg/sdk/transit"
 	"github.com/gwos/tcg/taskQueue"
 	"go.opentelemetry.io/otel/trace"
@@ -24,6 +26,13 @@ const (
 	subjInventoryMetrics = "inventory-metrics"
 )
 
+// durableEventsAck defines durable name part
+// for events actions processed separately from events on the same subject
+const durableEventsAck = "events-ack"
+
+// errSkipPayload used by dispatcher handler for payload processed by another durable
+var errSkipPayload = fmt.Errorf("skip payload")
+
 // Status defines status value
 type Status string
 
@@ -43,9 +52,46 @@ type AgentStats struct {
 	LastInventoryRun       *transit.Timestamp `json:"lastInventoryRun,omitempty"`
 	LastMetricsRun         *transit.Timestamp `json:"lastMetricsRun,omitempty"`
 	LastAlertRun           *transit.Timestamp `json:"lastAlertRun,omitempty"`
+	LastAlertActionRun     *transit.Timestamp `json:"lastAlertActionRun,omitempty"`
 	ExecutionTimeInventory time.Duration      `json:"executionTimeInventory"`
 	ExecutionTimeMetrics   time.Duration      `json:"executionTimeMetrics"`
 	UpSince                *transit.Timestamp `json:"upSince"`
+	CountingSince          *transit.Timestamp `json:"countingSince"`
+
+	// PayloadTypes counts the delivered messages by payload type
+	PayloadTypes map[string]int `json:"payloadTypes"`
+	// Connections counts the deliveries by TCG connection host name
+	Connections map[string]*ConnectionStats `json:"connections"`
+	Last1h      StatsWindow                 `json:"last1h"`
+	Last24h     StatsWindow                 `json:"last24h"`
+	// EventsDropped counts the events dropped by batching
+	EventsDropped EventsDroppedStats `json:"eventsDropped"`
+}
+
+// EventsDroppedStats defines the counts of events dropped by suppression and host rate limit
+type EventsDroppedStats struct {
+	Suppressed  int                `json:"suppressed"`
+	RateLimited int                `json:"rateLimited"`
+	LastDropped *transit.Timestamp `json:"lastDropped,omitempty"`
+	// Hosts counts the dropped events by host
+	Hosts map[string]int `json:"hosts,omitempty"`
+}
+
+// StatsWindow defines the counts of rolling window
+type StatsWindow struct {
+	BytesSent      int `json:"bytesSent"`
+	MessagesSent   int `json:"messagesSent"`
+	MessagesFailed int `json:"messagesFailed"`
+}
+
+// ConnectionStats defines the delivery counts of TCG connection
+type ConnectionStats struct {
+	MessagesSent   int                `json:"messagesSent"`
+	MessagesFailed int                `json:"messagesFailed"`
+	LastSent       *transit.Timestamp `json:"lastSent,omitempty"`
+	LastFailed     *transit.Timestamp `json:"lastFailed,omitempty"`
+	// FailingSince is set on the first failure after success
+	FailingSince *transit.Timestamp `json:"failingSince,omitempty"`
 }
 
 // AgentStatsExt defines complex type
@@ -55,6 +101,22 @@ type AgentStatsExt struct {
 	LastErrors []logzer.LogRecord `json:"lastErrors"`
 }
 
+// ExitReport describes what was left undelivered on exit
+// EventsLeft and MetricsLeft count the payloads not processed by batchers, they are lost
+// Undelivered lists the durables with messages left pending or not acknowledged by dispatcher,
+// they are kept for the next run with the "FILE" NATS store
+type ExitReport struct {
+	EventsLeft  int                 `json:"eventsLeft"`
+	MetricsLeft int                 `json:"metricsLeft"`
+	Undelivered []nats.DurableStats `json:"undelivered,omitempty"`
+	TimedOut    bool                `json:"timedOut"`
+}
+
+// Drained returns true if nothing was left undelivered
+func (r ExitReport) Drained() bool {
+	return r.EventsLeft == 0 && r.MetricsLeft == 0 && len(r.Undelivered) == 0
+}
+
 // AgentStatus defines TCG Agent status
 type AgentStatus struct {
 	task       *taskQueue.Task
@@ -66,13 +128,122 @@ type AgentStatus struct {
 // ConnectorStatusDTO describes status
 type ConnectorStatusDTO struct {
 	Status Status `json:"connectorStatus"`
-	JobID  uint8  `json:"jobId,omitempty"`
+	JobID  uint64 `json:"jobId,omitempty"`
+}
+
+// ConfigValidationDTO describes the result of config validation
+type ConfigValidationDTO struct {
+	Valid bool `json:"valid"`
+	config.Validation
+}
+
+// StatusDTO describes status with circuit breakers of dispatcher
+type StatusDTO struct {
+	ConnectorStatusDTO
+	Breakers []nats.BreakerState `json:"breakers,omitempty"`
+}
+
+// ProbeDTO describes the result of health or readiness probe
+// the Status is "ok" if all checks passed, otherwise "fail"
+type ProbeDTO struct {
+	Status string          `json:"status"`
+	Checks []ProbeCheckDTO `json:"checks"`
+}
+
+// ProbeCheckDTO describes the check of component
+type ProbeCheckDTO struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// TaskDTO describes the state of asynchronous task
+// the Status is "waiting", "processing", "success" or "failure"
+type TaskDTO struct {
+	ID        uint64     `json:"id"`
+	Subject   string     `json:"subject"`
+	Status    string     `json:"status"`
+	Submitted time.Time  `json:"submitted"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// QueueDTO describes the state of queue
+type QueueDTO struct {
+	Subjects []QueueSubjectDTO `json:"subjects"`
+	Durables []QueueDurableDTO `json:"durables"`
+}
+
+// QueueSubjectDTO describes the messages kept for subject
+// OldestAgeSeconds is the age of the first message in seconds
+type QueueSubjectDTO struct {
+	nats.SubjectStats
+	OldestAgeSeconds float64 `json:"oldestAgeSeconds"`
+}
+
+// QueueDurableDTO describes the delivery state of durable with retry state of dispatcher
+type QueueDurableDTO struct {
+	nats.DurableStats
+	Retry *nats.BreakerState `json:"retry,omitempty"`
+}
+
+// QueuePurgeDTO selects messages to purge, empty fields match any
+// the empty Subject selects subjects of payloads, at least one field is required
+// OlderThan accepts duration string like "1h30m"
+type QueuePurgeDTO struct {
+	Subject     string `json:"subject,omitempty"`
+	OlderThan   string `json:"olderThan,omitempty"`
+	PayloadType string `json:"payloadType,omitempty"`
+}
+
+// QueueResetDTO selects durable to reset
+// the zero StartSeq moves durable to new messages
+type QueueResetDTO struct {
+	DurableName string `json:"durableName"`
+	StartSeq    uint64 `json:"startSeq,omitempty"`
+}
+
+// QueueResultDTO describes the number of messages removed by purge or skipped by reset
+type QueueResultDTO struct {
+	Removed uint64 `json:"removed"`
+}
+
+// QueueMessageDTO describes the queued message
+// the Error is set if the message could not be decoded
+type QueueMessageDTO struct {
+	Sequence    uint64    `json:"sequence"`
+	Timestamp   time.Time `json:"timestamp"`
+	Type        string    `json:"type,omitempty"`
+	TraceID     string    `json:"traceID,omitempty"`
+	SpanID      string    `json:"spanID,omitempty"`
+	PayloadSize int       `json:"payloadSize"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// AuditRecord describes the state-changing call of controller
+// the payload is kept as digest only
+// the TaskIdx and TaskError are set for call processed with task
+type AuditRecord struct {
+	Time          time.Time `json:"time"`
+	AuthMethod    string    `json:"authMethod,omitempty"`
+	Identity      string    `json:"identity,omitempty"`
+	Role          string    `json:"role,omitempty"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	Method        string    `json:"method"`
+	Route         string    `json:"route"`
+	PayloadSize   int       `json:"payloadSize"`
+	PayloadDigest string    `json:"payloadDigest,omitempty"`
+	Status        int       `json:"status"`
+	TaskIdx       uint64    `json:"taskIdx,omitempty"`
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"`
 }
 
 // AgentServices defines TCG Agent services interface
 type AgentServices interface {
 	DemandConfig() error
-	Quit() <-chan struct{}
+	Quit() <-chan ExitReport
 	MakeTracerContext() *transit.TracerContext
 	RegisterConfigHandler(func([]byte))
 	RemoveConfigHandler()
@@ -82,8 +253,11 @@ type AgentServices interface {
 	RemoveExitHandler()
 	Stats() AgentStats
 	Status() AgentStatus
+	Health() ProbeDTO
+	Readiness() ProbeDTO
 
 	ExitAsync() (*taskQueue.Task, error)
+	ReloadConfigAsync() (*taskQueue.Task, error)
 	ResetNatsAsync() (*taskQueue.Task, error)
 	StartControllerAsync() (*taskQueue.Task, error)
 	StopControllerAsync() (*taskQueue.Task, error)
@@ -93,6 +267,7 @@ type AgentServices interface {
 	StopTransportAsync() (*taskQueue.Task, error)
 
 	Exit() error
+	ReloadConfig() error
 	ResetNats() error
 	StartController() error
 	StopController() error
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gwos/tcg/batcher"
 	"github.com/gwos/tcg/batcher/events"
@@ -19,11 +20,16 @@ type TransitService struct {
 
 	eventsBatcher  *batcher.Batcher
 	metricsBatcher *batcher.Batcher
+	// eventsBuilder keeps the suppression state, replaced on settings change only
+	eventsBuilder *events.EventsBatchBuilder
 }
 
 var onceTransitService sync.Once
 var transitService *TransitService
 
+// transitServiceCreated is set once the transit service is created
+var transitServiceCreated int32
+
 // GetTransitService implements Singleton pattern
 func GetTransitService() *TransitService {
 	onceTransitService.Do(func() {
@@ -31,22 +37,77 @@ func GetTransitService() *TransitService {
 			AgentService:       GetAgentService(),
 			listMetricsHandler: defaultListMetricsHandler,
 		}
+		transitService.eventsBuilder = transitService.newEventsBuilder()
 		transitService.eventsBatcher = batcher.NewBatcher(
-			new(events.EventsBatchBuilder),
+			transitService.eventsBuilder,
 			transitService.sendEvents,
 			transitService.Connector.BatchEvents,
-			transitService.Connector.BatchMaxBytes,
+			transitService.batchLimits(),
 		)
 		transitService.metricsBatcher = batcher.NewBatcher(
-			new(metrics.MetricsBatchBuilder),
+			transitService.newMetricsBuilder(),
 			transitService.sendMetrics,
 			transitService.Connector.BatchMetrics,
-			transitService.Connector.BatchMaxBytes,
+			transitService.batchLimits(),
 		)
+		atomic.StoreInt32(&transitServiceCreated, 1)
 	})
 	return transitService
 }
 
+// createdTransitService returns the transit service if it was already created, nil otherwise
+// it doesn't create the service with batchers as a side effect
+func createdTransitService() *TransitService {
+	if atomic.LoadInt32(&transitServiceCreated) == 0 {
+		return nil
+	}
+	return transitService
+}
+
+// batchPayloadReserve defines the bytes reserved for the NATS message envelope and tracer context
+const batchPayloadReserve = 4 * 1024
+
+// batchLimits returns the batcher limits
+// the batch payload is limited to fit NatsMaxPayload
+func (service *TransitService) batchLimits() batcher.Limits {
+	maxBytes := service.Connector.BatchMaxBytes
+	if max := int(service.Connector.NatsMaxPayload) - batchPayloadReserve; max > 0 && (maxBytes <= 0 || maxBytes > max) {
+		maxBytes = max
+	}
+	return batcher.Limits{
+		MaxItems:  service.Connector.BatchMaxItems,
+		MaxBytes:  maxBytes,
+		MaxBuffer: service.Connector.BatchMaxBuffer,
+	}
+}
+
+// resetBatchers applies the batching config
+// the builders are replaced to apply their settings
+func (service *TransitService) resetBatchers() {
+	if eb := service.eventsBuilder; eb.SuppressWindow != service.Connector.BatchSuppressEvents ||
+		eb.HostRate != service.Connector.BatchEventsHostRate {
+		service.eventsBuilder = service.newEventsBuilder()
+		service.eventsBatcher.SetBuilder(service.eventsBuilder)
+	}
+	service.metricsBatcher.SetBuilder(service.newMetricsBuilder())
+
+	limits := service.batchLimits()
+	service.eventsBatcher.Reset(service.Connector.BatchEvents, limits)
+	service.metricsBatcher.Reset(service.Connector.BatchMetrics, limits)
+}
+
+func (service *TransitService) newEventsBuilder() *events.EventsBatchBuilder {
+	return &events.EventsBatchBuilder{
+		SuppressWindow: service.Connector.BatchSuppressEvents,
+		HostRate:       service.Connector.BatchEventsHostRate,
+		OnDrop:         service.agentStats.addDropped,
+	}
+}
+
+func (service *TransitService) newMetricsBuilder() *metrics.MetricsBatchBuilder {
+	return &metrics.MetricsBatchBuilder{Coalesce: service.Connector.BatchCoalesceMetrics}
+}
+
 func defaultListMetricsHandler() ([]byte, error) {
 	return nil, fmt.Errorf("listMetricsHandler unavailable")
 }
@@ -85,6 +146,7 @@ func (service *TransitService) ClearInDowntime(ctx context.Context, payload []by
 		return err
 	}
 	err = nats.Publish(subjDowntime, b)
+	selfMetrics.observePublish(subjDowntime, typeClearInDowntime, err)
 	return err
 }
 
@@ -107,6 +169,7 @@ func (service *TransitService) SetInDowntime(ctx context.Context, payload []byte
 		return err
 	}
 	err = nats.Publish(subjDowntime, b)
+	selfMetrics.observePublish(subjDowntime, typeSetInDowntime, err)
 	return err
 }
 
@@ -115,8 +178,7 @@ func (service *TransitService) SendEvents(ctx context.Context, payload []byte) e
 	if service.Connector.BatchEvents == 0 {
 		return service.sendEvents(ctx, payload)
 	}
-	service.eventsBatcher.Add(payload)
-	return nil
+	return service.eventsBatcher.Add(ctx, payload)
 }
 
 func (service *TransitService) sendEvents(ctx context.Context, payload []byte) error {
@@ -137,6 +199,7 @@ func (service *TransitService) sendEvents(ctx context.Context, payload []byte) e
 		return err
 	}
 	err = nats.Publish(subjEvents, b)
+	selfMetrics.observePublish(subjEvents, typeEvents, err)
 	return err
 }
 
@@ -159,6 +222,7 @@ func (service *TransitService) SendEventsAck(ctx context.Context, payload []byte
 		return err
 	}
 	err = nats.Publish(subjEvents, b)
+	selfMetrics.observePublish(subjEvents, typeEventsAck, err)
 	return err
 }
 
@@ -181,6 +245,7 @@ func (service *TransitService) SendEventsUnack(ctx context.Context, payload []by
 		return err
 	}
 	err = nats.Publish(subjEvents, b)
+	selfMetrics.observePublish(subjEvents, typeEventsUnack, err)
 	return err
 }
 
@@ -189,8 +254,7 @@ func (service *TransitService) SendResourceWithMetrics(ctx context.Context, payl
 	if service.Connector.BatchMetrics == 0 {
 		return service.sendMetrics(ctx, payload)
 	}
-	service.metricsBatcher.Add(payload)
-	return nil
+	return service.metricsBatcher.Add(ctx, payload)
 }
 
 func (service *TransitService) sendMetrics(ctx context.Context, payload []byte) error {
@@ -215,6 +279,7 @@ func (service *TransitService) sendMetrics(ctx context.Context, payload []byte)
 		return err
 	}
 	err = nats.Publish(subjInventoryMetrics, b)
+	selfMetrics.observePublish(subjInventoryMetrics, typeMetrics, err)
 	return err
 }
 
@@ -241,5 +306,6 @@ func (service *TransitService) SynchronizeInventory(ctx context.Context, payload
 		return err
 	}
 	err = nats.Publish(subjInventoryMetrics, b)
+	selfMetrics.observePublish(subjInventoryMetrics, typeInventory, err)
 	return err
 }
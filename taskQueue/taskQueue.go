@@ -1,25 +1,55 @@
 package taskQueue
 
 import (
+	"context"
 	"fmt"
-	"math"
+	"sync"
 	"time"
 )
 
-const defaultCapacity = 8
+const (
+	defaultCapacity = 8
+	defaultHistory  = 64
+)
 
 var (
 	ErrTaskQueue          = fmt.Errorf("task queue error")
 	ErrTaskQueueCapacity  = fmt.Errorf("%w: capacity is exhausted", ErrTaskQueue)
 	ErrTaskQueueUndefined = fmt.Errorf("%w: undefined", ErrTaskQueue)
+	ErrTaskQueueNotFound  = fmt.Errorf("%w: task not found", ErrTaskQueue)
 )
 
 // Task defines queued task
 type Task struct {
 	done    chan error
 	Args    []interface{}
-	Idx     uint8
+	Idx     uint64
 	Subject Subject
+
+	record *taskRecord
+}
+
+// TaskState describes the task processing
+// the zero Started and Finished mean the task is waiting and processing accordingly
+type TaskState struct {
+	Idx       uint64
+	Subject   Subject
+	Submitted time.Time
+	Started   time.Time
+	Finished  time.Time
+	Err       error
+}
+
+// IsDone returns true for finished task
+func (st TaskState) IsDone() bool {
+	return !st.Finished.IsZero()
+}
+
+// taskRecord keeps the task state in history
+// the finished channel is closed on the task done
+type taskRecord struct {
+	state    TaskState
+	finished chan struct{}
 }
 
 // Done returns channel for result
@@ -40,8 +70,13 @@ type TaskQueue struct {
 	alarmHandler Handler
 	capacity     uint8
 	handlers     map[Subject]Handler
-	idx          uint8
 	queue        chan *Task
+
+	mu          sync.Mutex
+	idx         uint64
+	current     *taskRecord
+	history     []*taskRecord
+	historySize int
 }
 
 // PushAsync adds task into queue and returns immediately
@@ -49,13 +84,26 @@ func (q *TaskQueue) PushAsync(subj Subject, args ...interface{}) (*Task, error)
 	if _, ok := q.handlers[subj]; !ok {
 		return nil, fmt.Errorf("%w: %v", ErrTaskQueueUndefined, subj)
 	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
 	done := make(chan error, 1)
-	task := &Task{done: done, Args: args, Idx: q.idx + 1, Subject: subj}
+	record := &taskRecord{
+		state: TaskState{
+			Idx:       q.idx + 1,
+			Subject:   subj,
+			Submitted: time.Now(),
+		},
+		finished: make(chan struct{}),
+	}
+	task := &Task{done: done, Args: args, Idx: q.idx + 1, Subject: subj, record: record}
 	select {
 	case q.queue <- task:
 		q.idx = task.Idx
-		if q.idx > math.MaxUint8-1 {
-			q.idx = 0
+		q.history = append(q.history, record)
+		if len(q.history) > q.historySize {
+			q.history[0] = nil
+			q.history = q.history[1:]
 		}
 		return task, nil
 	default:
@@ -63,6 +111,61 @@ func (q *TaskQueue) PushAsync(subj Subject, args ...interface{}) (*Task, error)
 	}
 }
 
+// TaskState returns the state of task kept in history
+func (q *TaskQueue) TaskState(idx uint64) (TaskState, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if record := q.lookup(idx); record != nil {
+		return record.state, nil
+	}
+	return TaskState{}, fmt.Errorf("%w: %v", ErrTaskQueueNotFound, idx)
+}
+
+// Current returns the state of task in processing
+// returns false if there is no running task
+func (q *TaskQueue) Current() (TaskState, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.current == nil {
+		return TaskState{}, false
+	}
+	return q.current.state, true
+}
+
+// WaitTask returns the state of task kept in history after the task done
+// returns the current state on the context done
+func (q *TaskQueue) WaitTask(ctx context.Context, idx uint64) (TaskState, error) {
+	q.mu.Lock()
+	record := q.lookup(idx)
+	q.mu.Unlock()
+	if record == nil {
+		return TaskState{}, fmt.Errorf("%w: %v", ErrTaskQueueNotFound, idx)
+	}
+
+	select {
+	case <-record.finished:
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return record.state, nil
+}
+
+// lookup returns the record of task in history
+// the caller should hold the lock
+func (q *TaskQueue) lookup(idx uint64) *taskRecord {
+	if len(q.history) == 0 {
+		return nil
+	}
+	first := q.history[0].state.Idx
+	if idx < first || idx-first >= uint64(len(q.history)) {
+		return nil
+	}
+	return q.history[idx-first]
+}
+
 // PushSync adds task into queue and returns after task processing
 func (q *TaskQueue) PushSync(subj Subject, args ...interface{}) error {
 	if task, err := q.PushAsync(subj, args...); err != nil {
@@ -85,11 +188,24 @@ func (q *TaskQueue) runQueue() {
 			}(task)
 		}
 
+		q.mu.Lock()
+		task.record.state.Started = time.Now()
+		q.current = task.record
+		q.mu.Unlock()
+
 		handler := q.handlers[task.Subject]
 		err := handler(task)
 		if alarmTimer != nil {
 			alarmTimer.Stop()
 		}
+
+		q.mu.Lock()
+		task.record.state.Finished = time.Now()
+		task.record.state.Err = err
+		q.current = nil
+		close(task.record.finished)
+		q.mu.Unlock()
+
 		task.done <- err
 		close(task.done)
 	}
@@ -100,7 +216,7 @@ type TaskQueueOption func(*TaskQueue)
 
 // NewTaskQueue creates task queue
 func NewTaskQueue(opts ...TaskQueueOption) *TaskQueue {
-	q := &TaskQueue{capacity: defaultCapacity}
+	q := &TaskQueue{capacity: defaultCapacity, historySize: defaultHistory}
 	for _, optFn := range opts {
 		optFn(q)
 	}
@@ -125,6 +241,13 @@ func WithCapacity(c uint8) TaskQueueOption {
 	}
 }
 
+// WithHistory defines the number of latest tasks kept in history
+func WithHistory(n int) TaskQueueOption {
+	return func(q *TaskQueue) {
+		q.historySize = n
+	}
+}
+
 // WithHandlers defines tasks
 func WithHandlers(m map[Subject]Handler) TaskQueueOption {
 	return func(q *TaskQueue) {
@@ -1,6 +1,7 @@
 package taskQueue
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"testing"
@@ -103,12 +104,12 @@ func TestWithHandlers(t *testing.T) {
 	)
 	task, err = q.PushAsync(task1)
 	assert.NoError(t, err)
-	assert.Equal(t, uint8(1), task.Idx)
+	assert.Equal(t, uint64(1), task.Idx)
 	assert.Equal(t, Subject(task1), task.Subject)
 	assert.Equal(t, []interface{}(nil), task.Args)
 	task, err = q.PushAsync(task2, "data_arg", 1, true, []byte("data arg"))
 	assert.NoError(t, err)
-	assert.Equal(t, uint8(2), task.Idx)
+	assert.Equal(t, uint64(2), task.Idx)
 	assert.Equal(t, Subject(task2), task.Subject)
 	assert.Equal(t, []interface{}{"data_arg", 1, true, []byte("data arg")}, task.Args)
 
@@ -129,3 +130,55 @@ func TestWithHandlers(t *testing.T) {
 	assert.True(t, errors.Is(err, ErrTaskQueue))
 	assert.True(t, errors.Is(err, ErrTaskQueueUndefined))
 }
+
+func TestWithHistory(t *testing.T) {
+	release := make(chan struct{})
+	handlers := map[Subject]Handler{
+		"block": func(task *Task) error {
+			<-release
+			return nil
+		},
+		"fail": func(task *Task) error {
+			return errors.New("failed")
+		},
+	}
+	q := NewTaskQueue(WithHandlers(handlers), WithHistory(2))
+
+	task1, err := q.PushAsync("block")
+	assert.NoError(t, err)
+	task2, err := q.PushAsync("fail")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	st, err := q.WaitTask(ctx, task1.Idx)
+	assert.NoError(t, err)
+	assert.False(t, st.IsDone())
+	assert.Equal(t, Subject("block"), st.Subject)
+	assert.False(t, st.Submitted.IsZero())
+	assert.False(t, st.Started.IsZero())
+	current, ok := q.Current()
+	assert.True(t, ok)
+	assert.Equal(t, task1.Idx, current.Idx)
+
+	close(release)
+	st, err = q.WaitTask(context.Background(), task2.Idx)
+	assert.NoError(t, err)
+	assert.True(t, st.IsDone())
+	assert.EqualError(t, st.Err, "failed")
+	st, err = q.TaskState(task1.Idx)
+	assert.NoError(t, err)
+	assert.True(t, st.IsDone())
+	assert.NoError(t, st.Err)
+	_, ok = q.Current()
+	assert.False(t, ok)
+
+	/* the oldest task is evicted from history */
+	task3, err := q.PushAsync("fail")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), task3.Idx)
+	_, err = q.TaskState(task1.Idx)
+	assert.ErrorIs(t, err, ErrTaskQueueNotFound)
+	_, err = q.WaitTask(context.Background(), 100)
+	assert.ErrorIs(t, err, ErrTaskQueueNotFound)
+}